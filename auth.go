@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// digestChallenge is a parsed "WWW-Authenticate: Digest" challenge (RFC 7616)
+type digestChallenge struct {
+	realm     string
+	nonce     string
+	opaque    string
+	algorithm string // MD5, MD5-sess, SHA-256 or SHA-256-sess
+	qop       string // "auth" or empty for the legacy RFC 2069 scheme
+	stale     bool
+	nc        int // nonce count, incremented for every request using nonce
+}
+
+// authChallenge is one challenge of a WWW-Authenticate header (RFC 7235)
+type authChallenge struct {
+	scheme string            // lower case
+	params map[string]string // lower-cased names, unquoted values
+}
+
+// isTokenChar reports whether c may appear in an RFC 7230 token
+func isTokenChar(c byte) bool {
+	return c > ' ' && c < 0x7f && !strings.ContainsRune(`"(),/:;<=>?@[\]{}`, rune(c))
+}
+
+// readToken splits a leading token off s
+func readToken(s string) (token, rest string) {
+	i := 0
+	for i < len(s) && isTokenChar(s[i]) {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+// readAuthValue splits a leading token or quoted string off s, unquoting it
+func readAuthValue(s string) (value, rest string) {
+	if !strings.HasPrefix(s, `"`) {
+		return readToken(s)
+	}
+	var b strings.Builder
+	i := 1
+	for ; i < len(s) && s[i] != '"'; i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	if i < len(s) {
+		i++
+	}
+	return b.String(), s[i:]
+}
+
+// parseChallenges splits WWW-Authenticate headers into their challenges.
+// Several may share one header, separated by commas like their parameters;
+// a token followed by "=" is a parameter and any other token starts a new
+// challenge. Quoted strings are read whole, so a realm such as "Digest area"
+// cannot start a challenge of its own.
+func parseChallenges(headers []string) []authChallenge {
+	var challenges []authChallenge
+	for _, s := range headers {
+		current := -1
+		for {
+			s = strings.TrimLeft(s, " \t,")
+			if s == "" {
+				break
+			}
+			token, rest := readToken(s)
+			if token == "" {
+				// Not a token: skip to the next element
+				if end := strings.IndexByte(s[1:], ','); end >= 0 {
+					s = s[1+end:]
+					continue
+				}
+				break
+			}
+			after := strings.TrimLeft(rest, " \t")
+			if current < 0 || !strings.HasPrefix(after, "=") {
+				challenges = append(challenges, authChallenge{scheme: strings.ToLower(token), params: map[string]string{}})
+				current = len(challenges) - 1
+				s = rest
+				continue
+			}
+			if padding := strings.TrimLeft(after, "= \t"); padding == "" || padding[0] == ',' {
+				// A token68 credential such as Negotiate's; no parameters
+				s = padding
+				continue
+			}
+			var value string
+			value, s = readAuthValue(strings.TrimLeft(after[1:], " \t"))
+			challenges[current].params[strings.ToLower(token)] = value
+		}
+	}
+	return challenges
+}
+
+// parseDigestChallenge picks the strongest Digest challenge supported from the
+// WWW-Authenticate headers, preferring SHA-256 over MD5
+func parseDigestChallenge(headers []string) *digestChallenge {
+	var best *digestChallenge
+	for _, ch := range parseChallenges(headers) {
+		if ch.scheme != "digest" {
+			continue
+		}
+		p := ch.params
+		c := &digestChallenge{
+			realm:     p["realm"],
+			nonce:     p["nonce"],
+			opaque:    p["opaque"],
+			algorithm: p["algorithm"],
+			stale:     strings.EqualFold(p["stale"], "true"),
+		}
+		if c.algorithm == "" {
+			c.algorithm = "MD5"
+		}
+		for _, q := range strings.Split(p["qop"], ",") {
+			if strings.TrimSpace(q) == "auth" {
+				c.qop = "auth"
+			}
+		}
+		supported := digestHash(c.algorithm) != nil && (p["qop"] == "" || c.qop != "")
+		if c.nonce != "" && supported && (best == nil || strings.HasPrefix(strings.ToUpper(c.algorithm), "SHA-256")) {
+			best = c
+		}
+	}
+	return best
+}
+
+// hasBasicChallenge reports whether the WWW-Authenticate headers offer Basic
+func hasBasicChallenge(headers []string) bool {
+	for _, ch := range parseChallenges(headers) {
+		if ch.scheme == "basic" {
+			return true
+		}
+	}
+	return false
+}
+
+// digestHash returns the hash constructor for a Digest algorithm name
+func digestHash(algorithm string) func() hash.Hash {
+	switch strings.TrimSuffix(strings.ToUpper(algorithm), "-SESS") {
+	case "MD5":
+		return md5.New
+	case "SHA-256":
+		return sha256.New
+	}
+	return nil
+}
+
+// authorization computes the Authorization header for req. The caller must
+// hold the lock protecting c.nc.
+func (c *digestChallenge) authorization(req *http.Request, username, password string) string {
+	newHash := digestHash(c.algorithm)
+	h := func(s string) string {
+		hh := newHash()
+		io.WriteString(hh, s)
+		return hex.EncodeToString(hh.Sum(nil))
+	}
+
+	c.nc++
+	nc := fmt.Sprintf("%08x", c.nc)
+	cnonceBytes := make([]byte, 16)
+	rand.Read(cnonceBytes)
+	cnonce := hex.EncodeToString(cnonceBytes)
+
+	uri := req.URL.RequestURI()
+	ha1 := h(username + ":" + c.realm + ":" + password)
+	if strings.HasSuffix(strings.ToUpper(c.algorithm), "-SESS") {
+		ha1 = h(ha1 + ":" + c.nonce + ":" + cnonce)
+	}
+	ha2 := h(req.Method + ":" + uri)
+
+	var response string
+	if c.qop == "" {
+		response = h(ha1 + ":" + c.nonce + ":" + ha2)
+	} else {
+		response = h(strings.Join([]string{ha1, c.nonce, nc, cnonce, c.qop, ha2}, ":"))
+	}
+
+	parts := []string{
+		fmt.Sprintf(`username="%s"`, username),
+		fmt.Sprintf(`realm="%s"`, c.realm),
+		fmt.Sprintf(`nonce="%s"`, c.nonce),
+		fmt.Sprintf(`uri="%s"`, uri),
+		fmt.Sprintf(`algorithm=%s`, c.algorithm),
+		fmt.Sprintf(`response="%s"`, response),
+	}
+	if c.qop != "" {
+		parts = append(parts, "qop="+c.qop, "nc="+nc, fmt.Sprintf(`cnonce="%s"`, cnonce))
+	}
+	if c.opaque != "" {
+		parts = append(parts, fmt.Sprintf(`opaque="%s"`, c.opaque))
+	}
+	return "Digest " + strings.Join(parts, ", ")
+}
+
+// challengeCache remembers per host how the server asked to authenticate:
+// the last Digest challenge, or that it accepts Basic. Later requests
+// (retries, segments and resumes) then authenticate without another 401
+// round trip.
+type challengeCache struct {
+	mu         sync.Mutex
+	challenges map[string]*digestChallenge
+	basic      map[string]bool
+}
+
+// setDigest remembers a Digest challenge for host
+func (d *challengeCache) setDigest(host string, c *digestChallenge) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.challenges == nil {
+		d.challenges = map[string]*digestChallenge{}
+	}
+	d.challenges[host] = c
+}
+
+// setBasic remembers that host asked for Basic credentials
+func (d *challengeCache) setBasic(host string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.basic == nil {
+		d.basic = map[string]bool{}
+	}
+	d.basic[host] = true
+}
+
+// authorize sets the Authorization header on req if its host has asked for
+// credentials before, reporting whether it did. Digest wins over Basic.
+func (d *challengeCache) authorize(req *http.Request, creds *Credentials) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if c := d.challenges[req.URL.Host]; c != nil {
+		req.Header.Set("Authorization", c.authorization(req, creds.Username, creds.Password))
+		return true
+	}
+	if d.basic[req.URL.Host] {
+		req.SetBasicAuth(creds.Username, creds.Password)
+		return true
+	}
+	return false
+}
+
+// rewindRequest clones req with a fresh copy of its body so it can be sent again
+func rewindRequest(req *http.Request) (*http.Request, error) {
+	retry := req.Clone(req.Context())
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			return nil, fmt.Errorf("cannot replay request body")
+		}
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		retry.Body = body
+	}
+	return retry, nil
+}
+
+// drainBody discards the rest of a response we are about to replace so the
+// connection can be reused
+func drainBody(resp *http.Response) {
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+}
+
+// OAuth2Source obtains and caches access tokens with the OAuth2 client
+// credentials grant (RFC 6749 section 4.4)
+type OAuth2Source struct {
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	Scope        string
+	Host         string // only requests to this host receive the token
+
+	client *http.Client
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// Token returns a valid access token, requesting a new one when the cached
+// token is missing or about to expire
+func (s *OAuth2Source) Token(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token != "" && (s.expiry.IsZero() || time.Until(s.expiry) > 30*time.Second) {
+		return s.token, nil
+	}
+
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if s.Scope != "" {
+		form.Set("scope", s.Scope)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", fmt.Errorf("oauth2 token request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(s.ClientID), url.QueryEscape(s.ClientSecret))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("oauth2 token request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("oauth2 token request: %w", &HTTPError{StatusCode: resp.StatusCode, Status: resp.Status})
+	}
+
+	var body struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("oauth2 token response: %w", err)
+	}
+	if body.AccessToken == "" {
+		return "", fmt.Errorf("oauth2 token response has no access_token")
+	}
+
+	s.token = body.AccessToken
+	s.expiry = time.Time{}
+	if body.ExpiresIn > 0 {
+		s.expiry = time.Now().Add(time.Duration(body.ExpiresIn) * time.Second)
+	}
+	return s.token, nil
+}
+
+// Invalidate drops token if it is still the cached one, forcing a refresh
+func (s *OAuth2Source) Invalidate(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token == token {
+		s.token = ""
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestParseChallenges(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers []string
+		want    []authChallenge
+	}{
+		{
+			name:    "basic",
+			headers: []string{`Basic realm="files"`},
+			want:    []authChallenge{{"basic", map[string]string{"realm": "files"}}},
+		},
+		{
+			name:    "two challenges in one header",
+			headers: []string{`Basic realm="a", Digest realm="b", nonce="n1", qop="auth,auth-int"`},
+			want: []authChallenge{
+				{"basic", map[string]string{"realm": "a"}},
+				{"digest", map[string]string{"realm": "b", "nonce": "n1", "qop": "auth,auth-int"}},
+			},
+		},
+		{
+			name:    "scheme name inside a quoted realm",
+			headers: []string{`Basic realm="Digest area, nonce=fake"`},
+			want:    []authChallenge{{"basic", map[string]string{"realm": "Digest area, nonce=fake"}}},
+		},
+		{
+			name:    "RFC 7235 example",
+			headers: []string{`Newauth realm="apps", type=1, title="Login to \"apps\"", Basic realm="simple"`},
+			want: []authChallenge{
+				{"newauth", map[string]string{"realm": "apps", "type": "1", "title": `Login to "apps"`}},
+				{"basic", map[string]string{"realm": "simple"}},
+			},
+		},
+		{
+			name:    "token68 and several headers",
+			headers: []string{`Negotiate YIIB==`, `DIGEST  Realm = "x" , NONCE="y"`},
+			want: []authChallenge{
+				{"negotiate", map[string]string{}},
+				{"digest", map[string]string{"realm": "x", "nonce": "y"}},
+			},
+		},
+		{
+			name:    "bare scheme",
+			headers: []string{`Bearer`},
+			want:    []authChallenge{{"bearer", map[string]string{}}},
+		},
+		{
+			name:    "empty",
+			headers: []string{``, ` , `},
+			want:    nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseChallenges(tt.headers); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseChallenges = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseDigestChallenge(t *testing.T) {
+	tests := []struct {
+		name      string
+		headers   []string
+		nonce     string // "" when no challenge should be chosen
+		algorithm string
+		qop       string
+		stale     bool
+	}{
+		{
+			name:      "legacy without qop",
+			headers:   []string{`Digest realm="r", nonce="abc"`},
+			nonce:     "abc",
+			algorithm: "MD5",
+		},
+		{
+			name:      "qop auth among others",
+			headers:   []string{`Digest realm="r", nonce="abc", qop="auth-int, auth", algorithm=MD5-sess`},
+			nonce:     "abc",
+			algorithm: "MD5-sess",
+			qop:       "auth",
+		},
+		{
+			name:      "SHA-256 preferred",
+			headers:   []string{`Digest realm="r", nonce="md5", qop="auth"`, `Digest realm="r", nonce="sha", qop="auth", algorithm=SHA-256`},
+			nonce:     "sha",
+			algorithm: "SHA-256",
+			qop:       "auth",
+		},
+		{
+			name:      "SHA-256 preferred in one header",
+			headers:   []string{`Digest realm="r", nonce="sha", qop="auth", algorithm=SHA-256, Digest realm="r", nonce="md5", qop="auth"`},
+			nonce:     "sha",
+			algorithm: "SHA-256",
+			qop:       "auth",
+		},
+		{
+			name:      "stale",
+			headers:   []string{`Digest realm="r", nonce="new", stale=TRUE`},
+			nonce:     "new",
+			algorithm: "MD5",
+			stale:     true,
+		},
+		{
+			name:    "only auth-int",
+			headers: []string{`Digest realm="r", nonce="abc", qop="auth-int"`},
+		},
+		{
+			name:    "unsupported algorithm",
+			headers: []string{`Digest realm="r", nonce="abc", algorithm=SHA-512-256`},
+		},
+		{
+			name:    "no nonce",
+			headers: []string{`Digest realm="r"`},
+		},
+		{
+			name:    "digest only inside a realm",
+			headers: []string{`Basic realm="digest nonce=x"`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := parseDigestChallenge(tt.headers)
+			if tt.nonce == "" {
+				if c != nil {
+					t.Fatalf("parseDigestChallenge = %+v, want nil", c)
+				}
+				return
+			}
+			if c == nil {
+				t.Fatal("parseDigestChallenge = nil")
+			}
+			if c.nonce != tt.nonce || c.algorithm != tt.algorithm || c.qop != tt.qop || c.stale != tt.stale {
+				t.Errorf("parseDigestChallenge = %+v, want nonce %q algorithm %q qop %q stale %v", c, tt.nonce, tt.algorithm, tt.qop, tt.stale)
+			}
+		})
+	}
+}
+
+// digestServer answers like a Digest-only server, checking each Authorization
+// header with its own computation of the response
+func digestServer(t *testing.T, algorithm, user, password string, seen *[]string, mu *sync.Mutex) *httptest.Server {
+	const realm, nonce = "appliance", "3f1c0a"
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		mu.Lock()
+		*seen = append(*seen, auth)
+		mu.Unlock()
+
+		challenge := fmt.Sprintf(`Digest realm="%s", nonce="%s", qop="auth", algorithm=%s`, realm, nonce, algorithm)
+		if !strings.HasPrefix(auth, "Digest ") {
+			w.Header().Set("WWW-Authenticate", challenge)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		p := parseChallenges([]string{auth})[0].params
+		newHash := md5.New
+		if strings.HasPrefix(algorithm, "SHA-256") {
+			newHash = sha256.New
+		}
+		h := func(s string) string {
+			var hh hash.Hash = newHash()
+			hh.Write([]byte(s))
+			return hex.EncodeToString(hh.Sum(nil))
+		}
+		ha1 := h(user + ":" + realm + ":" + password)
+		if strings.HasSuffix(algorithm, "-sess") {
+			ha1 = h(ha1 + ":" + nonce + ":" + p["cnonce"])
+		}
+		ha2 := h(r.Method + ":" + r.URL.RequestURI())
+		want := h(strings.Join([]string{ha1, nonce, p["nc"], p["cnonce"], "auth", ha2}, ":"))
+		if p["username"] != user || p["uri"] != r.URL.RequestURI() || p["response"] != want {
+			w.Header().Set("WWW-Authenticate", challenge)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, "ok")
+	}))
+}
+
+// netrcStore returns a CredentialStore whose .netrc has user and password for
+// every host
+func netrcStore(t *testing.T, user, password string) *CredentialStore {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "netrc")
+	if err := ioutil.WriteFile(path, []byte("default login "+user+" password "+password+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return &CredentialStore{NetrcFile: path}
+}
+
+func TestAuthTransportDigest(t *testing.T) {
+	for _, algorithm := range []string{"MD5", "MD5-sess", "SHA-256", "SHA-256-sess"} {
+		t.Run(algorithm, func(t *testing.T) {
+			var seen []string
+			var mu sync.Mutex
+			srv := digestServer(t, algorithm, "admin", "s3cret", &seen, &mu)
+			defer srv.Close()
+
+			client := &http.Client{Transport: &authTransport{base: http.DefaultTransport, store: netrcStore(t, "admin", "s3cret")}}
+			for i := 0; i < 2; i++ {
+				resp, err := client.Get(srv.URL + "/fw/image.bin?v=2")
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					t.Fatalf("request %d: status %d", i, resp.StatusCode)
+				}
+			}
+
+			// The password never goes out as Basic; the first request carries
+			// nothing and the second reuses the remembered challenge
+			if len(seen) != 3 || seen[0] != "" || !strings.HasPrefix(seen[1], "Digest ") || !strings.HasPrefix(seen[2], "Digest ") {
+				t.Fatalf("Authorization headers sent: %q", seen)
+			}
+			if strings.Contains(seen[2], "nc=00000001") {
+				t.Errorf("nonce count was not incremented: %s", seen[2])
+			}
+		})
+	}
+}
+
+func TestAuthTransportBasicAfterChallenge(t *testing.T) {
+	var seen []string
+	var mu sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seen = append(seen, r.Header.Get("Authorization"))
+		mu.Unlock()
+		if user, pass, ok := r.BasicAuth(); !ok || user != "ci" || pass != "hunter2" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="artifacts"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, "ok")
+	}))
+	defer srv.Close()
+
+	client := &http.Client{Transport: &authTransport{base: http.DefaultTransport, store: netrcStore(t, "ci", "hunter2")}}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(srv.URL + "/app.tar.gz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("request %d: status %d", i, resp.StatusCode)
+		}
+	}
+	if len(seen) != 3 || seen[0] != "" || !strings.HasPrefix(seen[1], "Basic ") || seen[2] != seen[1] {
+		t.Fatalf("Authorization headers sent: %q", seen)
+	}
+}
+
+func TestAuthTransportWrongBasicPasswordIsNotRetried(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("WWW-Authenticate", `Basic realm="artifacts"`)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer srv.Close()
+
+	client := &http.Client{Transport: &authTransport{base: http.DefaultTransport, store: netrcStore(t, "ci", "wrong")}}
+	resp, err := client.Get(srv.URL + "/app.tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized || requests != 2 {
+		t.Fatalf("status %d after %d requests, want 401 after 2", resp.StatusCode, requests)
+	}
+}
+
+func TestAuthTransportNoCredentialsWithoutChallenge(t *testing.T) {
+	var seen string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.Header.Get("Authorization")
+		fmt.Fprint(w, "public")
+	}))
+	defer srv.Close()
+
+	client := &http.Client{Transport: &authTransport{base: http.DefaultTransport, store: netrcStore(t, "ci", "hunter2")}}
+	resp, err := client.Get(srv.URL + "/public.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if seen != "" {
+		t.Fatalf("sent %q to a server that did not ask", seen)
+	}
+}
+
+func TestAuthTransportOAuth2Refresh(t *testing.T) {
+	tests := []struct {
+		name       string
+		refreshErr int // status of the second token request; 0 issues a token
+		want       string
+	}{
+		{"token refreshed", 0, "ok"},
+		{"refresh fails", http.StatusInternalServerError, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var issued int32
+			tokens := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := atomic.AddInt32(&issued, 1)
+				if n > 1 && tt.refreshErr != 0 {
+					w.WriteHeader(tt.refreshErr)
+					return
+				}
+				fmt.Fprintf(w, `{"access_token":"t%d","token_type":"Bearer"}`, n)
+			}))
+			defer tokens.Close()
+			// The first token is rejected, as if revoked early
+			api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Authorization") != "Bearer t2" {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				fmt.Fprint(w, "ok")
+			}))
+			defer api.Close()
+
+			oauth := &OAuth2Source{TokenURL: tokens.URL, ClientID: "id", ClientSecret: "secret", Host: strings.TrimPrefix(api.URL, "http://"), client: http.DefaultClient}
+			client := &http.Client{Transport: &authTransport{base: http.DefaultTransport, oauth: oauth}}
+			resp, err := client.Get(api.URL + "/report.csv")
+			if tt.want == "" {
+				var httpErr *HTTPError
+				if err == nil {
+					resp.Body.Close()
+					t.Fatalf("status %d, want the token endpoint's error", resp.StatusCode)
+				}
+				if !errors.As(err, &httpErr) || httpErr.StatusCode != tt.refreshErr || !strings.Contains(err.Error(), "OAuth2 token") {
+					t.Fatalf("error = %v, want the token endpoint's %d", err, tt.refreshErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(body) != tt.want {
+				t.Errorf("body = %q, want %q", body, tt.want)
+			}
+		})
+	}
+}
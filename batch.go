@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/cheggaaa/pb"
+)
+
+// fetchBatchItem downloads one item of a batch with the usual retries.
+// Concurrent items report through the overall progress instead of their own.
+func fetchBatchItem(ctx context.Context, config *Config, item batchItem, concurrent bool) error {
+	file := *config
+	file.URL = item.URL
+	file.FilePath = item.FilePath
+	file.Batch = nil
+	file.etag = ""
+	file.mirrors = nil
+	if concurrent {
+		file.Quiet = true
+		file.Events = nil
+	}
+	var err error
+	if item.FilePath != "" {
+		// -o "logs/day#1.gz" may name directories that do not exist yet
+		err = os.MkdirAll(filepath.Dir(item.FilePath), 0777)
+	}
+	if err == nil {
+		err = downloadWithRetry(ctx, &file)
+	}
+
+	fields := map[string]interface{}{
+		"url":  redactQuery(item.URL),
+		"path": file.FilePath,
+		"ok":   err == nil,
+	}
+	if err != nil {
+		fields["error"] = err.Error()
+	} else if fi, statErr := os.Stat(file.FilePath); statErr == nil {
+		fields["bytes"] = fi.Size()
+	}
+	config.Events.Emit("file", fields)
+	return err
+}
+
+// downloadBatch downloads the URLs a glob expanded to, config.Parallel at a
+// time. A failed item does not stop the others; the error reports how many
+// failed and the first failure, whose exit code it keeps.
+func downloadBatch(ctx context.Context, config *Config) error {
+	// Build the shared client before the workers would race to. Concurrent
+	// items are quiet, so the client's redirect check must be too.
+	concurrent := config.Parallel > 1
+	if concurrent {
+		quiet := *config
+		quiet.Quiet = true
+		quiet.client = nil
+		config.client = httpClient(&quiet)
+	} else {
+		httpClient(config)
+	}
+	if !config.Quiet {
+		fmt.Printf("Downloading %d URLs\n", len(config.Batch))
+	}
+	var bar *pb.ProgressBar
+	if concurrent && !config.Quiet && config.Events == nil {
+		bar = pb.New(len(config.Batch))
+		bar.ShowTimeLeft = true
+		bar.Start()
+	}
+
+	todo := make(chan int)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var failed int
+	var firstErr error
+	for w := 0; w < config.Parallel; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range todo {
+				item := config.Batch[i]
+				err := fetchBatchItem(ctx, config, item, concurrent)
+				if bar != nil {
+					bar.Increment()
+				}
+				if err == nil || ctx.Err() != nil {
+					continue
+				}
+				mu.Lock()
+				failed++
+				if firstErr == nil {
+					firstErr = fmt.Errorf("%s: %w", redactQuery(item.URL), err)
+				}
+				mu.Unlock()
+				if bar == nil && !config.Quiet {
+					fmt.Printf("Failed: %s: %v\n", redactQuery(item.URL), err)
+				}
+			}
+		}()
+	}
+	for i := range config.Batch {
+		select {
+		case todo <- i:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	close(todo)
+	wg.Wait()
+	if bar != nil {
+		bar.Finish()
+	}
+
+	if ctx.Err() != nil {
+		if config.FilePath == "" {
+			return ErrInterrupted
+		}
+		return fmt.Errorf("%w: resume by running the same command with -r", ErrInterrupted)
+	}
+	if firstErr != nil {
+		return fmt.Errorf("%d of %d downloads failed; first: %w", failed, len(config.Batch), firstErr)
+	}
+	if !config.Quiet {
+		fmt.Printf("Downloaded %d files\n", len(config.Batch))
+	}
+	return nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// Bencoding (BEP 3) is decoded into int64, string, []interface{} and
+// map[string]interface{} values. Strings are binary and kept as Go strings.
+
+// errBencode is wrapped by every decoding error
+var errBencode = errors.New("invalid bencoding")
+
+// maxBencodeDepth bounds list and dictionary nesting, which real torrents
+// and peer messages keep to a handful of levels, so hostile input cannot
+// exhaust the stack
+const maxBencodeDepth = 64
+
+// bdecoder reads one bencoded value at a time from data
+type bdecoder struct {
+	data  []byte
+	pos   int
+	depth int // lists and dictionaries currently open
+}
+
+// bdecode decodes a complete bencoded value; trailing data is an error
+func bdecode(data []byte) (interface{}, error) {
+	d := &bdecoder{data: data}
+	v, err := d.value()
+	if err != nil {
+		return nil, err
+	}
+	if d.pos != len(data) {
+		return nil, fmt.Errorf("%w: trailing data at offset %d", errBencode, d.pos)
+	}
+	return v, nil
+}
+
+// bdecodePrefix decodes the value at the start of data and returns how many
+// bytes it used. Messages such as ut_metadata pieces carry raw data after it.
+func bdecodePrefix(data []byte) (interface{}, int, error) {
+	d := &bdecoder{data: data}
+	v, err := d.value()
+	return v, d.pos, err
+}
+
+func (d *bdecoder) fail(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s at offset %d", errBencode, fmt.Sprintf(format, args...), d.pos)
+}
+
+func (d *bdecoder) value() (interface{}, error) {
+	if d.pos >= len(d.data) {
+		return nil, d.fail("unexpected end")
+	}
+	switch c := d.data[d.pos]; {
+	case c == 'i':
+		end := bytes.IndexByte(d.data[d.pos:], 'e')
+		if end < 0 {
+			return nil, d.fail("unterminated integer")
+		}
+		n, err := strconv.ParseInt(string(d.data[d.pos+1:d.pos+end]), 10, 64)
+		if err != nil {
+			return nil, d.fail("bad integer")
+		}
+		d.pos += end + 1
+		return n, nil
+	case c == 'l':
+		if d.depth++; d.depth > maxBencodeDepth {
+			return nil, d.fail("nested too deeply")
+		}
+		defer func() { d.depth-- }()
+		d.pos++
+		list := []interface{}{}
+		for d.pos < len(d.data) && d.data[d.pos] != 'e' {
+			v, err := d.value()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		if d.pos >= len(d.data) {
+			return nil, d.fail("unterminated list")
+		}
+		d.pos++
+		return list, nil
+	case c == 'd':
+		if d.depth++; d.depth > maxBencodeDepth {
+			return nil, d.fail("nested too deeply")
+		}
+		defer func() { d.depth-- }()
+		d.pos++
+		dict := map[string]interface{}{}
+		for d.pos < len(d.data) && d.data[d.pos] != 'e' {
+			key, err := d.str()
+			if err != nil {
+				return nil, err
+			}
+			v, err := d.value()
+			if err != nil {
+				return nil, err
+			}
+			dict[key] = v
+		}
+		if d.pos >= len(d.data) {
+			return nil, d.fail("unterminated dictionary")
+		}
+		d.pos++
+		return dict, nil
+	case c >= '0' && c <= '9':
+		return d.str()
+	default:
+		return nil, d.fail("unexpected %q", c)
+	}
+}
+
+func (d *bdecoder) str() (string, error) {
+	colon := bytes.IndexByte(d.data[d.pos:], ':')
+	if colon < 0 {
+		return "", d.fail("bad string length")
+	}
+	n, err := strconv.Atoi(string(d.data[d.pos : d.pos+colon]))
+	if err != nil || n < 0 || n > len(d.data)-d.pos-colon-1 {
+		return "", d.fail("bad string length")
+	}
+	start := d.pos + colon + 1
+	d.pos = start + n
+	return string(d.data[start:d.pos]), nil
+}
+
+// bdictRaw returns the exact bytes of the value stored under key in the
+// top-level dictionary of data. The info hash is taken over these bytes, so
+// they must not be re-encoded.
+func bdictRaw(data []byte, key string) ([]byte, error) {
+	d := &bdecoder{data: data}
+	if len(data) == 0 || data[0] != 'd' {
+		return nil, d.fail("not a dictionary")
+	}
+	d.pos = 1
+	for d.pos < len(data) && data[d.pos] != 'e' {
+		k, err := d.str()
+		if err != nil {
+			return nil, err
+		}
+		start := d.pos
+		if _, err := d.value(); err != nil {
+			return nil, err
+		}
+		if k == key {
+			return data[start:d.pos], nil
+		}
+	}
+	return nil, fmt.Errorf("%w: missing %q", errBencode, key)
+}
+
+// bencode encodes v, which may hold ints, strings, []byte, lists and
+// dictionaries with string keys
+func bencode(v interface{}) []byte {
+	var buf bytes.Buffer
+	bencodeTo(&buf, v)
+	return buf.Bytes()
+}
+
+func bencodeTo(buf *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case int:
+		fmt.Fprintf(buf, "i%de", v)
+	case int64:
+		fmt.Fprintf(buf, "i%de", v)
+	case string:
+		fmt.Fprintf(buf, "%d:%s", len(v), v)
+	case []byte:
+		fmt.Fprintf(buf, "%d:", len(v))
+		buf.Write(v)
+	case []interface{}:
+		buf.WriteByte('l')
+		for _, item := range v {
+			bencodeTo(buf, item)
+		}
+		buf.WriteByte('e')
+	case map[string]interface{}:
+		// Keys must be sorted as raw strings
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		buf.WriteByte('d')
+		for _, k := range keys {
+			bencodeTo(buf, k)
+			bencodeTo(buf, v[k])
+		}
+		buf.WriteByte('e')
+	default:
+		panic(fmt.Sprintf("bencode: unsupported type %T", v))
+	}
+}
+
+// bdict helpers read typed fields from a decoded dictionary, returning the
+// zero value when the key is missing or has another type
+
+func bstring(d map[string]interface{}, key string) string {
+	s, _ := d[key].(string)
+	return s
+}
+
+func bint(d map[string]interface{}, key string) int64 {
+	n, _ := d[key].(int64)
+	return n
+}
+
+func blist(d map[string]interface{}, key string) []interface{} {
+	l, _ := d[key].([]interface{})
+	return l
+}
+
+func bdict(d map[string]interface{}, key string) map[string]interface{} {
+	m, _ := d[key].(map[string]interface{})
+	return m
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBencodeRoundTrip(t *testing.T) {
+	tests := []struct {
+		value   interface{}
+		encoded string
+	}{
+		{int64(0), "i0e"},
+		{int64(-42), "i-42e"},
+		{"", "0:"},
+		{"spam", "4:spam"},
+		{"\x00\xff:e", "4:\x00\xff:e"},
+		{[]interface{}{}, "le"},
+		{[]interface{}{"a", int64(1), []interface{}{"b"}}, "l1:ai1el1:bee"},
+		{map[string]interface{}{}, "de"},
+		{
+			map[string]interface{}{"zz": int64(1), "a": "x", "info": map[string]interface{}{"name": "f", "length": int64(3)}},
+			"d1:a1:x4:infod6:lengthi3e4:name1:fe2:zzi1ee",
+		},
+	}
+	for _, tt := range tests {
+		if got := string(bencode(tt.value)); got != tt.encoded {
+			t.Errorf("bencode(%#v) = %q, want %q", tt.value, got, tt.encoded)
+		}
+		got, err := bdecode([]byte(tt.encoded))
+		if err != nil || !reflect.DeepEqual(got, tt.value) {
+			t.Errorf("bdecode(%q) = %#v, %v; want %#v", tt.encoded, got, err, tt.value)
+		}
+	}
+
+	// []byte and int encode like strings and int64
+	if got := string(bencode(map[string]interface{}{"b": []byte("xy"), "n": 7})); got != "d1:b2:xy1:ni7ee" {
+		t.Errorf("bencode of []byte and int = %q", got)
+	}
+}
+
+func TestBdecodeMalformed(t *testing.T) {
+	tests := []struct {
+		name, data, want string
+	}{
+		{"empty", "", "unexpected end"},
+		{"unknown type", "x", `unexpected 'x'`},
+		{"unterminated integer", "i42", "unterminated integer"},
+		{"empty integer", "ie", "bad integer"},
+		{"integer overflow", "i99999999999999999999e", "bad integer"},
+		{"string without colon", "4spam", "bad string length"},
+		{"negative string length", "-1:a", `unexpected '-'`},
+		{"short string", "10:spam", "bad string length"},
+		{"string length overflow", "9223372036854775807:spam", "bad string length"},
+		{"unterminated list", "l4:spam", "unterminated list"},
+		{"unterminated dictionary", "d1:ai1e", "unterminated dictionary"},
+		{"dictionary without value", "d1:ae", `unexpected 'e'`},
+		{"integer dictionary key", "di1ei2ee", "bad string length"},
+		{"trailing data", "i1ei2e", "trailing data"},
+		{"deep lists", strings.Repeat("l", maxBencodeDepth+1) + strings.Repeat("e", maxBencodeDepth+1), "nested too deeply"},
+		{"deep dictionaries", strings.Repeat("d1:k", maxBencodeDepth+1) + "i0e" + strings.Repeat("e", maxBencodeDepth+1), "nested too deeply"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := bdecode([]byte(tt.data))
+			if err == nil {
+				t.Fatalf("bdecode(%q) = %#v, want an error", tt.data, v)
+			}
+			if !errors.Is(err, errBencode) || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("bdecode(%q) = %v, want an errBencode mentioning %q", tt.data, err, tt.want)
+			}
+		})
+	}
+
+	// The limit leaves room for any real torrent
+	deep := strings.Repeat("l", maxBencodeDepth) + strings.Repeat("e", maxBencodeDepth)
+	if _, err := bdecode([]byte(deep)); err != nil {
+		t.Errorf("bdecode of %d nested lists: %v", maxBencodeDepth, err)
+	}
+	if _, err := bdictRaw([]byte("d1:k"+strings.Repeat("l", maxBencodeDepth+1)), "k"); err == nil {
+		t.Error("bdictRaw accepted nesting beyond the limit")
+	}
+}
+
+func TestBdecodePrefix(t *testing.T) {
+	v, n, err := bdecodePrefix([]byte("d8:msg_typei1e5:piecei0eeRAW DATA"))
+	if err != nil || n != 25 {
+		t.Fatalf("bdecodePrefix = %v, %d, %v", v, n, err)
+	}
+	want := map[string]interface{}{"msg_type": int64(1), "piece": int64(0)}
+	if !reflect.DeepEqual(v, want) {
+		t.Errorf("bdecodePrefix = %#v, want %#v", v, want)
+	}
+}
+
+func TestBdictRaw(t *testing.T) {
+	// The raw value is returned as is, even where re-encoding would differ
+	data := []byte("d8:announce3:url4:infod4:name1:b4:name1:aee")
+	raw, err := bdictRaw(data, "info")
+	if err != nil || string(raw) != "d4:name1:b4:name1:ae" {
+		t.Errorf("bdictRaw(info) = %q, %v", raw, err)
+	}
+	if _, err := bdictRaw(data, "missing"); err == nil {
+		t.Error("bdictRaw found a missing key")
+	}
+	if _, err := bdictRaw([]byte("l4:infoe"), "info"); err == nil {
+		t.Error("bdictRaw accepted a list")
+	}
+}
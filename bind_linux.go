@@ -0,0 +1,26 @@
+//go:build linux
+
+package main
+
+import (
+	"syscall"
+)
+
+// bindToDeviceSupported is true where SO_BINDTODEVICE is available
+const bindToDeviceSupported = true
+
+// bindToDevice returns a net.Dialer Control function that binds sockets to
+// the named network interface with SO_BINDTODEVICE, so traffic leaves through
+// that interface regardless of the routing table's choice
+func bindToDevice(iface string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface)
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package main
+
+import (
+	"syscall"
+)
+
+// bindToDeviceSupported is false where SO_BINDTODEVICE is unavailable; the
+// interface's address is used as the local address instead
+const bindToDeviceSupported = false
+
+// bindToDevice is never called on this platform
+func bindToDevice(iface string) func(network, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"DLError"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// newTransport builds the http.Transport shared by every request of a download
+func newTransport(config *Config) *http.Transport {
+	return &http.Transport{
+		Proxy:                  proxyFunc(config),
+		TLSClientConfig:        config.TLS,
+		OnProxyConnectResponse: onProxyConnectResponse,
+		DialContext:            newDialContext(config),
+		ForceAttemptHTTP2:      true,
+		MaxIdleConns:           100,
+		IdleConnTimeout:        90 * time.Second,
+		TLSHandshakeTimeout:    10 * time.Second,
+		ExpectContinueTimeout:  1 * time.Second,
+	}
+}
+
+// httpClient returns the client used by downloadFile. It is built once per
+// run so connections, cookies, Digest nonces and OAuth2 tokens survive retries.
+func httpClient(config *Config) *http.Client {
+	if config.client != nil {
+		return config.client
+	}
+
+	var base http.RoundTripper = newTransport(config)
+	if config.OAuth2 != nil {
+		config.OAuth2.client = &http.Client{Transport: base, Timeout: config.Timeout}
+	}
+	if config.S3 != nil {
+		base = &s3Transport{base: base, s3: config.S3}
+	}
+	config.client = &http.Client{
+		Transport:     &authTransport{base: base, store: config.Credentials, oauth: config.OAuth2},
+		CheckRedirect: checkRedirect(config),
+		Timeout:       config.Timeout,
+	}
+	if config.Cookies != nil {
+		config.client.Jar = config.Cookies
+	}
+	return config.client
+}
+
+// doRequest sends req and reports proxy failures, including a 407 from a
+// plain HTTP proxy, as a ProxyError and certificate failures as a TLSError.
+// The query is removed from the URL in the error.
+func doRequest(config *Config, client *http.Client, req *http.Request) (*http.Response, error) {
+	proxy := proxyFunc(config)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		// The failing URL may be a redirect target carrying a signature
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			urlErr.URL = redactQuery(urlErr.URL)
+		}
+		return nil, DLError.New("GET Request Error", asTLSError(asProxyError(req, proxy, err)))
+	}
+	if resp.StatusCode == http.StatusProxyAuthRequired {
+		resp.Body.Close()
+		proxyURL, _ := proxy(req)
+		return nil, &ProxyError{Proxy: redactURL(proxyURL), StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	return resp, nil
+}
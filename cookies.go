@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// jarCookie is a stored cookie with the attributes needed to match requests
+// and to write it back out in Netscape format
+type jarCookie struct {
+	Name     string
+	Value    string
+	Domain   string
+	HostOnly bool // set by the host without a Domain attribute
+	Path     string
+	Secure   bool
+	HttpOnly bool
+	Expires  time.Time // zero for session cookies
+}
+
+// CookieJar is an http.CookieJar that can load and save Netscape cookies.txt
+// files. Unlike net/http/cookiejar it keeps every attribute, which is what
+// makes saving possible.
+type CookieJar struct {
+	mu      sync.Mutex
+	cookies map[string]*jarCookie // keyed by domain, path and name
+}
+
+// NewCookieJar creates an empty jar
+func NewCookieJar() *CookieJar {
+	return &CookieJar{cookies: map[string]*jarCookie{}}
+}
+
+func cookieKey(domain, path, name string) string {
+	return domain + ";" + path + ";" + name
+}
+
+// domainMatch reports whether host is domain or a subdomain of it
+func domainMatch(host, domain string) bool {
+	return host == domain || (strings.HasSuffix(host, "."+domain) && net.ParseIP(host) == nil)
+}
+
+// defaultCookiePath implements the default-path algorithm of RFC 6265 section 5.1.4
+func defaultCookiePath(u *url.URL) string {
+	path := u.EscapedPath()
+	if !strings.HasPrefix(path, "/") {
+		return "/"
+	}
+	i := strings.LastIndex(path, "/")
+	if i == 0 {
+		return "/"
+	}
+	return path[:i]
+}
+
+// SetCookies implements http.CookieJar
+func (j *CookieJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	host := strings.ToLower(u.Hostname())
+	now := time.Now()
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, c := range cookies {
+		jc := &jarCookie{
+			Name:     c.Name,
+			Value:    c.Value,
+			Path:     c.Path,
+			Secure:   c.Secure,
+			HttpOnly: c.HttpOnly,
+		}
+
+		domain := strings.TrimPrefix(strings.ToLower(c.Domain), ".")
+		if domain == "" {
+			jc.Domain, jc.HostOnly = host, true
+		} else {
+			// Refuse cookies for unrelated hosts or whole top-level domains
+			if !domainMatch(host, domain) || !strings.Contains(domain, ".") {
+				continue
+			}
+			jc.Domain = domain
+		}
+		if jc.Path == "" || !strings.HasPrefix(jc.Path, "/") {
+			jc.Path = defaultCookiePath(u)
+		}
+
+		switch {
+		case c.MaxAge < 0:
+			jc.Expires = now.Add(-time.Second)
+		case c.MaxAge > 0:
+			jc.Expires = now.Add(time.Duration(c.MaxAge) * time.Second)
+		case !c.Expires.IsZero():
+			jc.Expires = c.Expires
+		}
+
+		key := cookieKey(jc.Domain, jc.Path, jc.Name)
+		if !jc.Expires.IsZero() && !jc.Expires.After(now) {
+			delete(j.cookies, key)
+			continue
+		}
+		j.cookies[key] = jc
+	}
+}
+
+// Cookies implements http.CookieJar
+func (j *CookieJar) Cookies(u *url.URL) []*http.Cookie {
+	host := strings.ToLower(u.Hostname())
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	secure := u.Scheme == "https"
+	now := time.Now()
+
+	j.mu.Lock()
+	var matched []*jarCookie
+	for key, c := range j.cookies {
+		if !c.Expires.IsZero() && !c.Expires.After(now) {
+			delete(j.cookies, key)
+			continue
+		}
+		if c.Secure && !secure {
+			continue
+		}
+		if (c.HostOnly && host != c.Domain) || (!c.HostOnly && !domainMatch(host, c.Domain)) {
+			continue
+		}
+		if path != c.Path && !(strings.HasPrefix(path, c.Path) &&
+			(strings.HasSuffix(c.Path, "/") || path[len(c.Path)] == '/')) {
+			continue
+		}
+		matched = append(matched, c)
+	}
+	j.mu.Unlock()
+
+	// More specific paths first, as RFC 6265 recommends
+	sort.Slice(matched, func(a, b int) bool { return len(matched[a].Path) > len(matched[b].Path) })
+	cookies := make([]*http.Cookie, len(matched))
+	for i, c := range matched {
+		cookies[i] = &http.Cookie{Name: c.Name, Value: c.Value}
+	}
+	return cookies
+}
+
+// Load reads cookies from a Netscape cookies.txt file, as written by curl,
+// wget and browser export extensions
+func (j *CookieJar) Load(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		httpOnly := false
+		if strings.HasPrefix(line, "#HttpOnly_") {
+			line = strings.TrimPrefix(line, "#HttpOnly_")
+			httpOnly = true
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, "\t")
+		if len(fields) != 7 {
+			return fmt.Errorf("%s:%d: expected 7 tab-separated fields", path, lineNo)
+		}
+		expires, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s:%d: invalid expiry %q", path, lineNo, fields[4])
+		}
+
+		c := &jarCookie{
+			Domain:   strings.TrimPrefix(strings.ToLower(fields[0]), "."),
+			HostOnly: !strings.EqualFold(fields[1], "TRUE"),
+			Path:     fields[2],
+			Secure:   strings.EqualFold(fields[3], "TRUE"),
+			HttpOnly: httpOnly,
+			Name:     fields[5],
+			Value:    fields[6],
+		}
+		if expires > 0 {
+			c.Expires = time.Unix(expires, 0)
+			if !c.Expires.After(time.Now()) {
+				continue
+			}
+		}
+		j.cookies[cookieKey(c.Domain, c.Path, c.Name)] = c
+	}
+	return scanner.Err()
+}
+
+// Save writes all unexpired cookies, including session cookies, to path in
+// Netscape format
+func (j *CookieJar) Save(path string) error {
+	j.mu.Lock()
+	var b strings.Builder
+	b.WriteString("# Netscape HTTP Cookie File\n# Written by dl. Edit at your own risk.\n\n")
+
+	keys := make([]string, 0, len(j.cookies))
+	for key := range j.cookies {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	now := time.Now()
+	boolField := func(v bool) string {
+		if v {
+			return "TRUE"
+		}
+		return "FALSE"
+	}
+	for _, key := range keys {
+		c := j.cookies[key]
+		if !c.Expires.IsZero() && !c.Expires.After(now) {
+			continue
+		}
+		domain := c.Domain
+		if !c.HostOnly {
+			domain = "." + domain
+		}
+		if c.HttpOnly {
+			domain = "#HttpOnly_" + domain
+		}
+		expires := int64(0)
+		if !c.Expires.IsZero() {
+			expires = c.Expires.Unix()
+		}
+		fmt.Fprintf(&b, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+			domain, boolField(!c.HostOnly), c.Path, boolField(c.Secure), expires, c.Name, c.Value)
+	}
+	j.mu.Unlock()
+
+	return ioutil.WriteFile(path, []byte(b.String()), 0600)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// cookieNames returns the sorted "name=value" pairs the jar sends to rawURL
+func cookieNames(j *CookieJar, rawURL string) []string {
+	u, _ := url.Parse(rawURL)
+	var names []string
+	for _, c := range j.Cookies(u) {
+		names = append(names, c.Name+"="+c.Value)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func writeCookieFile(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "cookies.txt")
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCookieJarLoad(t *testing.T) {
+	future := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	past := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	data := "# Netscape HTTP Cookie File\n" +
+		"\n" +
+		".example.com\tTRUE\t/\tFALSE\t" + future + "\tsite\t1\n" +
+		"files.example.com\tFALSE\t/dl\tTRUE\t0\tsession\tabc\r\n" +
+		"#HttpOnly_.example.com\tTRUE\t/\tFALSE\t" + future + "\thttponly\tx\n" +
+		".example.com\tTRUE\t/\tFALSE\t" + past + "\texpired\told\n" +
+		"other.org\tFALSE\t/\tFALSE\t0\tother\ty\n"
+	j := NewCookieJar()
+	if err := j.Load(writeCookieFile(t, data)); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		url  string
+		want []string
+	}{
+		{"http://example.com/", []string{"httponly=x", "site=1"}},
+		{"http://www.example.com/a/b", []string{"httponly=x", "site=1"}},
+		// Secure, host-only and limited to /dl
+		{"https://files.example.com/dl/app.tar.gz", []string{"httponly=x", "session=abc", "site=1"}},
+		{"http://files.example.com/dl/app.tar.gz", []string{"httponly=x", "site=1"}},
+		{"https://files.example.com/dlx", []string{"httponly=x", "site=1"}},
+		{"https://sub.files.example.com/dl/", []string{"httponly=x", "site=1"}},
+		{"http://other.org/", []string{"other=y"}},
+		{"http://notexample.com/", nil},
+	}
+	for _, tt := range tests {
+		if got := cookieNames(j, tt.url); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("cookies for %s = %q, want %q", tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestCookieJarLoadErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{"too few fields", "example.com\tFALSE\t/\tFALSE\t0\tname\n", "cookies.txt:1: expected 7 tab-separated fields"},
+		{"spaces instead of tabs", "# header\nexample.com FALSE / FALSE 0 name value\n", "cookies.txt:2: expected 7 tab-separated fields"},
+		{"bad expiry", "example.com\tFALSE\t/\tFALSE\tsoon\tname\tvalue\n", `cookies.txt:1: invalid expiry "soon"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := NewCookieJar().Load(writeCookieFile(t, tt.data))
+			if err == nil || !strings.HasSuffix(err.Error(), tt.want) {
+				t.Errorf("Load = %v, want an error ending in %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCookieJarSaveLoadRoundTrip(t *testing.T) {
+	j := NewCookieJar()
+	u, _ := url.Parse("https://files.example.com/dl/app.tar.gz")
+	expires := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+	j.SetCookies(u, []*http.Cookie{
+		{Name: "session", Value: "abc"},
+		{Name: "site", Value: "1", Domain: ".example.com", Path: "/", Expires: expires},
+		{Name: "auth", Value: "t0k", Path: "/dl", Secure: true, HttpOnly: true, MaxAge: 3600},
+		{Name: "gone", Value: "x", MaxAge: -1},
+		{Name: "tld", Value: "x", Domain: "com"},
+		{Name: "foreign", Value: "x", Domain: "other.org"},
+	})
+
+	path := filepath.Join(t.TempDir(), "cookies.txt")
+	if err := j.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	saved, _ := ioutil.ReadFile(path)
+	if !strings.HasPrefix(string(saved), "# Netscape HTTP Cookie File\n") {
+		t.Errorf("saved file lacks the Netscape header:\n%s", saved)
+	}
+	if !strings.Contains(string(saved), "#HttpOnly_files.example.com\tFALSE\t/dl\tTRUE\t") {
+		t.Errorf("saved file lacks the HttpOnly cookie:\n%s", saved)
+	}
+	if !strings.Contains(string(saved), ".example.com\tTRUE\t/\tFALSE\t"+strconv.FormatInt(expires.Unix(), 10)+"\tsite\t1\n") {
+		t.Errorf("saved file lacks the domain cookie:\n%s", saved)
+	}
+
+	loaded := NewCookieJar()
+	if err := loaded.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	// cookies.txt keeps expiry times to the second
+	truncated := map[string]jarCookie{}
+	for key, c := range j.cookies {
+		tc := *c
+		if !tc.Expires.IsZero() {
+			tc.Expires = time.Unix(tc.Expires.Unix(), 0)
+		}
+		truncated[key] = tc
+	}
+	reloaded := map[string]jarCookie{}
+	for key, c := range loaded.cookies {
+		reloaded[key] = *c
+	}
+	if !reflect.DeepEqual(reloaded, truncated) {
+		for key, c := range j.cookies {
+			t.Logf("saved  %s: %+v", key, c)
+		}
+		for key, c := range loaded.cookies {
+			t.Logf("loaded %s: %+v", key, c)
+		}
+		t.Fatal("cookies differ after a save and load")
+	}
+	if got, want := cookieNames(loaded, "https://files.example.com/dl/x"), []string{"auth=t0k", "session=abc", "site=1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("cookies after reload = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Credentials authenticate requests to one host, either with a username and
+// password (HTTP Basic) or with a bearer token
+type Credentials struct {
+	Username string
+	Password string
+	Token    string
+}
+
+// CredentialStore looks up credentials per host from an external helper and
+// the .netrc file. Results are cached for the life of the process so retries,
+// segments and the files of a batch do not run the helper again.
+type CredentialStore struct {
+	NetrcFile string // path to the .netrc file, empty to disable
+	Helper    string // credential helper command, empty to disable
+
+	mu    sync.Mutex
+	cache map[string]*credentialLookup
+}
+
+// credentialLookup is the cached answer for one host. done is closed once
+// creds and err are set, so concurrent requests to the host wait for the
+// first lookup without holding the store's lock while the helper runs.
+type credentialLookup struct {
+	done  chan struct{}
+	creds *Credentials
+	err   error
+}
+
+// Lookup returns the credentials for u's host, or nil if none are configured
+func (s *CredentialStore) Lookup(u *url.URL) (*Credentials, error) {
+	if s == nil {
+		return nil, nil
+	}
+	key := u.Scheme + "://" + u.Host
+
+	s.mu.Lock()
+	if l, ok := s.cache[key]; ok {
+		s.mu.Unlock()
+		<-l.done
+		return l.creds, l.err
+	}
+	if s.cache == nil {
+		s.cache = map[string]*credentialLookup{}
+	}
+	l := &credentialLookup{done: make(chan struct{})}
+	s.cache[key] = l
+	s.mu.Unlock()
+
+	l.creds, l.err = s.lookup(u)
+	if l.err != nil {
+		// Let a retry run the helper again
+		s.mu.Lock()
+		delete(s.cache, key)
+		s.mu.Unlock()
+	}
+	close(l.done)
+	return l.creds, l.err
+}
+
+// lookup asks the helper, then the .netrc file, for u's credentials
+func (s *CredentialStore) lookup(u *url.URL) (*Credentials, error) {
+	if s.Helper != "" {
+		creds, err := runCredentialHelper(s.Helper, u)
+		if creds != nil || err != nil {
+			return creds, err
+		}
+	}
+	if login, password, ok := lookupNetrc(s.NetrcFile, u.Hostname()); ok {
+		return &Credentials{Username: login, Password: password}, nil
+	}
+	return nil, nil
+}
+
+// runCredentialHelper asks an external command for credentials using the
+// git-credential style protocol: "get" is passed as the last argument and
+// key=value lines describing the request are written to stdin:
+//
+//	protocol=https
+//	host=example.com:8443
+//	path=files/artifact.tar.gz
+//
+// The helper answers with key=value lines: username and password for Basic
+// auth, or token (equivalently authtype=Bearer with credential) for a bearer
+// token. Empty output means the helper has no credentials for the URL.
+func runCredentialHelper(helper string, u *url.URL) (*Credentials, error) {
+	var stdin bytes.Buffer
+	fmt.Fprintf(&stdin, "protocol=%s\nhost=%s\npath=%s\n\n", u.Scheme, u.Host, strings.TrimPrefix(u.Path, "/"))
+
+	cmd := shellCommand(context.Background(), helper+" get")
+	cmd.Stdin = &stdin
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("credential helper failed: %w", err)
+	}
+
+	values := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), "=", 2)
+		if len(parts) == 2 {
+			values[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+		}
+	}
+
+	creds := &Credentials{
+		Username: values["username"],
+		Password: values["password"],
+		Token:    values["token"],
+	}
+	if strings.EqualFold(values["authtype"], "bearer") {
+		creds.Token = values["credential"]
+	}
+	if creds.Username == "" && creds.Password == "" && creds.Token == "" {
+		return nil, nil
+	}
+	return creds, nil
+}
+
+// Apply sets the Authorization header on req
+func (c *Credentials) Apply(req *http.Request) {
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+		return
+	}
+	req.SetBasicAuth(c.Username, c.Password)
+}
+
+// authTransport adds credentials to each request based on its own URL. Because
+// the lookup happens per request, a redirect to another host never carries
+// the credentials of the original one. Passwords from the helper or .netrc
+// are only sent once the host has asked for them with a Basic or Digest
+// challenge, so a Digest-only server never sees one in the clear. It also
+// refreshes OAuth2 tokens that the server rejects.
+type authTransport struct {
+	base       http.RoundTripper
+	store      *CredentialStore
+	oauth      *OAuth2Source // nil unless OAuth2 is configured
+	challenges challengeCache
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var creds *Credentials
+	switch {
+	case req.Header.Get("Authorization") != "":
+		// Credentials given explicitly (URL userinfo or -H) take precedence,
+		// but Basic ones may still be used to answer a Digest challenge
+		if user, pass, ok := req.BasicAuth(); ok {
+			creds = &Credentials{Username: user, Password: pass}
+		}
+	case t.oauth != nil && req.URL.Host == t.oauth.Host:
+		return t.roundTripOAuth2(req)
+	default:
+		var err error
+		creds, err = t.store.Lookup(req.URL)
+		if err != nil {
+			return nil, err
+		}
+		if creds != nil {
+			// RoundTrippers must not modify the caller's request
+			req = req.Clone(req.Context())
+			if creds.Token != "" {
+				creds.Apply(req)
+			} else {
+				t.challenges.authorize(req, creds)
+			}
+		}
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if creds == nil || creds.Token != "" {
+		return resp, err
+	}
+
+	// Answer the server's challenge. A second challenge is only worth
+	// answering when the server says our Digest nonce went stale.
+	sent := req
+	for i := 0; i < 2 && err == nil && resp.StatusCode == http.StatusUnauthorized; i++ {
+		headers := resp.Header.Values("WWW-Authenticate")
+		digest := parseDigestChallenge(headers)
+		switch {
+		case digest != nil && (i == 0 || digest.stale):
+			t.challenges.setDigest(req.URL.Host, digest)
+		case digest == nil && sent.Header.Get("Authorization") == "" && hasBasicChallenge(headers):
+			t.challenges.setBasic(req.URL.Host)
+		default:
+			return resp, err
+		}
+		retry, rerr := rewindRequest(req)
+		if rerr != nil {
+			break
+		}
+		t.challenges.authorize(retry, creds)
+		drainBody(resp)
+		sent = retry
+		resp, err = t.base.RoundTrip(retry)
+	}
+	return resp, err
+}
+
+// roundTripOAuth2 sends req with a bearer token, fetching a new token and
+// trying once more if the server rejects the current one
+func (t *authTransport) roundTripOAuth2(req *http.Request) (*http.Response, error) {
+	token, err := t.oauth.Token(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	authed, err := rewindRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	authed.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := t.base.RoundTrip(authed)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	drainBody(resp)
+	t.oauth.Invalidate(token)
+	token, err = t.oauth.Token(req.Context())
+	if err != nil {
+		return nil, fmt.Errorf("refreshing the rejected OAuth2 token: %w", err)
+	}
+	retry, err := rewindRequest(req)
+	if err != nil {
+		return nil, fmt.Errorf("resending the request with a new OAuth2 token: %w", err)
+	}
+	retry.Header.Set("Authorization", "Bearer "+token)
+	return t.base.RoundTrip(retry)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writeHelper writes a credential helper script that appends a line to a log
+// file on every run, sleeps briefly, and prints out
+func writeHelper(t *testing.T, out string) (helper, log string) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("helper script needs sh")
+	}
+	dir := t.TempDir()
+	log = filepath.Join(dir, "runs")
+	helper = filepath.Join(dir, "helper")
+	script := "#!/bin/sh\ncat >/dev/null\necho run >>'" + log + "'\nsleep 0.2\nprintf '" + out + "'\n"
+	if err := ioutil.WriteFile(helper, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return helper, log
+}
+
+func TestCredentialStoreRunsHelperOncePerHost(t *testing.T) {
+	helper, log := writeHelper(t, `username=ci\npassword=secret\n`)
+	store := &CredentialStore{Helper: helper}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			u, _ := url.Parse("https://artifacts.example.com/builds/" + string(rune('a'+i)))
+			creds, err := store.Lookup(u)
+			if err != nil || creds == nil || creds.Username != "ci" || creds.Password != "secret" {
+				t.Errorf("Lookup = %+v, %v", creds, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	runs, _ := ioutil.ReadFile(log)
+	if n := strings.Count(string(runs), "run"); n != 1 {
+		t.Errorf("helper ran %d times, want 1", n)
+	}
+}
+
+func TestCredentialStoreHostsDoNotWaitForEachOther(t *testing.T) {
+	helper, log := writeHelper(t, `token=abc\n`)
+	store := &CredentialStore{Helper: helper}
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for _, host := range []string{"a.example.com", "b.example.com", "c.example.com", "d.example.com"} {
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			creds, err := store.Lookup(&url.URL{Scheme: "https", Host: host})
+			if err != nil || creds == nil || creds.Token != "abc" {
+				t.Errorf("Lookup(%s) = %+v, %v", host, creds, err)
+			}
+		}(host)
+	}
+	wg.Wait()
+
+	// Four helpers of 0.2s each take about 0.8s when run one after another
+	if elapsed := time.Since(start); elapsed > 700*time.Millisecond {
+		t.Errorf("lookups took %v; the helper runs were serialized", elapsed)
+	}
+	runs, _ := ioutil.ReadFile(log)
+	if n := strings.Count(string(runs), "run"); n != 4 {
+		t.Errorf("helper ran %d times, want 4", n)
+	}
+}
+
+func TestCredentialStoreFallsBackToNetrc(t *testing.T) {
+	helper, _ := writeHelper(t, ``)
+	netrc := filepath.Join(t.TempDir(), "netrc")
+	if err := ioutil.WriteFile(netrc, []byte("machine files.example.com login alice password pw\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	store := &CredentialStore{Helper: helper, NetrcFile: netrc}
+
+	creds, err := store.Lookup(&url.URL{Scheme: "https", Host: "files.example.com"})
+	if err != nil || creds == nil || creds.Username != "alice" || creds.Password != "pw" {
+		t.Fatalf("Lookup = %+v, %v", creds, err)
+	}
+	creds, err = store.Lookup(&url.URL{Scheme: "https", Host: "other.example.com"})
+	if err != nil || creds != nil {
+		t.Fatalf("Lookup(other) = %+v, %v; want no credentials", creds, err)
+	}
+}
+
+func TestCredentialStoreRetriesFailedHelper(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("helper script needs sh")
+	}
+	store := &CredentialStore{Helper: "false"}
+	u := &url.URL{Scheme: "https", Host: "example.com"}
+	for i := 0; i < 2; i++ {
+		if _, err := store.Lookup(u); err == nil {
+			t.Fatalf("Lookup %d succeeded with a failing helper", i)
+		}
+	}
+}
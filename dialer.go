@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// stringList collects a repeatable string flag
+type stringList []string
+
+func (s *stringList) String() string { return strings.Join(*s, ", ") }
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// DialOptions control how connections are made: curl-style host overrides,
+// the address family, the DNS server and the local end of each connection
+type DialOptions struct {
+	Resolve    map[string][]string // "host:port" -> addresses to connect to instead
+	ConnectTo  map[string]string   // "host:port", "host:" or ":port" -> "host:port"
+	Network    string              // "tcp", "tcp4" or "tcp6"
+	DNSServer  string              // "ip:port" of the DNS server, empty for the system resolver
+	LocalAddr  net.IP              // source address for outgoing connections
+	Interface  string              // network interface outgoing connections are bound to
+	UnixSocket string              // connect to this Unix domain socket instead of over TCP
+}
+
+// splitHostPortSpec splits the leading "host:port" of a curl-style spec,
+// allowing bracketed IPv6 hosts, and returns the remainder after the next colon
+func splitHostPortSpec(spec string) (host, port, rest string, err error) {
+	if strings.HasPrefix(spec, "[") {
+		end := strings.Index(spec, "]")
+		if end < 0 {
+			return "", "", "", fmt.Errorf("missing ']' in %q", spec)
+		}
+		host, spec = spec[1:end], spec[end+1:]
+		if !strings.HasPrefix(spec, ":") {
+			return "", "", "", fmt.Errorf("missing port in %q", spec)
+		}
+		spec = spec[1:]
+	} else {
+		parts := strings.SplitN(spec, ":", 2)
+		if len(parts) != 2 {
+			return "", "", "", fmt.Errorf("missing port in %q", spec)
+		}
+		host, spec = parts[0], parts[1]
+	}
+	parts := strings.SplitN(spec, ":", 2)
+	port = parts[0]
+	if len(parts) == 2 {
+		rest = parts[1]
+	}
+	return strings.ToLower(host), port, rest, nil
+}
+
+// parseResolve parses -resolve entries of the form host:port:addr[,addr...]
+func parseResolve(entries []string) (map[string][]string, error) {
+	resolve := map[string][]string{}
+	for _, entry := range entries {
+		host, port, rest, err := splitHostPortSpec(entry)
+		if err != nil || host == "" || port == "" || rest == "" {
+			return nil, fmt.Errorf("invalid -resolve %q, expected host:port:addr", entry)
+		}
+		for _, addr := range strings.Split(rest, ",") {
+			addr = strings.Trim(strings.TrimSpace(addr), "[]")
+			if net.ParseIP(addr) == nil {
+				return nil, fmt.Errorf("invalid -resolve %q: %q is not an IP address", entry, addr)
+			}
+			resolve[net.JoinHostPort(host, port)] = append(resolve[net.JoinHostPort(host, port)], addr)
+		}
+	}
+	return resolve, nil
+}
+
+// parseConnectTo parses -connect-to entries of the form
+// host1:port1:host2:port2. An empty host1 or port1 matches any host or port;
+// an empty host2 or port2 keeps the original one.
+func parseConnectTo(entries []string) (map[string]string, error) {
+	connectTo := map[string]string{}
+	for _, entry := range entries {
+		host1, port1, rest, err := splitHostPortSpec(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -connect-to %q: %v", entry, err)
+		}
+		host2, port2, _, err := splitHostPortSpec(rest)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -connect-to %q, expected host1:port1:host2:port2", entry)
+		}
+		connectTo[host1+":"+port1] = net.JoinHostPort(host2, port2)
+	}
+	return connectTo, nil
+}
+
+// connectTarget applies -connect-to to addr, trying the exact host and port
+// first, then the host-only and port-only wildcards, and finally an entry
+// matching any host and port
+func (o *DialOptions) connectTarget(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || len(o.ConnectTo) == 0 {
+		return addr
+	}
+	host = strings.ToLower(host)
+	for _, key := range []string{host + ":" + port, host + ":", ":" + port, ":"} {
+		target, ok := o.ConnectTo[key]
+		if !ok {
+			continue
+		}
+		newHost, newPort, _ := net.SplitHostPort(target)
+		if newHost == "" {
+			newHost = host
+		}
+		if newPort == "" {
+			newPort = port
+		}
+		return net.JoinHostPort(newHost, newPort)
+	}
+	return addr
+}
+
+// interfaceAddr returns an address of the named interface suitable for
+// network ("tcp4" prefers IPv4, "tcp6" requires IPv6)
+func interfaceAddr(name, network string) (net.IP, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var v4, v6 net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if ipNet.IP.To4() != nil {
+			if v4 == nil {
+				v4 = ipNet.IP
+			}
+		} else if v6 == nil {
+			v6 = ipNet.IP
+		}
+	}
+	switch {
+	case network == "tcp6" && v6 != nil:
+		return v6, nil
+	case network != "tcp6" && v4 != nil:
+		return v4, nil
+	case network == "tcp" && v6 != nil:
+		return v6, nil
+	}
+	return nil, fmt.Errorf("interface %s has no usable address", name)
+}
+
+// localDialer returns a dialer for network bound to the -local-addr and
+// -interface of opts, so DNS queries leave the same way as the connections
+func localDialer(opts DialOptions, network string, timeout time.Duration) *net.Dialer {
+	dialer := &net.Dialer{Timeout: timeout}
+	if opts.LocalAddr != nil {
+		if strings.HasPrefix(network, "udp") {
+			dialer.LocalAddr = &net.UDPAddr{IP: opts.LocalAddr}
+		} else {
+			dialer.LocalAddr = &net.TCPAddr{IP: opts.LocalAddr}
+		}
+	}
+	if opts.Interface != "" {
+		dialer.Control = bindToDevice(opts.Interface)
+	}
+	return dialer
+}
+
+// newDialContext returns the DialContext used for every connection, so the
+// overrides apply equally to the first request, retries and resumes. UDP
+// tracker connections get the same treatment, except for -unix-socket.
+func newDialContext(config *Config) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	opts := config.Dial
+	tcpDialer := localDialer(opts, "tcp", config.Timeout)
+	tcpDialer.KeepAlive = 30 * time.Second
+	udpDialer := localDialer(opts, "udp", config.Timeout)
+	if opts.DNSServer != "" {
+		tcpDialer.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return localDialer(opts, network, 5*time.Second).DialContext(ctx, network, opts.DNSServer)
+			},
+		}
+		udpDialer.Resolver = tcpDialer.Resolver
+	}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialer := tcpDialer
+		if strings.HasPrefix(network, "udp") {
+			dialer = udpDialer
+			// -4 and -6 pick "udp4" and "udp6"
+			if opts.Network != "" {
+				network = "udp" + strings.TrimPrefix(opts.Network, "tcp")
+			}
+		} else {
+			// The URL keeps supplying the Host header, path and TLS server name
+			if opts.UnixSocket != "" {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", opts.UnixSocket)
+			}
+			if opts.Network != "" && opts.Network != "tcp" {
+				network = opts.Network
+			}
+		}
+		addr = opts.connectTarget(addr)
+
+		ips, ok := opts.Resolve[strings.ToLower(addr)]
+		if !ok {
+			return dialer.DialContext(ctx, network, addr)
+		}
+		_, port, _ := net.SplitHostPort(addr)
+		var errs []error
+		for _, ip := range ips {
+			conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+			if err == nil {
+				return conn, nil
+			}
+			errs = append(errs, err)
+		}
+		return nil, errors.Join(errs...)
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseResolve(t *testing.T) {
+	tests := []struct {
+		entries []string
+		want    map[string][]string // nil when an error is expected
+	}{
+		{
+			entries: []string{"example.com:443:127.0.0.1"},
+			want:    map[string][]string{"example.com:443": {"127.0.0.1"}},
+		},
+		{
+			entries: []string{"Example.COM:80:10.0.0.1, 10.0.0.2", "example.com:80:10.0.0.3"},
+			want:    map[string][]string{"example.com:80": {"10.0.0.1", "10.0.0.2", "10.0.0.3"}},
+		},
+		{
+			entries: []string{"example.com:443:[::1],127.0.0.1"},
+			want:    map[string][]string{"example.com:443": {"::1", "127.0.0.1"}},
+		},
+		{
+			entries: []string{"[2001:db8::1]:8443:::1"},
+			want:    map[string][]string{"[2001:db8::1]:8443": {"::1"}},
+		},
+		{entries: nil, want: map[string][]string{}},
+		{entries: []string{"example.com:443"}},
+		{entries: []string{"example.com::127.0.0.1"}},
+		{entries: []string{":443:127.0.0.1"}},
+		{entries: []string{"example.com:443:localhost"}},
+		{entries: []string{"[::1:443:127.0.0.1"}},
+	}
+	for _, tt := range tests {
+		got, err := parseResolve(tt.entries)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("parseResolve(%q) = %v, want an error", tt.entries, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseResolve(%q) = %v, %v; want %v", tt.entries, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseConnectTo(t *testing.T) {
+	tests := []struct {
+		entries []string
+		want    map[string]string // nil when an error is expected
+	}{
+		{
+			entries: []string{"example.com:443:backend.internal:8443"},
+			want:    map[string]string{"example.com:443": "backend.internal:8443"},
+		},
+		{
+			entries: []string{"EXAMPLE.com:443:[::1]:8443"},
+			want:    map[string]string{"example.com:443": "[::1]:8443"},
+		},
+		{
+			entries: []string{"example.com::backend.internal:", "::other:8443", "[2001:db8::1]:80:10.0.0.1:8080"},
+			want: map[string]string{
+				"example.com:":   "backend.internal:",
+				":":              "other:8443",
+				"2001:db8::1:80": "10.0.0.1:8080",
+			},
+		},
+		{entries: []string{"example.com"}},
+		{entries: []string{"example.com:443"}},
+		{entries: []string{"example.com:443:[::1"}},
+	}
+	for _, tt := range tests {
+		got, err := parseConnectTo(tt.entries)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("parseConnectTo(%q) = %v, want an error", tt.entries, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseConnectTo(%q) = %v, %v; want %v", tt.entries, got, err, tt.want)
+		}
+	}
+}
+
+func TestConnectTarget(t *testing.T) {
+	connectTo, err := parseConnectTo([]string{
+		"example.com:443:backend.internal:8443",
+		"example.com::other.internal:",
+		":8080::9090",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := &DialOptions{ConnectTo: connectTo}
+
+	tests := []struct{ addr, want string }{
+		{"example.com:443", "backend.internal:8443"},
+		{"EXAMPLE.com:443", "backend.internal:8443"},
+		{"example.com:80", "other.internal:80"},
+		{"cdn.example.com:8080", "cdn.example.com:9090"},
+		{"example.com:8080", "other.internal:8080"},
+		{"unrelated.org:443", "unrelated.org:443"},
+	}
+	for _, tt := range tests {
+		if got := opts.connectTarget(tt.addr); got != tt.want {
+			t.Errorf("connectTarget(%s) = %s, want %s", tt.addr, got, tt.want)
+		}
+	}
+
+	if got := (&DialOptions{}).connectTarget("example.com:443"); got != "example.com:443" {
+		t.Errorf("connectTarget without -connect-to = %s", got)
+	}
+
+	catchAll, err := parseConnectTo([]string{"example.com:443:backend.internal:8443", "::proxy.internal:3128"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts = &DialOptions{ConnectTo: catchAll}
+	for addr, want := range map[string]string{
+		"example.com:443":   "backend.internal:8443",
+		"unrelated.org:80":  "proxy.internal:3128",
+		"[2001:db8::1]:443": "proxy.internal:3128",
+	} {
+		if got := opts.connectTarget(addr); got != want {
+			t.Errorf("connectTarget(%s) with a catch-all = %s, want %s", addr, got, want)
+		}
+	}
+}
+
+// dnsServer answers A queries over UDP with 127.0.0.1 and records the
+// source address of every query
+type dnsServer struct {
+	conn    net.PacketConn
+	mu      sync.Mutex
+	sources []string
+}
+
+func startDNSServer(t *testing.T) *dnsServer {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &dnsServer{conn: conn}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.sources = append(s.sources, from.(*net.UDPAddr).IP.String())
+			s.mu.Unlock()
+			if reply := dnsReply(buf[:n]); reply != nil {
+				conn.WriteTo(reply, from)
+			}
+		}
+	}()
+	return s
+}
+
+// dnsReply answers a single-question query: 127.0.0.1 for type A, no
+// records for anything else
+func dnsReply(query []byte) []byte {
+	end := 12
+	for end < len(query) && query[end] != 0 {
+		end += int(query[end]) + 1
+	}
+	end += 5 // the root label, QTYPE and QCLASS
+	if end > len(query) {
+		return nil
+	}
+	reply := append([]byte(nil), query[:end]...)
+	binary.BigEndian.PutUint16(reply[2:], 0x8180) // response, recursion available
+	binary.BigEndian.PutUint16(reply[8:], 0)      // no authority records
+	binary.BigEndian.PutUint16(reply[10:], 0)     // no additional records
+	if binary.BigEndian.Uint16(query[end-4:]) != 1 {
+		binary.BigEndian.PutUint16(reply[6:], 0)
+		return reply
+	}
+	binary.BigEndian.PutUint16(reply[6:], 1)
+	return append(reply,
+		0xc0, 0x0c, // the name in the question
+		0, 1, 0, 1, // A, IN
+		0, 0, 0, 60, // TTL
+		0, 4, 127, 0, 0, 1)
+}
+
+func TestDNSServerUsesLocalAddr(t *testing.T) {
+	// Linux answers on all of 127.0.0.0/8; elsewhere only 127.0.0.1 may exist
+	if probe, err := net.ListenPacket("udp", "127.0.0.2:0"); err != nil {
+		t.Skip("127.0.0.2 is not available:", err)
+	} else {
+		probe.Close()
+	}
+	dns := startDNSServer(t)
+	defer dns.conn.Close()
+	var remote string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remote = r.RemoteAddr
+		fmt.Fprint(w, "resolved")
+	}))
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(srv.URL, "http://"))
+
+	config := &Config{
+		URL:      "http://files.dl-test.invalid:" + port + "/file",
+		FilePath: filepath.Join(t.TempDir(), "file"),
+		Quiet:    true,
+		Dial: DialOptions{
+			Network:   "tcp4",
+			DNSServer: dns.conn.LocalAddr().String(),
+			LocalAddr: net.ParseIP("127.0.0.2"),
+		},
+	}
+	if err := downloadWithRetry(context.Background(), config); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ioutil.ReadFile(config.FilePath); string(got) != "resolved" {
+		t.Errorf("downloaded %q", got)
+	}
+	if !strings.HasPrefix(remote, "127.0.0.2:") {
+		t.Errorf("connection came from %s, want 127.0.0.2", remote)
+	}
+	dns.mu.Lock()
+	defer dns.mu.Unlock()
+	if len(dns.sources) == 0 {
+		t.Fatal("the DNS server was not asked")
+	}
+	for _, src := range dns.sources {
+		if src != "127.0.0.2" {
+			t.Errorf("DNS query came from %s, want 127.0.0.2", src)
+		}
+	}
+}
+
+// loopbackInterface returns the name of the loopback interface
+func loopbackInterface(t *testing.T) string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 && iface.Flags&net.FlagUp != 0 {
+			return iface.Name
+		}
+	}
+	t.Skip("no loopback interface")
+	return ""
+}
+
+func TestInterfaceAddr(t *testing.T) {
+	lo := loopbackInterface(t)
+	ip, err := interfaceAddr(lo, "tcp4")
+	if err != nil || !ip.IsLoopback() || ip.To4() == nil {
+		t.Errorf("interfaceAddr(%s, tcp4) = %v, %v; want an IPv4 loopback address", lo, ip, err)
+	}
+	if ip, err := interfaceAddr(lo, "tcp6"); err == nil && ip.To4() != nil {
+		t.Errorf("interfaceAddr(%s, tcp6) = %v, want an IPv6 address", lo, ip)
+	}
+	if _, err := interfaceAddr("dl-no-such-if0", "tcp"); err == nil {
+		t.Error("interfaceAddr accepted a missing interface")
+	}
+}
+
+func TestBindOutgoingConnections(t *testing.T) {
+	var mu sync.Mutex
+	var remote string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		remote = r.RemoteAddr
+		mu.Unlock()
+		fmt.Fprint(w, "bound")
+	}))
+	defer srv.Close()
+	lo := loopbackInterface(t)
+
+	tests := []struct {
+		name string
+		dial DialOptions
+		from string // expected source address, "" for any
+	}{
+		{"local address", DialOptions{LocalAddr: net.ParseIP("127.0.0.2")}, "127.0.0.2"},
+		{"interface", DialOptions{Interface: lo}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.dial.Interface != "" && !bindToDeviceSupported {
+				t.Skip("SO_BINDTODEVICE is Linux only; elsewhere -interface sets the local address")
+			}
+			if tt.dial.LocalAddr != nil {
+				probe, err := net.ListenPacket("udp", net.JoinHostPort(tt.dial.LocalAddr.String(), "0"))
+				if err != nil {
+					t.Skip(tt.dial.LocalAddr, "is not available:", err)
+				}
+				probe.Close()
+			}
+			config := &Config{URL: srv.URL + "/file", FilePath: filepath.Join(t.TempDir(), "file"), Quiet: true, Dial: tt.dial}
+			if err := downloadWithRetry(context.Background(), config); err != nil {
+				if tt.dial.Interface != "" && strings.Contains(err.Error(), "operation not permitted") {
+					t.Skip("SO_BINDTODEVICE needs CAP_NET_RAW:", err)
+				}
+				t.Fatal(err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if tt.from != "" && !strings.HasPrefix(remote, tt.from+":") {
+				t.Errorf("connection came from %s, want %s", remote, tt.from)
+			}
+		})
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	// Socket paths are limited to about 100 bytes, which t.TempDir may exceed
+	dir, err := ioutil.TempDir("", "dl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "api.sock")
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Skip("Unix sockets are not available:", err)
+	}
+	body := bytes.Repeat([]byte("layer"), 1000)
+	var mu sync.Mutex
+	var hosts, ranges []string
+	srv := &httptest.Server{Listener: ln, Config: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hosts = append(hosts, r.Host)
+		ranges = append(ranges, r.Header.Get("Range"))
+		mu.Unlock()
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+	})}}
+	srv.Start()
+	defer srv.Close()
+
+	path := filepath.Join(t.TempDir(), "image.tar")
+	if err := ioutil.WriteFile(path, body[:1234], 0644); err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{
+		URL:      "http://docker.local/v1.43/images/get",
+		FilePath: path,
+		Resume:   true,
+		Quiet:    true,
+		// Proxies do not apply to a local socket
+		Proxy: "http://127.0.0.1:1",
+		Dial:  DialOptions{Network: "tcp", UnixSocket: sock},
+	}
+	if err := downloadWithRetry(context.Background(), config); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ioutil.ReadFile(path); !bytes.Equal(got, body) {
+		t.Fatalf("resumed file has %d bytes that differ from the body", len(got))
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(hosts, []string{"docker.local"}) || !reflect.DeepEqual(ranges, []string{"bytes=1234-"}) {
+		t.Errorf("requests had Host %q and Range %q", hosts, ranges)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// progressInterval is how often progress events are emitted in JSON mode
+const progressInterval = time.Second
+
+// EventLog writes newline-delimited JSON events describing a download.
+// A nil *EventLog is valid and discards everything, so callers never need
+// to check whether JSON output was requested.
+type EventLog struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewEventLog creates an event log writing to w
+func NewEventLog(w io.Writer) *EventLog {
+	return &EventLog{enc: json.NewEncoder(w)}
+}
+
+// Emit writes a single event. The event name and a timestamp are added to fields.
+func (l *EventLog) Emit(event string, fields map[string]interface{}) {
+	if l == nil {
+		return
+	}
+	if fields == nil {
+		fields = map[string]interface{}{}
+	}
+	fields["event"] = event
+	fields["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.enc.Encode(fields)
+}
+
+// countingReader counts the bytes read through it so progress can be
+// sampled from another goroutine
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
+
+// Count returns the number of bytes read so far
+func (c *countingReader) Count() int64 {
+	return atomic.LoadInt64(&c.n)
+}
+
+// startProgressEvents emits a progress event every progressInterval until the
+// returned stop function is called. count reports the bytes read so far and
+// offset is the number of bytes already on disk.
+func startProgressEvents(config *Config, count func() int64, offset, totalSize int64) func() {
+	if config.Events == nil {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+
+		last := int64(0)
+		lastTime := time.Now()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				read := count()
+				speed := float64(read-last) / now.Sub(lastTime).Seconds()
+				last, lastTime = read, now
+				config.Events.Emit("progress", map[string]interface{}{
+					"bytes":       offset + read,
+					"total":       totalSize,
+					"bytes_per_s": int64(speed),
+				})
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+// fileHashes computes the MD5 and SHA256 digests of a file in a single pass
+func fileHashes(filePath string) (map[string]string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	md5h := md5.New()
+	sha256h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(md5h, sha256h), f); err != nil {
+		return nil, err
+	}
+
+	return map[string]string{
+		"md5":    hex.EncodeToString(md5h.Sum(nil)),
+		"sha256": hex.EncodeToString(sha256h.Sum(nil)),
+	}, nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// readEvents decodes the newline-delimited events written to buf
+func readEvents(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+	var events []map[string]interface{}
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		var e map[string]interface{}
+		if err := dec.Decode(&e); err != nil {
+			t.Fatalf("bad event line: %v", err)
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+func TestEventLogNil(t *testing.T) {
+	var l *EventLog
+	l.Emit("start", nil) // must not panic
+}
+
+func TestEventLogConcurrent(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewEventLog(&buf)
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			l.Emit("progress", map[string]interface{}{"bytes": i})
+		}(i)
+	}
+	wg.Wait()
+
+	events := readEvents(t, &buf)
+	if len(events) != 50 {
+		t.Fatalf("%d events, want 50", len(events))
+	}
+	for _, e := range events {
+		if e["event"] != "progress" || e["time"] == nil {
+			t.Errorf("event = %v, want a timestamped progress event", e)
+		}
+	}
+}
+
+func TestDownloadEvents(t *testing.T) {
+	body := []byte("event payload\n")
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(body)
+	}))
+	defer srv.Close()
+
+	md5sum := md5.Sum(body)
+	sha := sha256.Sum256(body)
+	var buf bytes.Buffer
+	config := &Config{
+		URL:         srv.URL + "/file.txt",
+		FilePath:    filepath.Join(t.TempDir(), "file.txt"),
+		MaxRetries:  1,
+		Quiet:       true,
+		Checksum:    hex.EncodeToString(sha[:]),
+		ChecksumAlg: "sha256",
+		Events:      NewEventLog(&buf),
+	}
+	if err := downloadWithRetry(context.Background(), config); err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	byName := map[string]map[string]interface{}{}
+	for _, e := range readEvents(t, &buf) {
+		name := e["event"].(string)
+		names = append(names, name)
+		byName[name] = e
+	}
+	if got := fmt.Sprint(names); got != "[retry start checksum finish]" {
+		t.Fatalf("events = %s, want [retry start checksum finish]", got)
+	}
+	if e := byName["retry"]; e["attempt"] != 1.0 || e["max"] != 1.0 {
+		t.Errorf("retry = %v", e)
+	}
+	if e := byName["start"]; e["size"] != float64(len(body)) || e["offset"] != 0.0 || e["status"] != 200.0 {
+		t.Errorf("start = %v", e)
+	}
+	if e := byName["checksum"]; e["ok"] != true || e["algorithm"] != "sha256" {
+		t.Errorf("checksum = %v", e)
+	}
+	finish := byName["finish"]
+	hashes, _ := finish["hashes"].(map[string]interface{})
+	if finish["bytes"] != float64(len(body)) || hashes["md5"] != hex.EncodeToString(md5sum[:]) || hashes["sha256"] != config.Checksum {
+		t.Errorf("finish = %v", finish)
+	}
+}
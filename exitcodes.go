@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"syscall"
+)
+
+// Exit codes returned by dl. Scripts can rely on these values.
+const (
+	ExitOK          = 0  // download (and verification) succeeded
+	ExitFailure     = 1  // unclassified failure or redirect policy violation
+	ExitUsage       = 2  // invalid flags or arguments
+	ExitNetwork     = 3  // connection, DNS or transfer error
+	ExitClientError = 4  // the server refused the request: HTTP 4xx, permanent FTP reply, SSH login or file error
+	ExitServerError = 5  // the server failed: HTTP 5xx or transient FTP reply
+	ExitTimeout     = 6  // request timed out or the transfer stalled
+	ExitChecksum    = 7  // checksum mismatch
+	ExitSignature   = 8  // signature verification failed; reserved, as signatures are not verified yet
+	ExitIO          = 9  // local disk or file error
+	ExitInterrupted = 10 // interrupted; the partial file can be resumed with -r
+	ExitTLS         = 11 // certificate or SSH host key verification, or pinning, failed
+)
+
+// ErrInterrupted is returned when the download is stopped by SIGINT or SIGTERM
+var ErrInterrupted = errors.New("download interrupted")
+
+// UsageError reports invalid command line arguments
+type UsageError struct {
+	Err error
+}
+
+func (e *UsageError) Error() string { return e.Err.Error() }
+
+func (e *UsageError) Unwrap() error { return e.Err }
+
+// HTTPError is returned when the server answers with an unexpected status
+type HTTPError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("HTTP error: %s (status code %d)", e.Status, e.StatusCode)
+}
+
+// ChecksumError is returned when the downloaded file does not match the expected digest
+type ChecksumError struct {
+	Algorithm string
+	Expected  string
+	Actual    string
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("checksum mismatch: expected %s, got %s", e.Expected, e.Actual)
+}
+
+// exitCode maps an error returned by the downloader to a process exit code
+func exitCode(err error) int {
+	if err == nil {
+		return ExitOK
+	}
+
+	var usageErr *UsageError
+	var httpErr *HTTPError
+	var checksumErr *ChecksumError
+	var proxyErr *ProxyError
+	var tlsErr *TLSError
+	var redirectErr *RedirectError
+	var ftpErr *FTPError
+	var sshErr *SSHError
+	var netErr net.Error
+	var urlErr *url.Error
+	var pathErr *os.PathError
+	var linkErr *os.LinkError
+
+	switch {
+	case errors.Is(err, ErrInterrupted):
+		return ExitInterrupted
+	case errors.As(err, &usageErr):
+		return ExitUsage
+	case errors.As(err, &checksumErr):
+		return ExitChecksum
+	case errors.As(err, &redirectErr):
+		return ExitFailure
+	case errors.As(err, &tlsErr):
+		return ExitTLS
+	case errors.As(err, &proxyErr):
+		return ExitNetwork
+	case errors.As(err, &httpErr):
+		if httpErr.StatusCode >= 500 {
+			return ExitServerError
+		}
+		return ExitClientError
+	case errors.As(err, &sshErr):
+		if sshErr.Reason == "host key" {
+			return ExitTLS
+		}
+		return ExitClientError
+	case errors.As(err, &ftpErr):
+		if ftpErr.Permanent() {
+			return ExitClientError
+		}
+		return ExitServerError
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return ExitTimeout
+	case errors.Is(err, syscall.ENOSPC),
+		errors.As(err, &pathErr),
+		errors.As(err, &linkErr):
+		return ExitIO
+	case errors.As(err, &urlErr),
+		errors.As(err, &netErr),
+		errors.Is(err, io.ErrUnexpectedEOF):
+		return ExitNetwork
+	}
+	return ExitFailure
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"success", nil, ExitOK},
+		{"unknown", errors.New("boom"), ExitFailure},
+		{"interrupted", fmt.Errorf("%w: resume with -r", ErrInterrupted), ExitInterrupted},
+		{"usage", &UsageError{errors.New("bad flag")}, ExitUsage},
+		{"checksum", fmt.Errorf("checksum verification failed: %w", &ChecksumError{}), ExitChecksum},
+		{"redirect", &RedirectError{Reason: "HTTPS to HTTP downgrade"}, ExitFailure},
+		{"tls", &TLSError{Reason: "pin mismatch", Err: errors.New("x")}, ExitTLS},
+		{"proxy", &ProxyError{StatusCode: 407}, ExitNetwork},
+		{"http 404", &HTTPError{StatusCode: 404}, ExitClientError},
+		{"http 503", fmt.Errorf("download failed after 3 attempts: %w", &HTTPError{StatusCode: 503}), ExitServerError},
+		{"ssh host key", &SSHError{Reason: "host key", Err: errors.New("x")}, ExitTLS},
+		{"ssh login", &SSHError{Reason: "authentication", Err: errors.New("x")}, ExitClientError},
+		{"ftp permanent", &FTPError{Command: "RETR", Code: 550}, ExitClientError},
+		{"ftp transient", &FTPError{Command: "RETR", Code: 421}, ExitServerError},
+		{"deadline", context.DeadlineExceeded, ExitTimeout},
+		{"disk full", fmt.Errorf("write: %w", syscall.ENOSPC), ExitIO},
+		{"missing file", &os.PathError{Op: "open", Path: "/x", Err: os.ErrNotExist}, ExitIO},
+		{"connection refused", &net.OpError{Op: "dial", Err: errors.New("connection refused")}, ExitNetwork},
+		{"url error", &url.Error{Op: "Get", URL: "http://x", Err: errors.New("EOF")}, ExitNetwork},
+		{"short body", io.ErrUnexpectedEOF, ExitNetwork},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := exitCode(tt.err); got != tt.want {
+				t.Errorf("exitCode(%v) = %d, want %d", tt.err, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FTPError is returned when an FTP server answers a command with a failure
+// reply. 4xx replies are transient and retried; 5xx replies are permanent.
+type FTPError struct {
+	Command string
+	Code    int
+	Msg     string
+}
+
+func (e *FTPError) Error() string {
+	return fmt.Sprintf("FTP error: %s: %d %s", e.Command, e.Code, e.Msg)
+}
+
+// Permanent reports whether the server will keep refusing the command
+func (e *FTPError) Permanent() bool { return e.Code >= 500 }
+
+// isFTPURL reports whether raw is an ftp:// or ftps:// URL
+func isFTPURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && (u.Scheme == "ftp" || u.Scheme == "ftps")
+}
+
+// ftpConn is a control connection to an FTP server
+type ftpConn struct {
+	conn   net.Conn
+	text   *textproto.Conn
+	host   string
+	tls    *tls.Config // non-nil once AUTH TLS has succeeded
+	dial   func(ctx context.Context, network, addr string) (net.Conn, error)
+	config *Config
+}
+
+// cmd sends a command and reads the reply, which must start with one of the
+// expected codes. It returns the reply code and message.
+func (c *ftpConn) cmd(expect []int, format string, args ...interface{}) (int, string, error) {
+	if err := c.text.PrintfLine(format, args...); err != nil {
+		return 0, "", err
+	}
+	return c.reply(strings.Fields(format)[0], expect)
+}
+
+// reply reads one (possibly multi-line) reply for command
+func (c *ftpConn) reply(command string, expect []int) (int, string, error) {
+	code, msg, err := c.text.ReadResponse(0)
+	if err != nil {
+		var protoErr *textproto.Error
+		if !errors.As(err, &protoErr) {
+			return 0, "", err
+		}
+	}
+	for _, want := range expect {
+		if code == want {
+			return code, msg, nil
+		}
+	}
+	return code, msg, &FTPError{Command: command, Code: code, Msg: msg}
+}
+
+// dialFTP connects and logs in, upgrading to TLS for ftps:// URLs
+func dialFTP(ctx context.Context, config *Config, u *url.URL) (*ftpConn, error) {
+	host := u.Hostname()
+	port := u.Port()
+	if port == "" {
+		port = "21"
+	}
+	dial := newDialContext(config)
+	conn, err := dial(ctx, "tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		return nil, err
+	}
+	c := &ftpConn{conn: conn, text: textproto.NewConn(conn), host: host, dial: dial, config: config}
+	if _, _, err := c.reply("connect", []int{220}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if u.Scheme == "ftps" {
+		// Explicit TLS (RFC 4217): upgrade the control connection, then
+		// protect the data connections too
+		if _, _, err := c.cmd([]int{234}, "AUTH TLS"); err != nil {
+			c.Close()
+			return nil, err
+		}
+		tlsConfig := &tls.Config{}
+		if config.TLS != nil {
+			tlsConfig = config.TLS.Clone()
+		}
+		tlsConfig.ServerName = host
+		// Many servers require data connections to resume the control session
+		tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(4)
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, asTLSError(err)
+		}
+		c.conn, c.text, c.tls = tlsConn, textproto.NewConn(tlsConn), tlsConfig
+		if _, _, err := c.cmd([]int{200}, "PBSZ 0"); err != nil {
+			c.Close()
+			return nil, err
+		}
+		if _, _, err := c.cmd([]int{200}, "PROT P"); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	if err := c.login(u); err != nil {
+		c.Close()
+		return nil, err
+	}
+	if _, _, err := c.cmd([]int{200}, "TYPE I"); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// login authenticates with the URL's user info, then the credential helper
+// or .netrc, and finally as anonymous
+func (c *ftpConn) login(u *url.URL) error {
+	user, pass := "anonymous", "anonymous@"
+	if u.User != nil {
+		user = u.User.Username()
+		pass, _ = u.User.Password()
+	} else {
+		creds, err := c.config.Credentials.Lookup(u)
+		if err != nil {
+			return err
+		}
+		if creds != nil && creds.Username != "" {
+			user, pass = creds.Username, creds.Password
+		}
+	}
+
+	code, _, err := c.cmd([]int{230, 331}, "USER %s", user)
+	if err != nil || code == 230 {
+		return err
+	}
+	_, _, err = c.cmd([]int{230, 202}, "PASS %s", pass)
+	return err
+}
+
+// size returns the remote file size, or -1 if the server does not support SIZE
+func (c *ftpConn) size(file string) int64 {
+	_, msg, err := c.cmd([]int{213}, "SIZE %s", file)
+	if err != nil {
+		return -1
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(msg), 10, 64)
+	if err != nil {
+		return -1
+	}
+	return size
+}
+
+// modTime returns the remote modification time, or the zero time if the
+// server does not support MDTM
+func (c *ftpConn) modTime(file string) time.Time {
+	_, msg, err := c.cmd([]int{213}, "MDTM %s", file)
+	if err != nil {
+		return time.Time{}
+	}
+	// YYYYMMDDHHMMSS with optional fractional seconds, always in UTC
+	msg = strings.TrimSpace(msg)
+	if i := strings.Index(msg, "."); i >= 0 {
+		msg = msg[:i]
+	}
+	t, err := time.Parse("20060102150405", msg)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// openData opens a passive data connection, preferring EPSV and falling back
+// to PASV. The address in a PASV reply is ignored in favor of the control
+// connection's host, which also works behind NAT. For FTPS the TLS handshake
+// is left to the caller, after the transfer command.
+func (c *ftpConn) openData(ctx context.Context) (net.Conn, error) {
+	var port string
+	if _, msg, err := c.cmd([]int{229}, "EPSV"); err == nil {
+		// "Entering Extended Passive Mode (|||port|)"
+		start, end := strings.Index(msg, "("), strings.LastIndex(msg, ")")
+		if start < 0 || end < start {
+			return nil, fmt.Errorf("malformed EPSV reply %q", msg)
+		}
+		fields := strings.Split(msg[start+1:end], string(msg[start+1]))
+		if len(fields) < 4 {
+			return nil, fmt.Errorf("malformed EPSV reply %q", msg)
+		}
+		port = fields[3]
+	} else {
+		_, msg, err := c.cmd([]int{227}, "PASV")
+		if err != nil {
+			return nil, err
+		}
+		// "Entering Passive Mode (h1,h2,h3,h4,p1,p2)"
+		start := strings.IndexAny(msg, "0123456789")
+		end := strings.LastIndexAny(msg, "0123456789")
+		if start < 0 {
+			return nil, fmt.Errorf("malformed PASV reply %q", msg)
+		}
+		fields := strings.Split(msg[start:end+1], ",")
+		if len(fields) != 6 {
+			return nil, fmt.Errorf("malformed PASV reply %q", msg)
+		}
+		p1, err1 := strconv.Atoi(fields[4])
+		p2, err2 := strconv.Atoi(fields[5])
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("malformed PASV reply %q", msg)
+		}
+		port = strconv.Itoa(p1<<8 | p2)
+	}
+
+	conn, err := c.dial(ctx, "tcp", net.JoinHostPort(c.host, port))
+	if err != nil {
+		return nil, err
+	}
+	if c.tls != nil {
+		// Servers only start the handshake once the transfer command is sent
+		return tls.Client(conn, c.tls), nil
+	}
+	return conn, nil
+}
+
+// Close logs out and closes the control connection
+func (c *ftpConn) Close() error {
+	c.text.PrintfLine("QUIT")
+	return c.conn.Close()
+}
+
+// downloadFTP retrieves an ftp:// or ftps:// URL, resuming with REST when a
+// partial file exists. The remote modification time is applied to the file.
+func downloadFTP(ctx context.Context, config *Config) error {
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return err
+	}
+	// Paths are relative to the login directory; use %2F for an absolute path
+	file := strings.TrimPrefix(u.Path, "/")
+	if file == "" || strings.HasSuffix(file, "/") {
+		return &UsageError{fmt.Errorf("FTP URL %s does not name a file", redactURL(u))}
+	}
+
+	if config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.Timeout)
+		defer cancel()
+	}
+
+	c, err := dialFTP(ctx, config, u)
+	if err != nil {
+		return timeoutError(ctx, err)
+	}
+	defer c.Close()
+	// Unblock reads and writes when interrupted or out of time
+	stop := context.AfterFunc(ctx, func() { c.conn.SetDeadline(time.Unix(1, 0)) })
+	defer stop()
+
+	filePath := config.FilePath
+	if filePath == "" {
+		filePath = path.Base(file)
+		config.FilePath = filePath
+	}
+
+	size := c.size(file)
+	mtime := c.modTime(file)
+
+	offset := int64(0)
+	if config.Resume {
+		if fi, err := os.Stat(filePath); err == nil {
+			offset = fi.Size()
+		}
+	}
+	if offset > 0 && size >= 0 && offset > size {
+		return fmt.Errorf("resume failed: local file is larger than the remote file (%d > %d bytes)", offset, size)
+	}
+	if offset > 0 {
+		if _, _, err := c.cmd([]int{350}, "REST %d", offset); err != nil {
+			var ftpErr *FTPError
+			if !errors.As(err, &ftpErr) {
+				return timeoutError(ctx, err)
+			}
+			if !config.Quiet {
+				fmt.Println("Warning: Server doesn't support resume. Starting download from beginning...")
+			}
+			offset = 0
+		} else if !config.Quiet {
+			fmt.Println("Resuming download...")
+		}
+	}
+
+	var f *os.File
+	if offset > 0 {
+		f, err = os.OpenFile(filePath, os.O_APPEND|os.O_WRONLY, 0666)
+	} else {
+		f, err = os.Create(filePath)
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	data, err := c.openData(ctx)
+	if err != nil {
+		return timeoutError(ctx, err)
+	}
+	defer data.Close()
+	stopData := context.AfterFunc(ctx, func() { data.SetDeadline(time.Unix(1, 0)) })
+	defer stopData()
+
+	code, _, err := c.cmd([]int{125, 150}, "RETR %s", file)
+	if err != nil {
+		return timeoutError(ctx, err)
+	}
+	if tlsData, ok := data.(*tls.Conn); ok {
+		if err := tlsData.HandshakeContext(ctx); err != nil {
+			return timeoutError(ctx, asTLSError(err))
+		}
+	}
+
+	if !config.Quiet {
+		fmt.Printf("Downloading to: %s\n", filePath)
+	}
+	fields := map[string]interface{}{
+		"url":    redactURL(u),
+		"path":   filePath,
+		"status": code,
+		"size":   size,
+		"offset": offset,
+	}
+	if !mtime.IsZero() {
+		fields["mtime"] = mtime.Format(time.RFC3339)
+	}
+	config.Events.Emit("start", fields)
+
+	totalSize := size
+	if totalSize < 0 {
+		totalSize = 0
+	}
+	if err := copyBody(ctx, config, f, data, offset, totalSize); err != nil {
+		return timeoutError(ctx, err)
+	}
+	data.Close()
+	if _, _, err := c.reply("RETR", []int{226, 250}); err != nil {
+		return timeoutError(ctx, err)
+	}
+
+	if size >= 0 {
+		if fi, err := f.Stat(); err == nil && fi.Size() != size {
+			return fmt.Errorf("FTP transfer incomplete: got %d of %d bytes: %w", fi.Size(), size, io.ErrUnexpectedEOF)
+		}
+	}
+	f.Close()
+	if !mtime.IsZero() {
+		os.Chtimes(filePath, mtime, mtime)
+	}
+	return nil
+}
+
+// timeoutError reports a timeout instead of the I/O error caused by
+// expiring the connection deadlines
+func timeoutError(ctx context.Context, err error) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("transfer timed out: %w", context.DeadlineExceeded)
+	}
+	return err
+}
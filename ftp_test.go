@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// ftpServer is a minimal passive-mode FTP server holding files in memory
+type ftpServer struct {
+	ln     net.Listener
+	files  map[string][]byte
+	mtime  time.Time
+	user   string // "" accepts anonymous logins without a password
+	pass   string
+	noEPSV bool
+	tls    *tls.Config // offers AUTH TLS when set
+
+	mu       sync.Mutex
+	commands []string
+}
+
+func startFTPServer(t *testing.T, s *ftpServer) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.ln = ln
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func (s *ftpServer) log() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return strings.Join(s.commands, ",")
+}
+
+func (s *ftpServer) serve(conn net.Conn) {
+	defer func() { conn.Close() }()
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 test server ready")
+	var data net.Listener
+	var rest int64
+	protected := false
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd, arg, _ := strings.Cut(line, " ")
+		cmd = strings.ToUpper(cmd)
+		s.mu.Lock()
+		s.commands = append(s.commands, cmd)
+		s.mu.Unlock()
+
+		switch cmd {
+		case "AUTH":
+			if s.tls == nil {
+				text.PrintfLine("502 not implemented")
+				continue
+			}
+			text.PrintfLine("234 proceed")
+			tlsConn := tls.Server(conn, s.tls)
+			if tlsConn.Handshake() != nil {
+				return
+			}
+			conn, text = tlsConn, textproto.NewConn(tlsConn)
+		case "PBSZ":
+			text.PrintfLine("200 ok")
+		case "PROT":
+			protected = arg == "P"
+			text.PrintfLine("200 ok")
+		case "USER":
+			if s.user == "" {
+				text.PrintfLine("230 logged in")
+			} else {
+				text.PrintfLine("331 password please")
+			}
+		case "PASS":
+			if arg == s.pass {
+				text.PrintfLine("230 logged in")
+			} else {
+				text.PrintfLine("530 login incorrect")
+			}
+		case "TYPE":
+			text.PrintfLine("200 binary")
+		case "SIZE":
+			if body, ok := s.files[arg]; ok {
+				text.PrintfLine("213 %d", len(body))
+			} else {
+				text.PrintfLine("550 no such file")
+			}
+		case "MDTM":
+			text.PrintfLine("213 %s", s.mtime.UTC().Format("20060102150405"))
+		case "EPSV", "PASV":
+			if cmd == "EPSV" && s.noEPSV {
+				text.PrintfLine("502 not implemented")
+				continue
+			}
+			if data, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+				return
+			}
+			port := data.Addr().(*net.TCPAddr).Port
+			if cmd == "EPSV" {
+				text.PrintfLine("229 Entering Extended Passive Mode (|||%d|)", port)
+			} else {
+				// The address is ignored by the client, which uses the control host
+				text.PrintfLine("227 Entering Passive Mode (10,0,0,1,%d,%d)", port>>8, port&0xff)
+			}
+		case "REST":
+			rest, _ = strconv.ParseInt(arg, 10, 64)
+			text.PrintfLine("350 restarting at %d", rest)
+		case "RETR":
+			body, ok := s.files[arg]
+			if !ok || data == nil {
+				text.PrintfLine("550 no such file")
+				continue
+			}
+			text.PrintfLine("150 opening data connection")
+			dc, err := data.Accept()
+			data.Close()
+			data = nil
+			if err != nil {
+				return
+			}
+			if protected {
+				dc = tls.Server(dc, s.tls)
+			}
+			dc.Write(body[rest:])
+			dc.Close()
+			rest = 0
+			text.PrintfLine("226 transfer complete")
+		case "QUIT":
+			text.PrintfLine("221 bye")
+			return
+		default:
+			text.PrintfLine("502 not implemented")
+		}
+	}
+}
+
+func TestDownloadFTP(t *testing.T) {
+	body := bytes.Repeat([]byte("ftp data "), 5000)
+	mtime := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+
+	// A TLS server certificate for 127.0.0.1 and a client trusting it
+	ts := httptest.NewUnstartedServer(http.NotFoundHandler())
+	ts.StartTLS()
+	defer ts.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+
+	tests := []struct {
+		name     string
+		server   *ftpServer // nil for an anonymous server with EPSV
+		scheme   string
+		userinfo string
+		file     string
+		partial  int    // bytes already on disk, resumed with -r
+		code     int    // expected FTP reply code of the failure, 0 on success
+		commands string // commands that must have been sent, in order
+	}{
+		{name: "anonymous", file: "pub/file.bin", commands: "USER,TYPE,SIZE,MDTM,EPSV,RETR"},
+		{name: "login", server: &ftpServer{user: "ci", pass: "hunter2"}, userinfo: "ci:hunter2@", file: "pub/file.bin", commands: "USER,PASS"},
+		{name: "wrong password", server: &ftpServer{user: "ci", pass: "hunter2"}, userinfo: "ci:wrong@", file: "pub/file.bin", code: 530},
+		{name: "missing file", file: "pub/missing.bin", code: 550},
+		{name: "PASV fallback", server: &ftpServer{noEPSV: true}, file: "pub/file.bin", commands: "EPSV,PASV,RETR"},
+		{name: "resume", file: "pub/file.bin", partial: 12345, commands: "REST,EPSV,RETR"},
+		{name: "explicit TLS", server: &ftpServer{tls: ts.TLS}, scheme: "ftps", file: "pub/file.bin", commands: "AUTH,PBSZ,PROT,USER"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := tt.server
+			if s == nil {
+				s = &ftpServer{}
+			}
+			s.files = map[string][]byte{"pub/file.bin": body}
+			s.mtime = mtime
+			addr := startFTPServer(t, s)
+
+			scheme := tt.scheme
+			if scheme == "" {
+				scheme = "ftp"
+			}
+			path := filepath.Join(t.TempDir(), "file.bin")
+			if tt.partial > 0 {
+				if err := ioutil.WriteFile(path, body[:tt.partial], 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			config := &Config{
+				URL:      fmt.Sprintf("%s://%s%s/%s", scheme, tt.userinfo, addr, tt.file),
+				FilePath: path,
+				Resume:   tt.partial > 0,
+				Quiet:    true,
+				TLS:      &tls.Config{RootCAs: roots},
+			}
+			err := downloadWithRetry(context.Background(), config)
+			if tt.code != 0 {
+				var ftpErr *FTPError
+				if !errors.As(err, &ftpErr) || ftpErr.Code != tt.code || exitCode(err) != ExitClientError {
+					t.Fatalf("download = %v, want FTP reply %d", err, tt.code)
+				}
+				if strings.Contains(err.Error(), "wrong") {
+					t.Errorf("error shows the password: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := ioutil.ReadFile(path); !bytes.Equal(got, body) {
+				t.Fatalf("downloaded %d bytes that differ from the file", len(got))
+			}
+			if fi, err := os.Stat(path); err != nil || !fi.ModTime().Equal(mtime) {
+				t.Errorf("modification time = %v, want %v", fi.ModTime(), mtime)
+			}
+			if log := s.log(); !containsInOrder(log, tt.commands) {
+				t.Errorf("commands %s do not include %s in order", log, tt.commands)
+			}
+		})
+	}
+}
+
+// containsInOrder reports whether the comma-separated commands in want all
+// appear in log in the same order
+func containsInOrder(log, want string) bool {
+	rest := strings.Split(log, ",")
+	for _, w := range strings.Split(want, ",") {
+		found := false
+		for len(rest) > 0 && !found {
+			found = rest[0] == w
+			rest = rest[1:]
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// maxGlobURLs bounds how many URLs one pattern may expand to
+const maxGlobURLs = 100000
+
+// globRange matches the contents of a [first-last] or [first-last:step]
+// range of numbers or of single letters
+var globRange = regexp.MustCompile(`^(?:([0-9]+)-([0-9]+)|([a-z])-([a-z])|([A-Z])-([A-Z]))(?::([0-9]+))?$`)
+
+// globURL is one URL of an expanded pattern with the value each glob took,
+// left to right, for #1-style references in -o
+type globURL struct {
+	URL    string
+	Values []string
+}
+
+// expandGlobRange returns the values of a range such as "01-31", "a-z" or
+// "0-100:10". Numbers are zero-padded when first is, as in curl.
+func expandGlobRange(m []string) ([]string, error) {
+	step := 1
+	if m[7] != "" {
+		n, err := strconv.Atoi(m[7])
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid step %q", m[7])
+		}
+		step = n
+	}
+
+	var values []string
+	if m[1] != "" {
+		first, err1 := strconv.Atoi(m[1])
+		last, err2 := strconv.Atoi(m[2])
+		if err1 != nil || err2 != nil || last < first {
+			return nil, fmt.Errorf("invalid range [%s-%s]", m[1], m[2])
+		}
+		width := 0
+		if len(m[1]) > 1 && m[1][0] == '0' {
+			width = len(m[1])
+		}
+		for n := first; n <= last; n += step {
+			values = append(values, fmt.Sprintf("%0*d", width, n))
+			if len(values) > maxGlobURLs {
+				return nil, fmt.Errorf("range [%s-%s] is too large", m[1], m[2])
+			}
+		}
+		return values, nil
+	}
+
+	first, last := m[3], m[4]
+	if first == "" {
+		first, last = m[5], m[6]
+	}
+	if last[0] < first[0] {
+		return nil, fmt.Errorf("invalid range [%s-%s]", first, last)
+	}
+	for c := int(first[0]); c <= int(last[0]); c += step {
+		values = append(values, string(rune(c)))
+	}
+	return values, nil
+}
+
+// expandGlob expands curl-style globs in raw: {a,b,c} sets and [01-31],
+// [a-z] or [1-100:10] ranges. The leftmost glob varies slowest. Brackets
+// that do not hold a range, such as an IPv6 host, and braces without a
+// comma are kept as they are; a backslash makes the next character literal.
+// A raw URL without globs expands to itself with no values.
+func expandGlob(raw string) ([]globURL, error) {
+	var literals []string // literals[i] precedes globs[i]; one more literal than globs
+	var globs [][]string
+	var lit strings.Builder
+	for i := 0; i < len(raw); i++ {
+		c := raw[i]
+		switch {
+		case c == '\\' && i+1 < len(raw):
+			i++
+			lit.WriteByte(raw[i])
+			continue
+		case c == '{':
+			end := strings.IndexByte(raw[i:], '}')
+			if end < 0 {
+				return nil, errors.New("unmatched '{' in URL")
+			}
+			body := raw[i+1 : i+end]
+			if !strings.Contains(body, ",") {
+				break
+			}
+			literals = append(literals, lit.String())
+			lit.Reset()
+			globs = append(globs, strings.Split(body, ","))
+			i += end
+			continue
+		case c == '[':
+			end := strings.IndexByte(raw[i:], ']')
+			if end < 0 {
+				break
+			}
+			m := globRange.FindStringSubmatch(raw[i+1 : i+end])
+			if m == nil {
+				break
+			}
+			values, err := expandGlobRange(m)
+			if err != nil {
+				return nil, err
+			}
+			literals = append(literals, lit.String())
+			lit.Reset()
+			globs = append(globs, values)
+			i += end
+			continue
+		}
+		lit.WriteByte(c)
+	}
+	literals = append(literals, lit.String())
+
+	total := 1
+	for _, values := range globs {
+		if total *= len(values); total > maxGlobURLs {
+			return nil, fmt.Errorf("URL expands to more than %d URLs", maxGlobURLs)
+		}
+	}
+	urls := make([]globURL, 0, total)
+	choice := make([]int, len(globs))
+	for {
+		var sb strings.Builder
+		values := make([]string, len(globs))
+		for g, values2 := range globs {
+			sb.WriteString(literals[g])
+			values[g] = values2[choice[g]]
+			sb.WriteString(values[g])
+		}
+		sb.WriteString(literals[len(globs)])
+		urls = append(urls, globURL{URL: sb.String(), Values: values})
+
+		// Advance the rightmost glob first, like an odometer
+		g := len(globs) - 1
+		for ; g >= 0; g-- {
+			if choice[g]++; choice[g] < len(globs[g]) {
+				break
+			}
+			choice[g] = 0
+		}
+		if g < 0 {
+			return urls, nil
+		}
+	}
+}
+
+// globReference matches #1, #2, ... in an output template
+var globReference = regexp.MustCompile(`#([0-9]+)`)
+
+// batchItem is one download of a batch
+type batchItem struct {
+	URL      string
+	FilePath string // "" to name the file after the URL or response
+}
+
+// batchItems pairs expanded URLs with output paths. template may be empty
+// (each file is named after its URL), a directory (ending in a separator or
+// already existing) to put them in, or a name with #1-style references to
+// the glob values.
+func batchItems(urls []globURL, template string) ([]batchItem, error) {
+	isDir := strings.HasSuffix(template, "/") || strings.HasSuffix(template, string(filepath.Separator))
+	if fi, err := os.Stat(template); err == nil && fi.IsDir() {
+		isDir = true
+	}
+	hasRefs := globReference.MatchString(template)
+	if template != "" && !isDir && !hasRefs && len(urls) > 1 {
+		return nil, fmt.Errorf("-o %q would be written by all %d URLs; use #1-style references or a directory", template, len(urls))
+	}
+
+	items := make([]batchItem, 0, len(urls))
+	seen := map[string]string{}
+	for _, u := range urls {
+		item := batchItem{URL: u.URL}
+		var name string
+		if template == "" || isDir {
+			parsed, err := url.Parse(u.URL)
+			if err != nil {
+				return nil, err
+			}
+			name = path.Base(parsed.Path)
+			if template != "" {
+				item.FilePath = filepath.Join(template, name)
+			}
+		} else {
+			var badRef error
+			item.FilePath = globReference.ReplaceAllStringFunc(template, func(ref string) string {
+				n, _ := strconv.Atoi(ref[1:])
+				if n < 1 || n > len(u.Values) {
+					badRef = fmt.Errorf("-o refers to %s but -url has no glob %s", ref, ref)
+					return ref
+				}
+				return u.Values[n-1]
+			})
+			if badRef != nil {
+				return nil, badRef
+			}
+			name = item.FilePath
+		}
+		if other, ok := seen[name]; ok && len(urls) > 1 {
+			return nil, fmt.Errorf("%s and %s would both be saved as %s; use -o with #1-style references", redactQuery(other), redactQuery(u.URL), name)
+		}
+		seen[name] = u.URL
+		items = append(items, item)
+	}
+	return items, nil
+}
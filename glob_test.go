@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExpandGlob(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want []globURL // nil when an error is expected
+	}{
+		{"no globs", "https://example.com/a.txt", []globURL{{URL: "https://example.com/a.txt", Values: []string{}}}},
+		{"set", "https://example.com/{a,b}.txt", []globURL{
+			{URL: "https://example.com/a.txt", Values: []string{"a"}},
+			{URL: "https://example.com/b.txt", Values: []string{"b"}},
+		}},
+		{"padded range", "https://example.com/day[08-10].gz", []globURL{
+			{URL: "https://example.com/day08.gz", Values: []string{"08"}},
+			{URL: "https://example.com/day09.gz", Values: []string{"09"}},
+			{URL: "https://example.com/day10.gz", Values: []string{"10"}},
+		}},
+		{"step", "https://example.com/[0-20:10]", []globURL{
+			{URL: "https://example.com/0", Values: []string{"0"}},
+			{URL: "https://example.com/10", Values: []string{"10"}},
+			{URL: "https://example.com/20", Values: []string{"20"}},
+		}},
+		{"letters, leftmost slowest", "https://example.com/{x,y}/[a-b]", []globURL{
+			{URL: "https://example.com/x/a", Values: []string{"x", "a"}},
+			{URL: "https://example.com/x/b", Values: []string{"x", "b"}},
+			{URL: "https://example.com/y/a", Values: []string{"y", "a"}},
+			{URL: "https://example.com/y/b", Values: []string{"y", "b"}},
+		}},
+		{"IPv6 host and single braces are literal", "http://[::1]:8080/{a}/[C-D]", []globURL{
+			{URL: "http://[::1]:8080/{a}/C", Values: []string{"C"}},
+			{URL: "http://[::1]:8080/{a}/D", Values: []string{"D"}},
+		}},
+		{"escapes", `https://example.com/\{a,b\}/\[1-2\]`, []globURL{{URL: "https://example.com/{a,b}/[1-2]", Values: []string{}}}},
+		{"unmatched brace", "https://example.com/{a,b", nil},
+		{"reversed range", "https://example.com/[9-1]", nil},
+		{"reversed letters", "https://example.com/[z-a]", nil},
+		{"zero step", "https://example.com/[1-9:0]", nil},
+		{"huge range", "https://example.com/[0-999999999]", nil},
+		{"huge product", "https://example.com/[1-1000]/[1-1000]", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := expandGlob(tt.raw)
+			if tt.want == nil {
+				if err == nil {
+					t.Fatalf("expandGlob(%s) = %d URLs, want an error", tt.raw, len(got))
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expandGlob(%s) = %+v, %v; want %+v", tt.raw, got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestBatchItems(t *testing.T) {
+	dir := t.TempDir()
+	urls := []globURL{
+		{URL: "https://example.com/x/a.gz?sig=secret", Values: []string{"x", "a"}},
+		{URL: "https://example.com/y/b.gz", Values: []string{"y", "b"}},
+	}
+	tests := []struct {
+		name     string
+		urls     []globURL
+		template string
+		want     []string // the items' FilePath; nil when an error is expected
+	}{
+		{"named after URLs", urls, "", []string{"", ""}},
+		{"directory with separator", urls, "out/", []string{filepath.Join("out", "a.gz"), filepath.Join("out", "b.gz")}},
+		{"existing directory", urls, dir, []string{filepath.Join(dir, "a.gz"), filepath.Join(dir, "b.gz")}},
+		{"references", urls, "logs/#1-#2.gz", []string{"logs/x-a.gz", "logs/y-b.gz"}},
+		{"single URL to a file", urls[:1], "one.gz", []string{"one.gz"}},
+		{"one file for many URLs", urls, "all.gz", nil},
+		{"reference beyond the globs", urls, "#3.gz", nil},
+		{"reference #0", urls, "#0.gz", nil},
+		{"references that collide", []globURL{
+			{URL: "https://example.com/x/a.gz", Values: []string{"x", "a"}},
+			{URL: "https://example.com/x/b.gz", Values: []string{"x", "b"}},
+		}, "#1.gz", nil},
+		{"URL names that collide", []globURL{
+			{URL: "https://example.com/x/a.gz", Values: []string{"x"}},
+			{URL: "https://example.com/y/a.gz", Values: []string{"y"}},
+		}, "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			items, err := batchItems(tt.urls, tt.template)
+			if tt.want == nil {
+				if err == nil {
+					t.Fatalf("batchItems(%q) = %+v, want an error", tt.template, items)
+				}
+				if strings.Contains(err.Error(), "secret") {
+					t.Errorf("error shows the query: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for i, item := range items {
+				if item.URL != tt.urls[i].URL {
+					t.Errorf("item %d URL = %s, want %s", i, item.URL, tt.urls[i].URL)
+				}
+				got = append(got, item.FilePath)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("paths = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// captureStdout returns what f prints to standard output
+func captureStdout(t *testing.T, f func()) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	out := make(chan string)
+	go func() {
+		data, _ := ioutil.ReadAll(r)
+		out <- string(data)
+	}()
+	defer func() {
+		os.Stdout = stdout
+	}()
+	f()
+	w.Close()
+	return <-out
+}
+
+func TestDownloadBatchQuietRedirects(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/old/") {
+			http.Redirect(w, r, "/new/"+filepath.Base(r.URL.Path), http.StatusFound)
+			return
+		}
+		fmt.Fprint(w, r.URL.Path)
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		parallel  int
+		redirects bool // whether -v prints the redirects
+	}{
+		{1, true},
+		{2, false},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint("parallel ", tt.parallel), func(t *testing.T) {
+			dir := t.TempDir()
+			config := &Config{
+				Parallel:     tt.parallel,
+				Verbose:      true,
+				MaxRedirects: 10,
+				FilePath:     dir + "/",
+				// Events leave out the progress bars, not the redirect lines
+				Events: NewEventLog(ioutil.Discard),
+			}
+			urls, err := expandGlob(srv.URL + "/old/{a,b}")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.Batch, err = batchItems(urls, config.FilePath); err != nil {
+				t.Fatal(err)
+			}
+			var downloadErr error
+			out := captureStdout(t, func() {
+				downloadErr = downloadBatch(context.Background(), config)
+			})
+			if downloadErr != nil {
+				t.Fatal(downloadErr)
+			}
+			if got := strings.Contains(out, "Redirect 302"); got != tt.redirects {
+				t.Errorf("redirects printed = %v, want %v; output:\n%s", got, tt.redirects, out)
+			}
+			for _, name := range []string{"a", "b"} {
+				data, err := ioutil.ReadFile(filepath.Join(dir, name))
+				if err != nil || string(data) != "/new/"+name {
+					t.Errorf("%s = %q, %v", name, data, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,748 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cheggaaa/pb"
+)
+
+// maxPlaylistSize bounds how much of an m3u8 playlist is read
+const maxPlaylistSize = 16 << 20
+
+// isHLSURL reports whether config.URL is, unless -follow-hls=false, an
+// http(s) or file URL of an .m3u8 playlist
+func isHLSURL(config *Config) bool {
+	u, err := url.Parse(config.URL)
+	if err != nil || !config.HLS.Follow {
+		return false
+	}
+	switch u.Scheme {
+	case "http", "https", "file":
+		return strings.HasSuffix(strings.ToLower(u.Path), ".m3u8")
+	}
+	return false
+}
+
+// HLSOptions configures HLS downloads
+type HLSOptions struct {
+	Follow  bool   // download the stream an .m3u8 URL describes
+	Variant string // "best", "worst", "<height>p" or a bandwidth cap in bits/s
+}
+
+// hlsVariant is one #EXT-X-STREAM-INF entry of a master playlist
+type hlsVariant struct {
+	URL       string
+	Bandwidth int64
+	Width     int
+	Height    int
+	Audio     string // GROUP-ID of audio renditions in separate playlists, which are not downloaded
+}
+
+func (v hlsVariant) String() string {
+	s := fmt.Sprintf("%.2f Mbit/s", float64(v.Bandwidth)/1e6)
+	if v.Height > 0 {
+		s = fmt.Sprintf("%dx%d, %s", v.Width, v.Height, s)
+	}
+	return s
+}
+
+// hlsKey is the #EXT-X-KEY in effect for a segment
+type hlsKey struct {
+	URL string
+	IV  []byte // nil: derived from the media sequence number
+}
+
+// hlsSegment is one piece of the stream in playback order. Initialization
+// sections (#EXT-X-MAP) are listed as segments before those that use them.
+type hlsSegment struct {
+	URL    string
+	Start  int64 // #EXT-X-BYTERANGE offset
+	Length int64 // -1 for the whole resource
+	Key    *hlsKey
+	Seq    int64 // media sequence number, the default IV
+}
+
+// hlsPlaylist is a parsed master or media playlist (RFC 8216)
+type hlsPlaylist struct {
+	Variants []hlsVariant // master playlists only
+	Segments []hlsSegment // media playlists only
+	Live     bool         // no #EXT-X-ENDLIST: more segments are still to come
+	InitExt  string       // extension of the #EXT-X-MAP section, if any
+}
+
+// parseHLSAttributes parses an attribute list such as
+// BANDWIDTH=1280000,RESOLUTION=640x360,CODECS="avc1.4d401e,mp4a.40.2"
+func parseHLSAttributes(s string) map[string]string {
+	attrs := map[string]string{}
+	for s != "" {
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 {
+			break
+		}
+		name := strings.TrimSpace(s[:eq])
+		s = s[eq+1:]
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			end := strings.IndexByte(s[1:], '"')
+			if end < 0 {
+				end = len(s) - 1
+			}
+			value, s = s[1:end+1], s[end+1:]
+			if i := strings.IndexByte(s, ','); i >= 0 {
+				s = s[i+1:]
+			} else {
+				s = ""
+			}
+		} else if i := strings.IndexByte(s, ','); i >= 0 {
+			value, s = s[:i], s[i+1:]
+		} else {
+			value, s = s, ""
+		}
+		attrs[strings.ToUpper(name)] = strings.TrimSpace(value)
+	}
+	return attrs
+}
+
+// parseHLSPlaylist parses data fetched from base
+func parseHLSPlaylist(data []byte, base *url.URL) (*hlsPlaylist, error) {
+	resolve := func(ref string) (string, error) {
+		u, err := base.Parse(strings.TrimSpace(ref))
+		if err != nil {
+			return "", fmt.Errorf("invalid URI %q: %w", ref, err)
+		}
+		// Only a local playlist may name local files
+		if u.Scheme != "http" && u.Scheme != "https" && (u.Scheme != "file" || base.Scheme != "file") {
+			return "", fmt.Errorf("URI %s is not allowed in a playlist from %s", redactQuery(u.String()), redactQuery(base.String()))
+		}
+		return u.String(), nil
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 1<<20)
+	if !scanner.Scan() || strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "\ufeff")) != "#EXTM3U" {
+		return nil, errors.New("missing #EXTM3U header")
+	}
+
+	pl := &hlsPlaylist{Live: true}
+	var (
+		seq         int64
+		key         *hlsKey
+		streamInf   map[string]string
+		audioGroups       = map[string]bool{} // GROUP-IDs with a rendition in its own playlist
+		rangeLength int64 = -1
+		rangeStart  int64
+		lastRange   = map[string]int64{} // end of the previous byte range per URI
+		initURL     string
+	)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		tag, value, _ := strings.Cut(line, ":")
+		switch {
+		case line == "":
+		case tag == "#EXT-X-STREAM-INF":
+			streamInf = parseHLSAttributes(value)
+		case tag == "#EXT-X-MEDIA":
+			// Renditions without a URI are muxed into the variant streams
+			if attrs := parseHLSAttributes(value); attrs["TYPE"] == "AUDIO" && attrs["URI"] != "" {
+				audioGroups[attrs["GROUP-ID"]] = true
+			}
+		case tag == "#EXT-X-MEDIA-SEQUENCE":
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s", line)
+			}
+			seq = n
+		case tag == "#EXT-X-ENDLIST":
+			pl.Live = false
+		case tag == "#EXT-X-PLAYLIST-TYPE":
+			if value == "VOD" {
+				pl.Live = false
+			}
+		case tag == "#EXT-X-KEY":
+			attrs := parseHLSAttributes(value)
+			switch attrs["METHOD"] {
+			case "NONE":
+				key = nil
+			case "AES-128":
+				keyURL, err := resolve(attrs["URI"])
+				if err != nil {
+					return nil, err
+				}
+				key = &hlsKey{URL: keyURL}
+				if iv := attrs["IV"]; iv != "" {
+					b, err := hex.DecodeString(strings.TrimPrefix(strings.TrimPrefix(iv, "0x"), "0X"))
+					if err != nil || len(b) != aes.BlockSize {
+						return nil, fmt.Errorf("invalid IV %q", iv)
+					}
+					key.IV = b
+				}
+			default:
+				return nil, fmt.Errorf("unsupported encryption METHOD=%s", attrs["METHOD"])
+			}
+		case tag == "#EXT-X-BYTERANGE":
+			n, o, hasOffset := strings.Cut(value, "@")
+			length, err := strconv.ParseInt(n, 10, 64)
+			if err != nil || length <= 0 {
+				return nil, fmt.Errorf("invalid %s", line)
+			}
+			rangeLength, rangeStart = length, -1
+			if hasOffset {
+				if rangeStart, err = strconv.ParseInt(o, 10, 64); err != nil || rangeStart < 0 {
+					return nil, fmt.Errorf("invalid %s", line)
+				}
+			}
+		case tag == "#EXT-X-MAP":
+			attrs := parseHLSAttributes(value)
+			mapURL, err := resolve(attrs["URI"])
+			if err != nil {
+				return nil, err
+			}
+			seg := hlsSegment{URL: mapURL, Length: -1, Key: key, Seq: seq}
+			if br := attrs["BYTERANGE"]; br != "" {
+				n, o, _ := strings.Cut(br, "@")
+				length, err := strconv.ParseInt(n, 10, 64)
+				if err != nil || length <= 0 {
+					return nil, fmt.Errorf("invalid %s", line)
+				}
+				seg.Length = length
+				seg.Start, _ = strconv.ParseInt(o, 10, 64)
+			}
+			// A section repeated for every segment is only needed once
+			if id := fmt.Sprintf("%s@%d", mapURL, seg.Start); id != initURL {
+				initURL = id
+				pl.Segments = append(pl.Segments, seg)
+			}
+			pl.InitExt = path.Ext(strings.ToLower(strings.SplitN(attrs["URI"], "?", 2)[0]))
+		case strings.HasPrefix(line, "#"):
+			// #EXTINF, #EXT-X-DISCONTINUITY and other tags need no action
+		default:
+			ref, err := resolve(line)
+			if err != nil {
+				return nil, err
+			}
+			if streamInf != nil {
+				v := hlsVariant{URL: ref, Audio: streamInf["AUDIO"]}
+				v.Bandwidth, _ = strconv.ParseInt(streamInf["BANDWIDTH"], 10, 64)
+				if w, h, ok := strings.Cut(streamInf["RESOLUTION"], "x"); ok {
+					v.Width, _ = strconv.Atoi(w)
+					v.Height, _ = strconv.Atoi(h)
+				}
+				pl.Variants = append(pl.Variants, v)
+				streamInf = nil
+				continue
+			}
+			seg := hlsSegment{URL: ref, Length: rangeLength, Key: key, Seq: seq}
+			if rangeLength > 0 {
+				seg.Start = rangeStart
+				if rangeStart < 0 {
+					seg.Start = lastRange[ref]
+				}
+				lastRange[ref] = seg.Start + rangeLength
+			}
+			pl.Segments = append(pl.Segments, seg)
+			seq++
+			rangeLength = -1
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(pl.Variants) == 0 && len(pl.Segments) == 0 {
+		return nil, errors.New("no variants or segments listed")
+	}
+	// #EXT-X-MEDIA may follow the variants that refer to it
+	for i := range pl.Variants {
+		if !audioGroups[pl.Variants[i].Audio] {
+			pl.Variants[i].Audio = ""
+		}
+	}
+	return pl, nil
+}
+
+// selectHLSVariant picks the variant -hls-variant asks for: the highest
+// bandwidth ("best"), the lowest ("worst"), the best one no taller than
+// "<height>p", or the best one within a bandwidth cap such as "3000000" or
+// "3M". If none fits, the smallest is used.
+func selectHLSVariant(variants []hlsVariant, choice string) (hlsVariant, error) {
+	sorted := append([]hlsVariant(nil), variants...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Bandwidth != sorted[j].Bandwidth {
+			return sorted[i].Bandwidth < sorted[j].Bandwidth
+		}
+		return sorted[i].Height < sorted[j].Height
+	})
+
+	choice = strings.ToLower(strings.TrimSpace(choice))
+	var fits func(hlsVariant) bool
+	switch {
+	case choice == "" || choice == "best":
+		return sorted[len(sorted)-1], nil
+	case choice == "worst":
+		return sorted[0], nil
+	case strings.HasSuffix(choice, "p"):
+		height, err := strconv.Atoi(strings.TrimSuffix(choice, "p"))
+		if err != nil {
+			return hlsVariant{}, fmt.Errorf("invalid -hls-variant %q", choice)
+		}
+		fits = func(v hlsVariant) bool { return v.Height > 0 && v.Height <= height }
+	default:
+		limit, err := parseBitRate(choice)
+		if err != nil {
+			return hlsVariant{}, fmt.Errorf("invalid -hls-variant %q", choice)
+		}
+		fits = func(v hlsVariant) bool { return v.Bandwidth <= limit }
+	}
+	for i := len(sorted) - 1; i >= 0; i-- {
+		if fits(sorted[i]) {
+			return sorted[i], nil
+		}
+	}
+	return sorted[0], nil
+}
+
+// parseBitRate parses bits per second with an optional decimal k, M or G
+// suffix
+func parseBitRate(s string) (int64, error) {
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(s, "k"):
+		mult, s = 1e3, strings.TrimSuffix(s, "k")
+	case strings.HasSuffix(s, "m"):
+		mult, s = 1e6, strings.TrimSuffix(s, "m")
+	case strings.HasSuffix(s, "g"):
+		mult, s = 1e9, strings.TrimSuffix(s, "g")
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f <= 0 {
+		return 0, fmt.Errorf("invalid bit rate %q", s)
+	}
+	return int64(f * float64(mult)), nil
+}
+
+// openHLSResource opens a segment, key or playlist, or the byte range
+// [start, start+length) of it when length is not -1
+func openHLSResource(ctx context.Context, config *Config, rawURL string, start, length int64) (io.ReadCloser, error) {
+	if isFileURL(rawURL) {
+		p, err := fileURLPath(rawURL)
+		if err != nil {
+			return nil, err
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return nil, err
+		}
+		if length < 0 {
+			return f, nil
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{io.NewSectionReader(f, start, length), f}, nil
+	}
+	if length >= 0 {
+		return openRange(ctx, config, rawURL, start, start+length-1)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	applyHeaders(config, req)
+	resp, err := doRequest(config, httpClient(config), req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, &HTTPError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	return resp.Body, nil
+}
+
+// loadHLSPlaylist fetches and parses the playlist at rawURL
+func loadHLSPlaylist(ctx context.Context, config *Config, rawURL string) (*hlsPlaylist, error) {
+	base, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, &UsageError{err}
+	}
+	list := *config
+	list.URL = rawURL
+	list.Method = ""
+	list.Body = nil
+	data, err := fetchDocument(ctx, &list, maxPlaylistSize)
+	if err != nil {
+		return nil, err
+	}
+	pl, err := parseHLSPlaylist(data, base)
+	if err != nil {
+		return nil, &UsageError{fmt.Errorf("invalid playlist %s: %w", redactQuery(rawURL), err)}
+	}
+	return pl, nil
+}
+
+// hlsState is saved in the work directory so an interrupted download only
+// reuses segments of the same stream
+type hlsState struct {
+	Playlist string `json:"playlist"`
+	Segments int    `json:"segments"`
+	Digest   string `json:"digest"` // SHA-256 over the segment URIs, sequence numbers and ranges
+}
+
+// hlsWorkDir returns the directory holding the finished segments of output
+func hlsWorkDir(output string) string {
+	return output + ".dlhls"
+}
+
+// hlsDownload fetches the segments of one media playlist
+type hlsDownload struct {
+	config   *Config
+	dir      string
+	segments []hlsSegment
+
+	keysMu sync.Mutex
+	keys   map[string][]byte
+
+	read int64 // bytes received, updated atomically
+}
+
+// segmentPath returns where segment i is kept once complete
+func (d *hlsDownload) segmentPath(i int) string {
+	return filepath.Join(d.dir, fmt.Sprintf("%06d.seg", i))
+}
+
+// prepare creates the work directory, keeping segments from an earlier
+// attempt at the same stream, and returns how many are already there
+func (d *hlsDownload) prepare(playlist string) (int, error) {
+	// Query strings are left out: CDNs sign every playlist fetch with new
+	// tokens, which must not make a retry discard the finished segments
+	h := sha256.New()
+	for _, seg := range d.segments {
+		fmt.Fprintf(h, "%s %d %d %d\n", redactQuery(seg.URL), seg.Seq, seg.Start, seg.Length)
+	}
+	state := hlsState{Playlist: redactQuery(playlist), Segments: len(d.segments), Digest: hex.EncodeToString(h.Sum(nil))}
+	statePath := filepath.Join(d.dir, "state.json")
+
+	var saved hlsState
+	if data, err := ioutil.ReadFile(statePath); err != nil || json.Unmarshal(data, &saved) != nil || saved != state {
+		if err := os.RemoveAll(d.dir); err != nil {
+			return 0, err
+		}
+	}
+	if err := os.MkdirAll(d.dir, 0777); err != nil {
+		return 0, err
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return 0, err
+	}
+	if err := ioutil.WriteFile(statePath, data, 0666); err != nil {
+		return 0, err
+	}
+
+	done := 0
+	for i := range d.segments {
+		if _, err := os.Stat(d.segmentPath(i)); err == nil {
+			done++
+		}
+	}
+	return done, nil
+}
+
+// key returns the AES-128 key at keyURL, fetching it once
+func (d *hlsDownload) key(ctx context.Context, keyURL string) ([]byte, error) {
+	d.keysMu.Lock()
+	defer d.keysMu.Unlock()
+	if k, ok := d.keys[keyURL]; ok {
+		return k, nil
+	}
+	body, err := openHLSResource(ctx, d.config, keyURL, 0, -1)
+	if err != nil {
+		return nil, fmt.Errorf("cannot fetch key %s: %w", redactQuery(keyURL), err)
+	}
+	defer body.Close()
+	k, err := ioutil.ReadAll(io.LimitReader(body, aes.BlockSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(k) != aes.BlockSize {
+		return nil, fmt.Errorf("key %s is %d bytes, expected %d", redactQuery(keyURL), len(k), aes.BlockSize)
+	}
+	d.keys[keyURL] = k
+	return k, nil
+}
+
+// decrypt removes AES-128-CBC encryption and PKCS#7 padding from data
+func (d *hlsDownload) decrypt(ctx context.Context, seg hlsSegment, data []byte) ([]byte, error) {
+	k, err := d.key(ctx, seg.Key.URL)
+	if err != nil {
+		return nil, err
+	}
+	iv := seg.Key.IV
+	if iv == nil {
+		iv = make([]byte, aes.BlockSize)
+		binary.BigEndian.PutUint64(iv[8:], uint64(seg.Seq))
+	}
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("encrypted segment %s is %d bytes, not a multiple of the block size", redactQuery(seg.URL), len(data))
+	}
+	block, _ := aes.NewCipher(k)
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(data, data)
+	pad := int(data[len(data)-1])
+	if pad == 0 || pad > aes.BlockSize || !bytes.Equal(data[len(data)-pad:], bytes.Repeat([]byte{byte(pad)}, pad)) {
+		return nil, fmt.Errorf("segment %s does not decrypt with its key", redactQuery(seg.URL))
+	}
+	return data[:len(data)-pad], nil
+}
+
+// fetchSegment downloads, decrypts and stores segment i
+func (d *hlsDownload) fetchSegment(ctx context.Context, i int) error {
+	seg := d.segments[i]
+	body, err := openHLSResource(ctx, d.config, seg.URL, seg.Start, seg.Length)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	counter := &countingReader{r: limitReader(ctx, d.config, body)}
+	data, err := ioutil.ReadAll(counter)
+	atomic.AddInt64(&d.read, counter.Count())
+	if err != nil {
+		return timeoutError(ctx, err)
+	}
+	if seg.Length >= 0 && int64(len(data)) != seg.Length {
+		return fmt.Errorf("segment %s ended after %d of %d bytes: %w", redactQuery(seg.URL), len(data), seg.Length, io.ErrUnexpectedEOF)
+	}
+	if seg.Key != nil {
+		if data, err = d.decrypt(ctx, seg, data); err != nil {
+			return err
+		}
+	}
+
+	// Segments only appear under their final name once complete
+	part := d.segmentPath(i) + ".part"
+	if err := ioutil.WriteFile(part, data, 0666); err != nil {
+		return err
+	}
+	return os.Rename(part, d.segmentPath(i))
+}
+
+// fetchWithRetry retries one segment with the same backoff as whole
+// downloads, so a single bad response does not restart the stream
+func (d *hlsDownload) fetchWithRetry(ctx context.Context, i int) error {
+	var err error
+	for attempt := 0; attempt <= d.config.MaxRetries; attempt++ {
+		if attempt > 0 {
+			backoff := time.Duration(1<<uint(attempt-1)) * time.Second
+			if d.config.Verbose && !d.config.Quiet {
+				fmt.Printf("Segment %d: %v; retrying after %v\n", i, err, backoff)
+			}
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if err = d.fetchSegment(ctx, i); err == nil || ctx.Err() != nil || isNonRetryableError(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// run downloads the missing segments over config.Parallel workers
+func (d *hlsDownload) run(ctx context.Context, bar *pb.ProgressBar) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Build the shared client before the workers would race to
+	httpClient(d.config)
+
+	todo := make(chan int)
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	for w := 0; w < d.config.Parallel; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range todo {
+				if err := d.fetchWithRetry(ctx, i); err != nil {
+					once.Do(func() {
+						firstErr = fmt.Errorf("segment %d: %w", i, err)
+						cancel()
+					})
+					continue
+				}
+				if bar != nil {
+					bar.Increment()
+				}
+			}
+		}()
+	}
+	for i := range d.segments {
+		if _, err := os.Stat(d.segmentPath(i)); err == nil {
+			continue
+		}
+		select {
+		case todo <- i:
+		case <-ctx.Done():
+		}
+	}
+	close(todo)
+	wg.Wait()
+	if firstErr == nil && ctx.Err() != nil {
+		firstErr = ctx.Err()
+	}
+	return firstErr
+}
+
+// assemble concatenates the segments into output
+func (d *hlsDownload) assemble(output string) error {
+	out, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	for i := range d.segments {
+		f, err := os.Open(d.segmentPath(i))
+		if err != nil {
+			out.Close()
+			return err
+		}
+		_, err = io.Copy(out, f)
+		f.Close()
+		if err != nil {
+			out.Close()
+			return err
+		}
+	}
+	return out.Close()
+}
+
+// downloadHLS downloads an HLS stream (RFC 8216). For a master playlist the
+// variant chosen by -hls-variant is used. Segments are fetched in parallel
+// into <output>.dlhls, decrypting AES-128, and concatenated into the output
+// once all are there; an interrupted download keeps the finished segments.
+func downloadHLS(ctx context.Context, config *Config) error {
+	playlistURL := config.URL
+	pl, err := loadHLSPlaylist(ctx, config, playlistURL)
+	if err != nil {
+		return err
+	}
+	var variant *hlsVariant
+	if len(pl.Variants) > 0 {
+		v, err := selectHLSVariant(pl.Variants, config.HLS.Variant)
+		if err != nil {
+			return &UsageError{err}
+		}
+		variant = &v
+		if !config.Quiet {
+			fmt.Printf("Selected variant: %s\n", v)
+			if v.Audio != "" {
+				fmt.Printf("Warning: the audio of this variant is in a separate rendition (group %q), which is not downloaded\n", v.Audio)
+			}
+		}
+		playlistURL = v.URL
+		if pl, err = loadHLSPlaylist(ctx, config, playlistURL); err != nil {
+			return err
+		}
+		if len(pl.Segments) == 0 {
+			return &UsageError{fmt.Errorf("variant playlist %s lists no segments", redactQuery(playlistURL))}
+		}
+	}
+	if pl.Live {
+		return &UsageError{fmt.Errorf("%s is a live playlist; only complete (VOD) streams can be downloaded", redactQuery(playlistURL))}
+	}
+
+	if config.FilePath == "" {
+		u, _ := url.Parse(config.URL)
+		name := strings.TrimSuffix(path.Base(u.Path), path.Ext(u.Path))
+		if name == "" || name == "." || name == "/" {
+			name = "stream"
+		}
+		ext := ".ts"
+		if pl.InitExt != "" {
+			ext = pl.InitExt
+		}
+		config.FilePath = name + ext
+	}
+
+	d := &hlsDownload{
+		config:   config,
+		dir:      hlsWorkDir(config.FilePath),
+		segments: pl.Segments,
+		keys:     map[string][]byte{},
+	}
+	done, err := d.prepare(playlistURL)
+	if err != nil {
+		return err
+	}
+	if !config.Quiet {
+		if done > 0 {
+			fmt.Println("Resuming download...")
+		}
+		fmt.Printf("Downloading %d segments to: %s\n", len(pl.Segments), config.FilePath)
+	}
+	fields := map[string]interface{}{
+		"url":      redactQuery(config.URL),
+		"path":     config.FilePath,
+		"segments": len(pl.Segments),
+		"offset":   done,
+	}
+	if variant != nil {
+		v := map[string]interface{}{
+			"url":       redactQuery(variant.URL),
+			"bandwidth": variant.Bandwidth,
+			"width":     variant.Width,
+			"height":    variant.Height,
+		}
+		if variant.Audio != "" {
+			v["audio_group"] = variant.Audio
+		}
+		fields["variant"] = v
+	}
+	config.Events.Emit("start", fields)
+
+	var bar *pb.ProgressBar
+	if !config.Quiet && config.Events == nil {
+		bar = pb.New(len(pl.Segments))
+		bar.ShowTimeLeft = true
+		bar.Start()
+		bar.Set(done)
+	}
+	stopEvents := startProgressEvents(config, func() int64 { return atomic.LoadInt64(&d.read) }, 0, 0)
+	err = d.run(ctx, bar)
+	stopEvents()
+	if bar != nil {
+		bar.Finish()
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := d.assemble(config.FilePath); err != nil {
+		return err
+	}
+	return os.RemoveAll(d.dir)
+}
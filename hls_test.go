@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParseHLSAttributes(t *testing.T) {
+	tests := []struct {
+		in   string
+		want map[string]string
+	}{
+		{
+			in:   `BANDWIDTH=1280000,RESOLUTION=640x360,CODECS="avc1.4d401e,mp4a.40.2"`,
+			want: map[string]string{"BANDWIDTH": "1280000", "RESOLUTION": "640x360", "CODECS": "avc1.4d401e,mp4a.40.2"},
+		},
+		{
+			in:   `METHOD=AES-128,URI="https://keys.example.com/k?id=1,2",IV=0x0123456789abcdef0123456789ABCDEF`,
+			want: map[string]string{"METHOD": "AES-128", "URI": "https://keys.example.com/k?id=1,2", "IV": "0x0123456789abcdef0123456789ABCDEF"},
+		},
+		{
+			in:   ` type=AUDIO , GROUP-ID="aud",NAME="English" ,DEFAULT=YES`,
+			want: map[string]string{"TYPE": "AUDIO", "GROUP-ID": "aud", "NAME": "English", "DEFAULT": "YES"},
+		},
+		{in: `URI="unterminated`, want: map[string]string{"URI": "unterminated"}},
+		{in: `NOVALUE`, want: map[string]string{}},
+		{in: ``, want: map[string]string{}},
+	}
+	for _, tt := range tests {
+		if got := parseHLSAttributes(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseHLSAttributes(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseHLSPlaylist(t *testing.T) {
+	base, _ := url.Parse("https://cdn.example.com/show/ep1/index.m3u8?token=abc")
+	key := &hlsKey{URL: "https://cdn.example.com/show/ep1/key.bin"}
+	ivKey := &hlsKey{URL: "https://keys.example.com/k2", IV: []byte{0: 0, 15: 1}}
+	tests := []struct {
+		name string
+		data string
+		want *hlsPlaylist // nil when an error is expected
+	}{
+		{
+			name: "master with separate and muxed audio",
+			data: "#EXTM3U\n" +
+				"#EXT-X-STREAM-INF:BANDWIDTH=800000,RESOLUTION=640x360,AUDIO=\"aac\"\n360p.m3u8\n" +
+				"#EXT-X-STREAM-INF:BANDWIDTH=5000000,RESOLUTION=1920x1080,AUDIO=\"muxed\"\nhttps://hd.example.com/1080p.m3u8\n" +
+				"#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"aac\",NAME=\"English\",URI=\"audio/en.m3u8\"\n" +
+				"#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"muxed\",NAME=\"Main\"\n" +
+				"#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID=\"subs\",NAME=\"English\",URI=\"subs/en.m3u8\"\n",
+			want: &hlsPlaylist{
+				Live: true,
+				Variants: []hlsVariant{
+					{URL: "https://cdn.example.com/show/ep1/360p.m3u8", Bandwidth: 800000, Width: 640, Height: 360, Audio: "aac"},
+					{URL: "https://hd.example.com/1080p.m3u8", Bandwidth: 5000000, Width: 1920, Height: 1080},
+				},
+			},
+		},
+		{
+			name: "media with keys and sequence numbers",
+			data: "\ufeff#EXTM3U\n#EXT-X-TARGETDURATION:6\n#EXT-X-MEDIA-SEQUENCE:7\n" +
+				"#EXTINF:6,\nseg7.ts\n" +
+				"#EXT-X-KEY:METHOD=AES-128,URI=\"key.bin\"\n#EXTINF:6,\nseg8.ts\n" +
+				"#EXT-X-KEY:METHOD=AES-128,URI=\"https://keys.example.com/k2\",IV=0x00000000000000000000000000000001\n#EXTINF:6,\nseg9.ts\n" +
+				"#EXT-X-KEY:METHOD=NONE\n#EXTINF:6,\nseg10.ts\n#EXT-X-ENDLIST\n",
+			want: &hlsPlaylist{Segments: []hlsSegment{
+				{URL: "https://cdn.example.com/show/ep1/seg7.ts", Length: -1, Seq: 7},
+				{URL: "https://cdn.example.com/show/ep1/seg8.ts", Length: -1, Key: key, Seq: 8},
+				{URL: "https://cdn.example.com/show/ep1/seg9.ts", Length: -1, Key: ivKey, Seq: 9},
+				{URL: "https://cdn.example.com/show/ep1/seg10.ts", Length: -1, Seq: 10},
+			}},
+		},
+		{
+			name: "byte ranges and an init section",
+			data: "#EXTM3U\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXT-X-MAP:URI=\"main.mp4\",BYTERANGE=\"720@0\"\n" +
+				"#EXT-X-BYTERANGE:1000@720\n#EXTINF:4,\nmain.mp4\n" +
+				"#EXT-X-BYTERANGE:2000\n#EXTINF:4,\nmain.mp4\n" +
+				"#EXT-X-MAP:URI=\"main.mp4\",BYTERANGE=\"720@0\"\n#EXTINF:4,\nother.mp4\n",
+			want: &hlsPlaylist{
+				InitExt: ".mp4",
+				Segments: []hlsSegment{
+					{URL: "https://cdn.example.com/show/ep1/main.mp4", Start: 0, Length: 720},
+					{URL: "https://cdn.example.com/show/ep1/main.mp4", Start: 720, Length: 1000},
+					{URL: "https://cdn.example.com/show/ep1/main.mp4", Start: 1720, Length: 2000, Seq: 1},
+					{URL: "https://cdn.example.com/show/ep1/other.mp4", Length: -1, Seq: 2},
+				},
+			},
+		},
+		{name: "no header", data: "#EXTINF:4,\nseg.ts\n"},
+		{name: "empty", data: "#EXTM3U\n#EXT-X-ENDLIST\n"},
+		{name: "SAMPLE-AES", data: "#EXTM3U\n#EXT-X-KEY:METHOD=SAMPLE-AES,URI=\"k\"\n#EXTINF:4,\nseg.ts\n"},
+		{name: "bad IV", data: "#EXTM3U\n#EXT-X-KEY:METHOD=AES-128,URI=\"k\",IV=0x1234\n#EXTINF:4,\nseg.ts\n"},
+		{name: "bad byte range", data: "#EXTM3U\n#EXT-X-BYTERANGE:0@10\n#EXTINF:4,\nseg.ts\n"},
+		{name: "bad sequence", data: "#EXTM3U\n#EXT-X-MEDIA-SEQUENCE:x\n#EXTINF:4,\nseg.ts\n"},
+		{name: "local segment", data: "#EXTM3U\n#EXTINF:4,\nfile:///etc/passwd\n"},
+		{name: "local key", data: "#EXTM3U\n#EXT-X-KEY:METHOD=AES-128,URI=\"file:///etc/passwd\"\n#EXTINF:4,\nseg.ts\n"},
+		{name: "local init section", data: "#EXTM3U\n#EXT-X-MAP:URI=\"file:///etc/passwd\"\n#EXTINF:4,\nseg.ts\n"},
+		{name: "local variant", data: "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1\nfile:///etc/passwd\n"},
+		{name: "FTP segment", data: "#EXTM3U\n#EXTINF:4,\nftp://ftp.example.com/seg.ts\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseHLSPlaylist([]byte(tt.data), base)
+			if tt.want == nil {
+				if err == nil {
+					t.Fatalf("parseHLSPlaylist = %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseHLSPlaylist =\n%+v\nwant\n%+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectHLSVariant(t *testing.T) {
+	variants := []hlsVariant{
+		{URL: "720", Bandwidth: 3000000, Height: 720},
+		{URL: "360", Bandwidth: 800000, Height: 360},
+		{URL: "1080", Bandwidth: 6000000, Height: 1080},
+		{URL: "audio", Bandwidth: 64000},
+	}
+	tests := []struct {
+		choice, want string
+	}{
+		{"", "1080"},
+		{"best", "1080"},
+		{" BEST ", "1080"},
+		{"worst", "audio"},
+		{"720p", "720"},
+		{"800p", "720"},
+		{"100p", "audio"},
+		{"3M", "720"},
+		{"2999999", "360"},
+		{"1.5m", "360"},
+		{"6g", "1080"},
+		{"10k", "audio"},
+		{"p", ""},
+		{"fast", ""},
+		{"-3M", ""},
+	}
+	for _, tt := range tests {
+		got, err := selectHLSVariant(variants, tt.choice)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("selectHLSVariant(%q) = %s, want an error", tt.choice, got.URL)
+			}
+			continue
+		}
+		if err != nil || got.URL != tt.want {
+			t.Errorf("selectHLSVariant(%q) = %s, %v; want %s", tt.choice, got.URL, err, tt.want)
+		}
+	}
+}
+
+// hlsServer serves a master playlist whose variant and segment URLs carry a
+// token that changes with every playlist fetch, as signed CDN URLs do.
+// Segments listed in missing answer 404.
+type hlsServer struct {
+	mu      sync.Mutex
+	fetches int
+	missing map[string]bool
+}
+
+func (h *hlsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	switch {
+	case r.URL.Path == "/master.m3u8":
+		h.fetches++
+		fmt.Fprintf(w, "#EXTM3U\n"+
+			"#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"aud\",NAME=\"English\",URI=\"audio.m3u8?sig=%d\"\n"+
+			"#EXT-X-STREAM-INF:BANDWIDTH=2000000,RESOLUTION=1280x720,AUDIO=\"aud\"\nvideo.m3u8?sig=%d\n", h.fetches, h.fetches)
+	case r.URL.Path == "/video.m3u8":
+		h.fetches++
+		fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:4\n")
+		for i := 0; i < 4; i++ {
+			fmt.Fprintf(w, "#EXTINF:4,\nseg%d.ts?sig=%d\n", i, h.fetches)
+		}
+		fmt.Fprint(w, "#EXT-X-ENDLIST\n")
+	case strings.HasPrefix(r.URL.Path, "/seg") && !h.missing[r.URL.Path]:
+		fmt.Fprintf(w, "data of %s\n", r.URL.Path)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// runHLS runs downloadHLS and returns its start event and error
+func runHLS(t *testing.T, config *Config) (map[string]interface{}, error) {
+	t.Helper()
+	var events bytes.Buffer
+	config.Events = NewEventLog(&events)
+	err := downloadHLS(context.Background(), config)
+	for _, line := range strings.Split(strings.TrimSpace(events.String()), "\n") {
+		var e map[string]interface{}
+		if json.Unmarshal([]byte(line), &e) == nil && e["event"] == "start" {
+			return e, err
+		}
+	}
+	return nil, err
+}
+
+func TestDownloadHLSResumesAcrossNewTokens(t *testing.T) {
+	h := &hlsServer{missing: map[string]bool{"/seg2.ts": true}}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	output := filepath.Join(t.TempDir(), "show.ts")
+	newConfig := func() *Config {
+		return &Config{
+			URL:      srv.URL + "/master.m3u8?sig=secret",
+			FilePath: output,
+			Quiet:    true,
+			Parallel: 1,
+			HLS:      HLSOptions{Follow: true},
+		}
+	}
+
+	start, err := runHLS(t, newConfig())
+	if err == nil {
+		t.Fatal("download succeeded with a missing segment")
+	}
+	if start == nil {
+		t.Fatal("no start event")
+	}
+	if u := start["url"].(string); strings.Contains(u, "secret") {
+		t.Errorf("start event leaks the query: %s", u)
+	}
+	if v, _ := start["variant"].(map[string]interface{}); v == nil || v["audio_group"] != "aud" {
+		t.Errorf("start event variant = %v, want audio_group aud", start["variant"])
+	}
+
+	// The playlists now list every URL with a new token
+	h.mu.Lock()
+	h.missing = nil
+	h.mu.Unlock()
+	start, err = runHLS(t, newConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if start["offset"] != float64(2) {
+		t.Errorf("resumed with offset %v, want the 2 segments fetched before", start["offset"])
+	}
+	got, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "data of /seg0.ts\ndata of /seg1.ts\ndata of /seg2.ts\ndata of /seg3.ts\n"; string(got) != want {
+		t.Errorf("output = %q, want %q", got, want)
+	}
+}
+
+func TestHLSLocalFiles(t *testing.T) {
+	dir := t.TempDir()
+	secret := filepath.Join(dir, "secret.ts")
+	if err := ioutil.WriteFile(secret, []byte("local secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	playlist := "#EXTM3U\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXTINF:4,\n" + fileURL(secret) + "\n#EXT-X-ENDLIST\n"
+
+	// A local playlist may name local segments
+	local := filepath.Join(dir, "local.m3u8")
+	if err := ioutil.WriteFile(local, []byte(playlist), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{URL: fileURL(local), FilePath: filepath.Join(t.TempDir(), "local.ts"), Quiet: true, Parallel: 1, HLS: HLSOptions{Follow: true}}
+	if _, err := runHLS(t, config); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ioutil.ReadFile(config.FilePath); string(got) != "local secret" {
+		t.Errorf("local playlist wrote %q", got)
+	}
+
+	// A remote one may not
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, playlist)
+	}))
+	defer srv.Close()
+	config = &Config{URL: srv.URL + "/remote.m3u8", FilePath: filepath.Join(t.TempDir(), "remote.ts"), Quiet: true, Parallel: 1, HLS: HLSOptions{Follow: true}}
+	_, err := runHLS(t, config)
+	if err == nil || !strings.Contains(err.Error(), "not allowed") || exitCode(err) != ExitUsage {
+		t.Fatalf("remote playlist naming a local file = %v, want a usage error", err)
+	}
+	if got, _ := ioutil.ReadFile(config.FilePath); bytes.Contains(got, []byte("secret")) {
+		t.Error("the local file was copied")
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// isFileURL reports whether raw is a file:// URL
+func isFileURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && u.Scheme == "file"
+}
+
+// isDataURL reports whether raw is a data: URL (RFC 2397)
+func isDataURL(raw string) bool {
+	return len(raw) >= 5 && strings.EqualFold(raw[:5], "data:")
+}
+
+// fileURLPath returns the local path named by a file:// URL. Only local
+// hosts are accepted; on Windows "file:///C:/dir/file" maps to "C:\dir\file".
+func fileURLPath(raw string) (string, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", err
+	}
+	if u.Host != "" && u.Host != "localhost" {
+		return "", fmt.Errorf("file URL %s names remote host %q", raw, u.Host)
+	}
+	p := u.Path
+	if runtime.GOOS == "windows" && len(p) >= 3 && p[0] == '/' && p[2] == ':' {
+		p = p[1:]
+	}
+	if p == "" {
+		return "", fmt.Errorf("file URL %s has no path", raw)
+	}
+	return filepath.FromSlash(p), nil
+}
+
+// decodeDataURL returns the payload and media type of a data: URL
+func decodeDataURL(raw string) ([]byte, string, error) {
+	comma := strings.Index(raw, ",")
+	if comma < 0 {
+		return nil, "", fmt.Errorf("invalid data URL: missing ','")
+	}
+	header, payload := raw[len("data:"):comma], raw[comma+1:]
+
+	isBase64 := false
+	if strings.HasSuffix(strings.ToLower(header), ";base64") {
+		isBase64 = true
+		header = header[:len(header)-len(";base64")]
+	}
+	mediaType := header
+	if mediaType == "" || strings.HasPrefix(mediaType, ";") {
+		mediaType = "text/plain" + mediaType
+	}
+
+	data, err := url.PathUnescape(payload)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid data URL: %w", err)
+	}
+	if !isBase64 {
+		return []byte(data), mediaType, nil
+	}
+	// Tolerate whitespace and missing padding, which hand-written URLs often have
+	data = strings.Join(strings.Fields(data), "")
+	decoded, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(data, "="))
+	if err != nil {
+		if decoded, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(data, "=")); err != nil {
+			return nil, "", fmt.Errorf("invalid data URL: %w", err)
+		}
+	}
+	return decoded, mediaType, nil
+}
+
+// openOutput opens filePath for a download of a source that can seek. When
+// resuming it returns the length already on disk, otherwise it truncates.
+func openOutput(config *Config, filePath string) (*os.File, int64, error) {
+	if config.Resume {
+		if fi, err := os.Stat(filePath); err == nil && fi.Size() > 0 {
+			f, err := os.OpenFile(filePath, os.O_APPEND|os.O_WRONLY, 0666)
+			return f, fi.Size(), err
+		}
+	}
+	f, err := os.Create(filePath)
+	return f, 0, err
+}
+
+// copyLocal copies src of the given size into config.FilePath, skipping
+// what a resumed download already has
+func copyLocal(ctx context.Context, config *Config, src io.ReadSeeker, size int64, fields map[string]interface{}) error {
+	f, offset, err := openOutput(config, config.FilePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if offset > size {
+		return fmt.Errorf("resume failed: local file is larger than the source (%d > %d bytes)", offset, size)
+	}
+	if offset > 0 {
+		if _, err := src.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		if !config.Quiet {
+			fmt.Println("Resuming download...")
+		}
+	}
+
+	if !config.Quiet {
+		fmt.Printf("Downloading to: %s\n", config.FilePath)
+	}
+	fields["path"] = config.FilePath
+	fields["size"] = size
+	fields["offset"] = offset
+	config.Events.Emit("start", fields)
+
+	if err := copyBody(ctx, config, f, src, offset, size); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// downloadLocalFile copies the file named by a file:// URL
+func downloadLocalFile(ctx context.Context, config *Config) error {
+	source, err := fileURLPath(config.URL)
+	if err != nil {
+		return &UsageError{err}
+	}
+	src, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	fi, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return &UsageError{fmt.Errorf("%s is a directory", source)}
+	}
+
+	if config.FilePath == "" {
+		config.FilePath = filepath.Base(source)
+	}
+	// Opening the output would truncate the source
+	if out, err := os.Stat(config.FilePath); err == nil && os.SameFile(fi, out) {
+		return &UsageError{fmt.Errorf("source and output are the same file: %s", source)}
+	}
+	return copyLocal(ctx, config, &contextReader{ctx: ctx, ReadSeeker: src}, fi.Size(), map[string]interface{}{
+		"url": config.URL,
+	})
+}
+
+// downloadDataURL writes the payload of a data: URL
+func downloadDataURL(ctx context.Context, config *Config) error {
+	data, mediaType, err := decodeDataURL(config.URL)
+	if err != nil {
+		return &UsageError{err}
+	}
+	if config.FilePath == "" {
+		config.FilePath = "downloaded_file"
+		if mt, _, err := mime.ParseMediaType(mediaType); err == nil {
+			// The system table lists ".asc" and others before ".txt"
+			if mt == "text/plain" {
+				config.FilePath += ".txt"
+			} else if exts, _ := mime.ExtensionsByType(mt); len(exts) > 0 {
+				config.FilePath += exts[0]
+			}
+		}
+	}
+	return copyLocal(ctx, config, &contextReader{ctx: ctx, ReadSeeker: bytes.NewReader(data)}, int64(len(data)), map[string]interface{}{
+		"url":          redactDataURL(config.URL),
+		"content_type": mediaType,
+	})
+}
+
+// redactDataURL shortens a data: URL for reports, since the payload may be large
+func redactDataURL(raw string) string {
+	if comma := strings.Index(raw, ","); comma >= 0 && len(raw)-comma > 32 {
+		return raw[:comma+1] + "..."
+	}
+	return raw
+}
+
+// contextReader stops a local copy when ctx is cancelled. Local reads never
+// block, so checking between reads is enough.
+type contextReader struct {
+	ctx context.Context
+	io.ReadSeeker
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.ReadSeeker.Read(p)
+}
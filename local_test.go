@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestFileURLPath(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string // "" when an error is expected
+	}{
+		{"file:///srv/data/file.bin", "/srv/data/file.bin"},
+		{"file://localhost/srv/file.bin", "/srv/file.bin"},
+		{"file:///srv/with%20space.bin", "/srv/with space.bin"},
+		{"file://fileserver/share/file.bin", ""},
+		{"file://", ""},
+	}
+	for _, tt := range tests {
+		got, err := fileURLPath(tt.raw)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("fileURLPath(%s) = %q, want an error", tt.raw, got)
+			}
+			continue
+		}
+		if want := filepath.FromSlash(tt.want); err != nil || got != want {
+			t.Errorf("fileURLPath(%s) = %q, %v; want %q", tt.raw, got, err, want)
+		}
+	}
+}
+
+func TestDecodeDataURL(t *testing.T) {
+	tests := []struct {
+		raw       string
+		data      string
+		mediaType string
+		err       bool
+	}{
+		{"data:,hello%20world", "hello world", "text/plain", false},
+		{"data:text/csv,a%2Cb", "a,b", "text/csv", false},
+		{"data:;charset=utf-8,x", "x", "text/plain;charset=utf-8", false},
+		{"data:application/octet-stream;base64,aGVsbG8=", "hello", "application/octet-stream", false},
+		{"data:;base64,aGVsbG8", "hello", "text/plain", false},
+		{"data:;BASE64,aGVs%20bG8=", "hello", "text/plain", false},
+		{"data:;base64,-_8", "\xfb\xff", "text/plain", false},
+		{"data:text/plain", "", "", true},
+		{"data:;base64,!!!", "", "", true},
+		{"data:,%zz", "", "", true},
+	}
+	for _, tt := range tests {
+		data, mediaType, err := decodeDataURL(tt.raw)
+		if tt.err {
+			if err == nil {
+				t.Errorf("decodeDataURL(%s) = %q, want an error", tt.raw, data)
+			}
+			continue
+		}
+		if err != nil || string(data) != tt.data || mediaType != tt.mediaType {
+			t.Errorf("decodeDataURL(%s) = %q, %q, %v; want %q, %q", tt.raw, data, mediaType, err, tt.data, tt.mediaType)
+		}
+	}
+}
+
+// fileURL returns the file:// URL of a local path
+func fileURL(path string) string {
+	path = filepath.ToSlash(path)
+	if runtime.GOOS == "windows" {
+		path = "/" + path
+	}
+	return "file://" + path
+}
+
+func TestDownloadLocalFile(t *testing.T) {
+	dir := t.TempDir()
+	body := bytes.Repeat([]byte("local data "), 10000)
+	source := filepath.Join(dir, "source.bin")
+	if err := ioutil.WriteFile(source, body, 0644); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(body)
+
+	tests := []struct {
+		name     string
+		url      string
+		output   string // default a new file in a temporary directory
+		partial  []byte // already on disk, resumed with -r
+		checksum string
+		err      string // "" when the copy succeeds
+		usage    bool   // whether err is a UsageError
+	}{
+		{name: "copy", url: fileURL(source), checksum: hex.EncodeToString(sum[:])},
+		{name: "resume", url: fileURL(source), partial: body[:12345]},
+		{name: "wrong checksum", url: fileURL(source), checksum: strings.Repeat("0", 64), err: "checksum mismatch"},
+		{name: "partial file too large", url: fileURL(source), partial: append(append([]byte{}, body...), 'x'), err: "larger than the source"},
+		{name: "missing source", url: fileURL(filepath.Join(dir, "missing.bin")), err: "no such file"},
+		{name: "directory", url: fileURL(dir), err: "is a directory", usage: true},
+		{name: "same file", url: fileURL(source), output: source, err: "same file", usage: true},
+		{name: "remote host", url: "file://fileserver/share/file.bin", err: "remote host", usage: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := tt.output
+			if path == "" {
+				path = filepath.Join(t.TempDir(), "file.bin")
+			}
+			if tt.partial != nil {
+				if err := ioutil.WriteFile(path, tt.partial, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			config := &Config{
+				URL:         tt.url,
+				FilePath:    path,
+				Resume:      tt.partial != nil,
+				Checksum:    tt.checksum,
+				ChecksumAlg: "sha256",
+				Quiet:       true,
+			}
+			err := downloadWithRetry(context.Background(), config)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(strings.ToLower(err.Error()), tt.err) {
+					t.Fatalf("download = %v, want an error mentioning %q", err, tt.err)
+				}
+				var usageErr *UsageError
+				if errors.As(err, &usageErr) != tt.usage {
+					t.Errorf("download = %v, usage error = %v", err, !tt.usage)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := ioutil.ReadFile(path); !bytes.Equal(got, body) {
+				t.Fatalf("copied %d bytes that differ from the source", len(got))
+			}
+		})
+	}
+	// The source survives a copy onto itself
+	if got, _ := ioutil.ReadFile(source); !bytes.Equal(got, body) {
+		t.Error("the source file was changed")
+	}
+}
+
+func TestDownloadDataURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		name string // the default output name
+		data string
+	}{
+		{"data:,plain%20text", "downloaded_file.txt", "plain text"},
+		{"data:application/json;base64,eyJhIjoxfQ==", "downloaded_file.json", `{"a":1}`},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		wd, _ := os.Getwd()
+		if err := os.Chdir(dir); err != nil {
+			t.Fatal(err)
+		}
+		var events bytes.Buffer
+		config := &Config{URL: tt.url, Quiet: true, Events: NewEventLog(&events)}
+		err := downloadWithRetry(context.Background(), config)
+		os.Chdir(wd)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.url, err)
+		}
+		if config.FilePath != tt.name {
+			t.Errorf("%s: saved as %s, want %s", tt.url, config.FilePath, tt.name)
+		}
+		if got, _ := ioutil.ReadFile(filepath.Join(dir, tt.name)); string(got) != tt.data {
+			t.Errorf("%s: wrote %q, want %q", tt.url, got, tt.data)
+		}
+		for _, e := range readEvents(t, &events) {
+			if e["event"] == "start" && e["url"] != tt.url {
+				t.Errorf("start url = %v, want %s", e["url"], tt.url)
+			}
+		}
+	}
+
+	// Long payloads are left out of reports
+	long := "data:;base64," + strings.Repeat("QUJD", 20)
+	if got := redactDataURL(long); got != "data:;base64,..." {
+		t.Errorf("redactDataURL = %q", got)
+	}
+}
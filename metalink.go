@@ -0,0 +1,564 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// maxMetalinkSize bounds how much of a Metalink document is read
+const maxMetalinkSize = 16 << 20
+
+// isMetalinkURL reports whether config.URL is, unless -follow-metalink=false,
+// an http(s) or file URL of a .meta4 or .metalink file
+func isMetalinkURL(config *Config) bool {
+	u, err := url.Parse(config.URL)
+	if err != nil || !config.Metalink {
+		return false
+	}
+	switch u.Scheme {
+	case "http", "https", "file":
+		p := strings.ToLower(u.Path)
+		return strings.HasSuffix(p, ".meta4") || strings.HasSuffix(p, ".metalink")
+	}
+	return false
+}
+
+// metalinkXML covers both Metalink 4 (RFC 5854) and the older 3.0 format.
+// Element names are matched without their namespace, which differs between
+// the two.
+type metalinkXML struct {
+	Files   []metalinkFileXML `xml:"file"`       // 4.0
+	V3Files []metalinkFileXML `xml:"files>file"` // 3.0
+}
+
+type metalinkFileXML struct {
+	Name      string                `xml:"name,attr"`
+	Size      int64                 `xml:"size"`
+	Hashes    []metalinkHashXML     `xml:"hash"`
+	Pieces    []metalinkPiecesXML   `xml:"pieces"`
+	Signature *metalinkSignatureXML `xml:"signature"`
+	URLs      []metalinkURLXML      `xml:"url"`
+
+	// 3.0 keeps hashes and URLs one level down
+	Verification struct {
+		Hashes    []metalinkHashXML     `xml:"hash"`
+		Pieces    []metalinkPiecesXML   `xml:"pieces"`
+		Signature *metalinkSignatureXML `xml:"signature"`
+	} `xml:"verification"`
+	Resources struct {
+		URLs []metalinkURLXML `xml:"url"`
+	} `xml:"resources"`
+}
+
+type metalinkHashXML struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+type metalinkPiecesXML struct {
+	Type   string   `xml:"type,attr"`
+	Length int64    `xml:"length,attr"`
+	Hashes []string `xml:"hash"`
+}
+
+type metalinkSignatureXML struct {
+	MediaType string `xml:"mediatype,attr"` // 4.0: "application/pgp-signature"
+	Type      string `xml:"type,attr"`      // 3.0: "pgp"
+}
+
+type metalinkURLXML struct {
+	Priority   int    `xml:"priority,attr"`   // 4.0: 1 is the most preferred
+	Preference int    `xml:"preference,attr"` // 3.0: 100 is the most preferred
+	Type       string `xml:"type,attr"`       // 3.0: "http", "ftp", "bittorrent", ...
+	Value      string `xml:",chardata"`
+}
+
+// metalinkFile is one file described by a Metalink document
+type metalinkFile struct {
+	Name    string // slash-separated relative path
+	Size    int64  // -1 if not given
+	HashAlg string // strongest whole-file hash verifyChecksum supports
+	Hash    string
+	Mirrors []string // most preferred first
+
+	PieceAlg    string
+	PieceLength int64
+	Pieces      []string // hex digests
+
+	Signature string // type of the listed signature, which is not verified
+}
+
+// metalinkHashAlg maps a Metalink hash type ("sha-256", "sha256", ...) to
+// the names verifyChecksum uses, or "" if it is not supported
+func metalinkHashAlg(typ string) string {
+	alg := strings.ReplaceAll(strings.ToLower(strings.TrimSpace(typ)), "-", "")
+	if newChecksumHash(alg) == nil {
+		return ""
+	}
+	return alg
+}
+
+// parseMetalink parses a Metalink 4 or 3.0 document. Only a local document
+// may send dl to local files or to mirrors that use the user's SSH keys.
+func parseMetalink(data []byte, local bool) ([]metalinkFile, error) {
+	var doc metalinkXML
+	if err := xml.NewDecoder(bytes.NewReader(data)).Decode(&doc); err != nil {
+		return nil, err
+	}
+	v3 := len(doc.Files) == 0
+	raw := doc.Files
+	if v3 {
+		raw = doc.V3Files
+	}
+	if len(raw) == 0 {
+		return nil, errors.New("no files listed")
+	}
+
+	seen := map[string]bool{}
+	files := make([]metalinkFile, 0, len(raw))
+	for _, rf := range raw {
+		f := metalinkFile{Size: -1}
+		if rf.Size > 0 {
+			f.Size = rf.Size
+		}
+
+		// Names may contain directories but must stay below the output directory
+		parts := strings.Split(strings.TrimSpace(rf.Name), "/")
+		for _, part := range parts {
+			if !safePathComponent(part) {
+				return nil, fmt.Errorf("unsafe file name %q", rf.Name)
+			}
+		}
+		f.Name = strings.Join(parts, "/")
+		if seen[f.Name] {
+			return nil, fmt.Errorf("file %q is listed twice", f.Name)
+		}
+		seen[f.Name] = true
+
+		hashes, pieces, signature, urls := rf.Hashes, rf.Pieces, rf.Signature, rf.URLs
+		if v3 {
+			hashes, pieces, signature, urls = rf.Verification.Hashes, rf.Verification.Pieces, rf.Verification.Signature, rf.Resources.URLs
+		}
+		if signature != nil {
+			f.Signature = signature.MediaType
+			if v3 {
+				f.Signature = signature.Type
+			}
+			if f.Signature == "" {
+				f.Signature = "unknown"
+			}
+		}
+		for _, h := range hashes {
+			alg := metalinkHashAlg(h.Type)
+			if alg != "" && checksumStrength[alg] > checksumStrength[f.HashAlg] {
+				f.HashAlg, f.Hash = alg, strings.ToLower(strings.TrimSpace(h.Value))
+			}
+		}
+		for _, p := range pieces {
+			alg := metalinkHashAlg(p.Type)
+			if alg == "" || p.Length <= 0 || len(p.Hashes) == 0 || checksumStrength[alg] <= checksumStrength[f.PieceAlg] {
+				continue
+			}
+			// Each piece is read into memory to be checked
+			if p.Length > maxPieceLength {
+				return nil, fmt.Errorf("%s: piece length %d is over the %d byte limit", f.Name, p.Length, maxPieceLength)
+			}
+			if f.Size >= 0 && int64(len(p.Hashes)) != (f.Size+p.Length-1)/p.Length {
+				return nil, fmt.Errorf("%s: %d piece hashes do not cover %d bytes", f.Name, len(p.Hashes), f.Size)
+			}
+			length := p.Length
+			if f.Size >= 0 && length > f.Size {
+				// A single piece, as generators list for small files
+				length = f.Size
+			}
+			f.PieceAlg, f.PieceLength, f.Pieces = alg, length, nil
+			for _, h := range p.Hashes {
+				f.Pieces = append(f.Pieces, strings.ToLower(strings.TrimSpace(h)))
+			}
+		}
+		if f.Size < 0 {
+			// Without a size the last piece cannot be told from a short file
+			f.Pieces = nil
+		}
+
+		f.Mirrors = metalinkMirrors(urls, v3, local)
+		if len(f.Mirrors) == 0 {
+			return nil, fmt.Errorf("%s: no usable URLs", f.Name)
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// metalinkMirrors returns the URLs dl can download from, most preferred
+// first. Listed order breaks ties. file: and sftp: URLs are only taken from
+// a local document.
+func metalinkMirrors(urls []metalinkURLXML, v3, local bool) []string {
+	rank := func(u metalinkURLXML) int {
+		if v3 {
+			return -u.Preference
+		}
+		if u.Priority <= 0 {
+			return 1 << 30
+		}
+		return u.Priority
+	}
+	sorted := append([]metalinkURLXML(nil), urls...)
+	sort.SliceStable(sorted, func(i, j int) bool { return rank(sorted[i]) < rank(sorted[j]) })
+
+	var mirrors []string
+	for _, m := range sorted {
+		if strings.EqualFold(m.Type, "bittorrent") {
+			continue
+		}
+		raw := strings.TrimSpace(m.Value)
+		u, err := url.Parse(raw)
+		if err != nil {
+			continue
+		}
+		switch u.Scheme {
+		case "http", "https", "ftp", "ftps":
+			mirrors = append(mirrors, raw)
+		case "sftp", "file":
+			if local {
+				mirrors = append(mirrors, raw)
+			}
+		}
+	}
+	return mirrors
+}
+
+// metalinkDownload fetches the files of one Metalink document
+type metalinkDownload struct {
+	config *Config
+}
+
+// mirrorFailed reports a mirror that could not deliver a file before the
+// next one is tried
+func (m *metalinkDownload) mirrorFailed(mirror string, err error) {
+	if !m.config.Quiet {
+		fmt.Printf("Mirror %s failed: %v\n", redactQuery(mirror), err)
+	}
+	m.config.Events.Emit("mirror_error", map[string]interface{}{
+		"url":   redactQuery(mirror),
+		"error": err.Error(),
+	})
+}
+
+// fetch downloads f to path, trying the mirrors in order. A copy that fails
+// verification is repaired piece by piece when piece hashes are available
+// and otherwise downloaded again from the next mirror.
+func (m *metalinkDownload) fetch(ctx context.Context, f *metalinkFile, path string) error {
+	if f.Signature != "" {
+		if !m.config.Quiet {
+			fmt.Printf("Warning: the %s signature of %s is not verified\n", f.Signature, f.Name)
+		}
+		m.config.Events.Emit("signature", map[string]interface{}{
+			"path":     path,
+			"type":     f.Signature,
+			"verified": false,
+		})
+	}
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			return err
+		}
+	}
+
+	// A complete file left by an earlier run only needs checking; a partial
+	// one is continued only with -r. Within this run, each mirror picks up
+	// where the previous one stopped.
+	if fi, err := os.Stat(path); err == nil {
+		complete := f.Size >= 0 && fi.Size() == f.Size
+		if complete {
+			err := m.verify(ctx, f, path, f.Mirrors)
+			if err == nil {
+				if !m.config.Quiet {
+					fmt.Printf("Already complete: %s\n", path)
+				}
+				return nil
+			} else if !isChecksumError(err) {
+				return err
+			}
+		}
+		if complete || !m.config.Resume {
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+		}
+	}
+
+	var lastErr error
+	for i, mirror := range f.Mirrors {
+		if err := m.fetchFrom(ctx, f, path, mirror); err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			m.mirrorFailed(mirror, err)
+			lastErr = err
+			continue
+		}
+		// Pieces this mirror got wrong are fetched from the others first
+		repairFrom := append(append([]string(nil), f.Mirrors[i+1:]...), mirror)
+		err := m.verify(ctx, f, path, repairFrom)
+		if err == nil || !isChecksumError(err) || ctx.Err() != nil {
+			return err
+		}
+		// The copy is corrupt and could not be repaired; start over elsewhere
+		m.mirrorFailed(mirror, err)
+		lastErr = err
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	return lastErr
+}
+
+// fetchFrom downloads whatever part of f is missing from path from one
+// mirror, continuing a partial file where the mirror allows
+func (m *metalinkDownload) fetchFrom(ctx context.Context, f *metalinkFile, path, mirror string) error {
+	fi, err := os.Stat(path)
+	if err == nil && f.Size >= 0 {
+		switch {
+		case fi.Size() == f.Size:
+			return nil
+		case fi.Size() > f.Size:
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+			err = os.ErrNotExist
+		}
+	}
+
+	file := *m.config
+	file.URL = mirror
+	file.FilePath = path
+	file.Method = ""
+	file.Body = nil
+	file.Checksum = ""
+	file.etag = ""
+	file.Resume = err == nil && fi.Size() > 0
+	if err == nil && !file.Resume {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	if err := downloadFile(ctx, &file); err != nil {
+		return err
+	}
+
+	if f.Size >= 0 {
+		if fi, err := os.Stat(path); err != nil {
+			return err
+		} else if fi.Size() != f.Size {
+			return fmt.Errorf("%s is %d bytes, expected %d", path, fi.Size(), f.Size)
+		}
+	}
+	return nil
+}
+
+// verify checks the piece hashes of path, repairing bad pieces from mirrors,
+// then the whole-file hash
+func (m *metalinkDownload) verify(ctx context.Context, f *metalinkFile, path string, mirrors []string) error {
+	if len(f.Pieces) > 0 {
+		bad, err := m.badPieces(f, path)
+		if err != nil {
+			return err
+		}
+		if len(bad) > 0 {
+			if err := m.repair(ctx, f, path, bad, mirrors); err != nil {
+				return err
+			}
+		}
+	}
+	if f.Hash == "" {
+		return nil
+	}
+	if !m.config.Quiet {
+		fmt.Printf("Verifying %s checksum...\n", f.HashAlg)
+	}
+	err := verifyChecksum(path, f.Hash, f.HashAlg)
+	fields := map[string]interface{}{
+		"path":      path,
+		"algorithm": f.HashAlg,
+		"expected":  f.Hash,
+		"ok":        err == nil,
+	}
+	var checksumErr *ChecksumError
+	if errors.As(err, &checksumErr) {
+		fields["actual"] = checksumErr.Actual
+	}
+	m.config.Events.Emit("checksum", fields)
+	if err != nil {
+		return fmt.Errorf("checksum verification of %s failed: %w", path, err)
+	}
+	return nil
+}
+
+// pieceRange returns the byte range of piece i
+func (f *metalinkFile) pieceRange(i int) (start, end int64) {
+	start = int64(i) * f.PieceLength
+	end = start + f.PieceLength
+	if end > f.Size {
+		end = f.Size
+	}
+	return start, end
+}
+
+// pieceBufferSize returns the length of the largest piece
+func (f *metalinkFile) pieceBufferSize() int64 {
+	if f.Size < f.PieceLength {
+		return f.Size
+	}
+	return f.PieceLength
+}
+
+// checkPiece compares the hash of data with that of piece i
+func (f *metalinkFile) checkPiece(i int, data []byte) error {
+	h := newChecksumHash(f.PieceAlg)
+	h.Write(data)
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != f.Pieces[i] {
+		return &ChecksumError{Algorithm: f.PieceAlg, Expected: f.Pieces[i], Actual: actual}
+	}
+	return nil
+}
+
+// badPieces returns the pieces of path that are missing or do not match
+// their hash
+func (m *metalinkDownload) badPieces(f *metalinkFile, path string) ([]int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var bad []int
+	buf := make([]byte, f.pieceBufferSize())
+	for i := range f.Pieces {
+		start, end := f.pieceRange(i)
+		n, err := file.ReadAt(buf[:end-start], start)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if int64(n) < end-start || f.checkPiece(i, buf[:n]) != nil {
+			bad = append(bad, i)
+		}
+	}
+	return bad, nil
+}
+
+// repair downloads the bad pieces of path again with ranged requests, trying
+// each http(s) mirror in turn until a piece matches its hash
+func (m *metalinkDownload) repair(ctx context.Context, f *metalinkFile, path string, bad []int, mirrors []string) error {
+	if !m.config.Quiet {
+		fmt.Printf("Repairing %d of %d pieces of %s...\n", len(bad), len(f.Pieces), path)
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	buf := make([]byte, f.pieceBufferSize())
+	var failed error
+	for _, i := range bad {
+		start, end := f.pieceRange(i)
+		piece := buf[:end-start]
+		err := fmt.Errorf("no http(s) mirror to fetch piece %d of %s from", i, path)
+		for _, mirror := range mirrors {
+			if u, perr := url.Parse(mirror); perr != nil || u.Scheme != "http" && u.Scheme != "https" {
+				continue
+			}
+			var body io.ReadCloser
+			if body, err = openRange(ctx, m.config, mirror, start, end-1); err != nil {
+				if ctx.Err() != nil {
+					return err
+				}
+				continue
+			}
+			_, err = io.ReadFull(limitReader(ctx, m.config, body), piece)
+			body.Close()
+			if err == nil {
+				err = f.checkPiece(i, piece)
+			}
+			if err == nil {
+				break
+			}
+			if ctx.Err() != nil {
+				return timeoutError(ctx, err)
+			}
+		}
+		if err == nil {
+			_, err = file.WriteAt(piece, start)
+			if err != nil {
+				return err
+			}
+		} else if failed == nil || isChecksumError(err) && !isChecksumError(failed) {
+			failed = fmt.Errorf("cannot repair piece %d of %s: %w", i, path, err)
+		}
+	}
+	m.config.Events.Emit("repair", map[string]interface{}{
+		"path":   path,
+		"pieces": len(bad),
+		"ok":     failed == nil,
+	})
+	if failed != nil {
+		return failed
+	}
+	return file.Close()
+}
+
+// isChecksumError reports whether err is a hash mismatch
+func isChecksumError(err error) bool {
+	var checksumErr *ChecksumError
+	return errors.As(err, &checksumErr)
+}
+
+// downloadMetalink downloads the files a Metalink document describes. A
+// single file is saved to -o or its listed name; several go into the -o
+// directory, or the current one.
+func downloadMetalink(ctx context.Context, config *Config) error {
+	data, err := fetchDocument(ctx, config, maxMetalinkSize)
+	if err != nil {
+		return err
+	}
+	files, err := parseMetalink(data, isFileURL(config.URL))
+	if err != nil {
+		return &UsageError{fmt.Errorf("invalid Metalink file: %w", err)}
+	}
+
+	m := &metalinkDownload{config: config}
+	if len(files) == 1 {
+		f := &files[0]
+		if config.FilePath == "" {
+			config.FilePath = filepath.FromSlash(f.Name)
+		}
+		return m.fetch(ctx, f, config.FilePath)
+	}
+
+	if config.Checksum != "" {
+		return &UsageError{fmt.Errorf("checksums cannot be verified for a Metalink of %d files", len(files))}
+	}
+	if config.FilePath == "" {
+		config.FilePath = "."
+	}
+	for i := range files {
+		if err := m.fetch(ctx, &files[i], filepath.Join(config.FilePath, filepath.FromSlash(files[i].Name))); err != nil {
+			return err
+		}
+	}
+	if !config.Quiet {
+		fmt.Printf("Downloaded %d files to %s\n", len(files), config.FilePath)
+	}
+	return nil
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseMetalink(t *testing.T) {
+	v4 := `<?xml version="1.0" encoding="UTF-8"?>
+<metalink xmlns="urn:ietf:params:xml:ns:metalink">
+  <file name="dir/app.tar.gz">
+    <size>40</size>
+    <hash type="md5">00000000000000000000000000000000</hash>
+    <hash type="sha-256">AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA</hash>
+    <pieces type="sha-1" length="16"><hash>01</hash><hash>02</hash><hash>03</hash></pieces>
+    <signature mediatype="application/pgp-signature">-----BEGIN PGP SIGNATURE-----</signature>
+    <url priority="2">https://b.example/app.tar.gz</url>
+    <url>https://c.example/app.tar.gz</url>
+    <url priority="1">https://a.example/app.tar.gz</url>
+    <metaurl mediatype="torrent">https://a.example/app.torrent</metaurl>
+  </file>
+</metalink>`
+	v3 := `<?xml version="1.0" encoding="UTF-8"?>
+<metalink version="3.0" xmlns="http://www.metalinker.org/">
+  <files><file name="app.iso">
+    <size>1000</size>
+    <verification>
+      <hash type="sha1">BBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBB</hash>
+      <pieces type="sha1" length="262144"><hash piece="0">CC</hash></pieces>
+      <signature type="pgp">-----BEGIN PGP SIGNATURE-----</signature>
+    </verification>
+    <resources>
+      <url type="http" preference="10">http://slow.example/app.iso</url>
+      <url type="bittorrent" preference="100">http://t.example/app.iso.torrent</url>
+      <url type="ftp" preference="90">ftp://fast.example/app.iso</url>
+    </resources>
+  </file></files>
+</metalink>`
+
+	files, err := parseMetalink([]byte(v4), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := metalinkFile{
+		Name: "dir/app.tar.gz", Size: 40,
+		HashAlg: "sha256", Hash: strings.Repeat("a", 64),
+		Mirrors:  []string{"https://a.example/app.tar.gz", "https://b.example/app.tar.gz", "https://c.example/app.tar.gz"},
+		PieceAlg: "sha1", PieceLength: 16, Pieces: []string{"01", "02", "03"},
+		Signature: "application/pgp-signature",
+	}
+	if len(files) != 1 || !reflect.DeepEqual(files[0], want) {
+		t.Errorf("Metalink 4 = %+v\nwant %+v", files, want)
+	}
+
+	files, err = parseMetalink([]byte(v3), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = metalinkFile{
+		Name: "app.iso", Size: 1000,
+		HashAlg: "sha1", Hash: strings.Repeat("b", 40),
+		Mirrors: []string{"ftp://fast.example/app.iso", "http://slow.example/app.iso"},
+		// The one piece is as long as the file
+		PieceAlg: "sha1", PieceLength: 1000, Pieces: []string{"cc"},
+		Signature: "pgp",
+	}
+	if len(files) != 1 || !reflect.DeepEqual(files[0], want) {
+		t.Errorf("Metalink 3.0 = %+v\nwant %+v", files, want)
+	}
+}
+
+// metalink4 returns a Metalink 4 document listing one file
+func metalink4(name string, size int64, inner string) []byte {
+	return []byte(fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<metalink xmlns="urn:ietf:params:xml:ns:metalink"><file name="%s"><size>%d</size>%s</file></metalink>`, name, size, inner))
+}
+
+func TestParseMetalinkMirrorSchemes(t *testing.T) {
+	doc := metalink4("a", 1, `
+<url>http://h.example/a</url><url>https://h.example/a</url>
+<url>ftp://f.example/a</url><url>ftps://f.example/a</url>
+<url>sftp://s.example/a</url><url>s3://bucket/a</url>
+<url>file:///etc/passwd</url><url>gopher://g.example/a</url>`)
+	tests := []struct {
+		local bool
+		want  []string
+	}{
+		{false, []string{"http://h.example/a", "https://h.example/a", "ftp://f.example/a", "ftps://f.example/a"}},
+		{true, []string{"http://h.example/a", "https://h.example/a", "ftp://f.example/a", "ftps://f.example/a", "sftp://s.example/a", "file:///etc/passwd"}},
+	}
+	for _, tt := range tests {
+		files, err := parseMetalink(doc, tt.local)
+		if err != nil || !reflect.DeepEqual(files[0].Mirrors, tt.want) {
+			t.Errorf("local %v: mirrors = %v, %v; want %v", tt.local, files, err, tt.want)
+		}
+	}
+}
+
+func TestParseMetalinkMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		want string
+	}{
+		{"no files", `<metalink xmlns="urn:ietf:params:xml:ns:metalink"></metalink>`, "no files"},
+		{"unsafe name", string(metalink4("../evil", 1, `<url>http://h/a</url>`)), "unsafe file name"},
+		{"absolute name", string(metalink4("/etc/evil", 1, `<url>http://h/a</url>`)), "unsafe file name"},
+		{"listed twice", `<metalink xmlns="urn:ietf:params:xml:ns:metalink"><file name="a"><url>http://h/a</url></file><file name="a"><url>http://h/a</url></file></metalink>`, "listed twice"},
+		{"only local mirrors", string(metalink4("a", 1, `<url>file:///etc/passwd</url><url>sftp://h/a</url>`)), "no usable URLs"},
+		{"huge piece length", string(metalink4("a", 10, `<pieces type="sha-256" length="1125899906842624"><hash>00</hash></pieces><url>http://h/a</url>`)), "over the 67108864 byte limit"},
+		{"pieces do not cover the file", string(metalink4("a", 100, `<pieces type="sha-256" length="16"><hash>00</hash></pieces><url>http://h/a</url>`)), "do not cover"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files, err := parseMetalink([]byte(tt.doc), false)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("parseMetalink = %+v, %v; want an error mentioning %q", files, err, tt.want)
+			}
+		})
+	}
+}
+
+// pieceHashes returns the SHA-256 pieces element for content
+func pieceHashes(content []byte, length int) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, `<pieces type="sha-256" length="%d">`, length)
+	for i := 0; i < len(content); i += length {
+		end := i + length
+		if end > len(content) {
+			end = len(content)
+		}
+		sum := sha256.Sum256(content[i:end])
+		fmt.Fprintf(&b, "<hash>%s</hash>", hex.EncodeToString(sum[:]))
+	}
+	return b.String() + "</pieces>"
+}
+
+func TestDownloadMetalink(t *testing.T) {
+	content := bytes.Repeat([]byte("metalink content "), 4000)
+	corrupt := append([]byte(nil), content...)
+	copy(corrupt[20000:], "garbage")
+	sum := sha256.Sum256(content)
+	fileHash := fmt.Sprintf(`<hash type="sha-256">%x</hash>`, sum)
+
+	var doc []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/app.meta4":
+			w.Write(doc)
+		case "/good/app.bin":
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+		case "/bad/app.bin":
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(corrupt))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	local := filepath.Join(t.TempDir(), "source.bin")
+	if err := ioutil.WriteFile(local, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	mirrors := fmt.Sprintf(`<url priority="1">%[1]s/missing/app.bin</url><url priority="2">%[1]s/bad/app.bin</url><url priority="3">%[1]s/good/app.bin</url>`, srv.URL)
+	tests := []struct {
+		name    string
+		doc     []byte
+		local   bool // serve the document as a file:// URL
+		err     string
+		events  []string // events that must be emitted
+		noFiles bool     // nothing may be written
+	}{
+		{
+			name:   "failover and repair",
+			doc:    metalink4("app.bin", int64(len(content)), fileHash+pieceHashes(content, 16<<10)+mirrors),
+			events: []string{"mirror_error", "repair", "checksum"},
+		},
+		{
+			name:   "no pieces",
+			doc:    metalink4("app.bin", int64(len(content)), fileHash+mirrors),
+			events: []string{"mirror_error", "checksum"},
+		},
+		{
+			name: "piece longer than the file",
+			doc:  metalink4("app.bin", int64(len(content)), pieceHashes(content, 1<<20)+fmt.Sprintf(`<url>%s/good/app.bin</url>`, srv.URL)),
+		},
+		{
+			name:   "signature",
+			doc:    metalink4("app.bin", int64(len(content)), fileHash+`<signature mediatype="application/pgp-signature">sig</signature>`+fmt.Sprintf(`<url>%s/good/app.bin</url>`, srv.URL)),
+			events: []string{"signature"},
+		},
+		{
+			name:    "huge piece length",
+			doc:     metalink4("app.bin", 10, `<pieces type="sha-256" length="1125899906842624"><hash>00</hash></pieces>`+mirrors),
+			err:     "byte limit",
+			noFiles: true,
+		},
+		{
+			name:    "remote document naming a local file",
+			doc:     metalink4("app.bin", int64(len(content)), `<url>`+fileURL(local)+`</url>`),
+			err:     "no usable URLs",
+			noFiles: true,
+		},
+		{
+			name:  "local document naming a local file",
+			doc:   metalink4("app.bin", int64(len(content)), fileHash+`<url>`+fileURL(local)+`</url>`),
+			local: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc = tt.doc
+			dir := t.TempDir()
+			u := srv.URL + "/app.meta4"
+			if tt.local {
+				path := filepath.Join(t.TempDir(), "app.meta4")
+				ioutil.WriteFile(path, tt.doc, 0644)
+				u = fileURL(path)
+			}
+			var events bytes.Buffer
+			config := &Config{
+				URL:      u,
+				FilePath: filepath.Join(dir, "app.bin"),
+				Metalink: true,
+				Quiet:    true,
+				Events:   NewEventLog(&events),
+			}
+			err := downloadWithRetry(context.Background(), config)
+			if tt.err != "" {
+				var usageErr *UsageError
+				if !errors.As(err, &usageErr) || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("download = %v, want a usage error mentioning %q", err, tt.err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else if got, _ := ioutil.ReadFile(config.FilePath); !bytes.Equal(got, content) {
+				t.Fatalf("downloaded %d bytes that differ from the file", len(got))
+			}
+			if entries, _ := ioutil.ReadDir(dir); tt.noFiles && len(entries) > 0 {
+				t.Errorf("wrote %s", entries[0].Name())
+			}
+
+			seen := map[string]map[string]interface{}{}
+			for _, e := range readEvents(t, &events) {
+				seen[e["event"].(string)] = e
+			}
+			for _, name := range tt.events {
+				if seen[name] == nil {
+					t.Errorf("no %s event", name)
+				}
+			}
+			if e := seen["signature"]; e != nil && (e["verified"] != false || e["type"] != "application/pgp-signature") {
+				t.Errorf("signature event = %v", e)
+			}
+			if e := seen["repair"]; e != nil && e["ok"] != true {
+				t.Errorf("repair event = %v", e)
+			}
+		})
+	}
+}
+
+func TestDownloadS3WithoutClient(t *testing.T) {
+	err := downloadS3(context.Background(), &Config{URL: "s3://bucket/key", FilePath: filepath.Join(t.TempDir(), "key")})
+	var usageErr *UsageError
+	if !errors.As(err, &usageErr) {
+		t.Fatalf("downloadS3 without a client = %v, want a usage error", err)
+	}
+}
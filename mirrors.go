@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// defaultLinkPriority is the pri of a duplicate that does not give one (RFC 6249)
+const defaultLinkPriority = 999999
+
+// linkMirror is a duplicate of the download advertised in a Link header
+type linkMirror struct {
+	URL      string
+	Priority int    // lower is preferred
+	Geo      string // ISO 3166-1 alpha-2 country code, lower case
+}
+
+// splitLinkParams parses the ";"-separated parameters following a Link
+// target up to the next "," outside quotes, returning them with lower case
+// names and the rest of the header value
+func splitLinkParams(v string) (map[string]string, string) {
+	params := map[string]string{}
+	inQuote := false
+	start := 0
+	add := func(param string) {
+		name, value, _ := strings.Cut(param, "=")
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			params[name] = strings.Trim(strings.TrimSpace(value), `"`)
+		}
+	}
+	for i := 0; i < len(v); i++ {
+		switch c := v[i]; {
+		case c == '"':
+			inQuote = !inQuote
+		case c == ';' && !inQuote:
+			add(v[start:i])
+			start = i + 1
+		case c == ',' && !inQuote:
+			add(v[start:i])
+			return params, v[i+1:]
+		}
+	}
+	add(v[start:])
+	return params, ""
+}
+
+// parseLinkMirrors returns the http(s) targets of rel=duplicate links
+// (RFC 6249) in header, resolved against base. They are ordered by pri;
+// among equal priorities, mirrors in country geo come first.
+func parseLinkMirrors(base *url.URL, header http.Header, geo string) []linkMirror {
+	var mirrors []linkMirror
+	for _, v := range header.Values("Link") {
+		for v != "" {
+			start := strings.IndexByte(v, '<')
+			end := strings.IndexByte(v, '>')
+			if start < 0 || end < start {
+				break
+			}
+			target := v[start+1 : end]
+			var params map[string]string
+			params, v = splitLinkParams(v[end+1:])
+
+			duplicate := false
+			for _, rel := range strings.Fields(strings.ToLower(params["rel"])) {
+				duplicate = duplicate || rel == "duplicate"
+			}
+			u, err := base.Parse(strings.TrimSpace(target))
+			if !duplicate || err != nil || u.Scheme != "http" && u.Scheme != "https" {
+				continue
+			}
+			m := linkMirror{URL: u.String(), Priority: defaultLinkPriority, Geo: strings.ToLower(params["geo"])}
+			if pri, err := strconv.Atoi(params["pri"]); err == nil && pri > 0 {
+				m.Priority = pri
+			}
+			mirrors = append(mirrors, m)
+		}
+	}
+
+	geo = strings.ToLower(geo)
+	sort.SliceStable(mirrors, func(i, j int) bool {
+		if mirrors[i].Priority != mirrors[j].Priority {
+			return mirrors[i].Priority < mirrors[j].Priority
+		}
+		return geo != "" && mirrors[i].Geo == geo && mirrors[j].Geo != geo
+	})
+	return mirrors
+}
+
+// mirrorAllowed applies the redirect policy to a duplicate, which is a
+// redirect the server suggests rather than makes
+func mirrorAllowed(config *Config, origin, mirror *url.URL) bool {
+	if config.NoDowngrade && origin.Scheme == "https" && mirror.Scheme == "http" {
+		return false
+	}
+	host := mirror.Hostname()
+	return len(config.RedirectAllow) == 0 || host == origin.Hostname() || redirectAllowed(host, config.RedirectAllow)
+}
+
+// discoverMirrors records the duplicates advertised in the first response to
+// a GET request. config.mirrors then holds config.URL followed by them.
+func discoverMirrors(config *Config, resp *http.Response) {
+	if config.mirrors != nil || config.Method != "" && config.Method != http.MethodGet {
+		return
+	}
+	config.mirrors = []string{config.URL}
+	origin := resp.Request.URL
+	for _, m := range parseLinkMirrors(origin, resp.Header, config.Geo) {
+		u, _ := url.Parse(m.URL)
+		if m.URL == origin.String() || !mirrorAllowed(config, origin, u) {
+			continue
+		}
+		config.mirrors = append(config.mirrors, m.URL)
+		if config.Verbose && !config.Quiet {
+			fmt.Printf("Mirror: %s (pri %d, geo %q)\n", redactQuery(m.URL), m.Priority, m.Geo)
+		}
+	}
+}
+
+// digestAlgorithms maps RFC 3230 digest names to verifyChecksum's
+var digestAlgorithms = map[string]string{"md5": "md5", "sha": "sha1", "sha-256": "sha256", "sha-512": "sha512"}
+
+// parseDigest returns the strongest supported digest in the Digest header
+// (RFC 3230) as an algorithm and hex value, or empty strings
+func parseDigest(header http.Header) (algorithm, sum string) {
+	for _, v := range header.Values("Digest") {
+		for _, item := range strings.Split(v, ",") {
+			name, value, ok := strings.Cut(strings.TrimSpace(item), "=")
+			alg := digestAlgorithms[strings.ToLower(name)]
+			if !ok || alg == "" || checksumStrength[alg] <= checksumStrength[algorithm] {
+				continue
+			}
+			raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+			if err != nil || len(raw) != newChecksumHash(alg).Size() {
+				continue
+			}
+			algorithm, sum = alg, hex.EncodeToString(raw)
+		}
+	}
+	return algorithm, sum
+}
+
+// serverDigest is the checksum a server published in its Digest header
+type serverDigest struct {
+	Algorithm string // as for Config.ChecksumAlg
+	Sum       string // hex
+}
+
+// useDigest records the server's Digest header. It is verified after the
+// download in addition to any checksum given on the command line, so server
+// data never replaces what the user asked for.
+func useDigest(config *Config, resp *http.Response) {
+	if config.digest != nil || resp.Uncompressed || resp.Header.Get("Content-Encoding") != "" {
+		return
+	}
+	if alg, sum := parseDigest(resp.Header); alg != "" {
+		config.digest = &serverDigest{Algorithm: alg, Sum: sum}
+		if config.Verbose && !config.Quiet {
+			fmt.Printf("Server sent a %s digest\n", alg)
+		}
+	}
+}
+
+// switchMirror moves a failed download on to the next advertised duplicate,
+// continuing from what is already on disk. It reports whether there was one.
+func switchMirror(config *Config, err error) bool {
+	if len(config.mirrors) < 2 {
+		return false
+	}
+	// Errors that are permanent here are permanent on a duplicate too, except
+	// that one mirror may not have the file (yet)
+	var httpErr *HTTPError
+	missing := errors.As(err, &httpErr) && (httpErr.StatusCode == http.StatusNotFound || httpErr.StatusCode == http.StatusGone)
+	if isNonRetryableError(err) && !missing {
+		return false
+	}
+	next := 0
+	for i, m := range config.mirrors {
+		if m == config.URL {
+			next = (i + 1) % len(config.mirrors)
+		}
+	}
+	config.URL = config.mirrors[next]
+	if fi, statErr := os.Stat(config.FilePath); config.FilePath != "" && statErr == nil && fi.Size() > 0 {
+		config.Resume = true
+	}
+	if !config.Quiet {
+		fmt.Printf("Switching to mirror %s\n", redactQuery(config.URL))
+	}
+	config.Events.Emit("mirror", map[string]interface{}{
+		"url":    redactQuery(config.URL),
+		"reason": err.Error(),
+	})
+	return true
+}
+
+// downloadHTTPSegments downloads an http(s) URL over config.Segments parallel
+// ranged requests, spread over the server's duplicates. It reports false,
+// without downloading, when a HEAD request shows that the server cannot
+// serve ranges, so the caller can fall back to a single request.
+func downloadHTTPSegments(ctx context.Context, config *Config) (bool, error) {
+	head, err := http.NewRequestWithContext(ctx, http.MethodHead, config.URL, nil)
+	if err != nil {
+		return true, err
+	}
+	applyHeaders(config, head)
+	resp, err := doRequest(config, httpClient(config), head)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.ContentLength <= 0 || resp.Header.Get("Accept-Ranges") != "bytes" {
+		return false, nil
+	}
+	if err := checkETag(config, resp); err != nil {
+		return true, err
+	}
+	discoverMirrors(config, resp)
+	useDigest(config, resp)
+
+	if config.FilePath == "" {
+		config.FilePath = extractFilename(resp, resp.Request.URL.String())
+	}
+	if !config.Quiet {
+		fmt.Printf("Downloading to: %s\n", config.FilePath)
+	}
+	config.Events.Emit("start", map[string]interface{}{
+		"url":       config.URL,
+		"final_url": redactQuery(resp.Request.URL.String()),
+		"redirects": redirectChain(resp),
+		"path":      config.FilePath,
+		"status":    resp.StatusCode,
+		"headers":   resp.Header,
+		"size":      resp.ContentLength,
+		"segments":  config.Segments,
+		"mirrors":   len(config.mirrors),
+	})
+
+	// Segments go to the mirrors in turn, falling back to the others if
+	// one fails
+	urls := config.mirrors
+	if len(urls) == 0 {
+		urls = []string{config.URL}
+	}
+	var turn uint32
+	return true, downloadSegments(ctx, config, config.FilePath, resp.ContentLength, config.etag, config.Segments,
+		func(ctx context.Context, start, end int64) (io.ReadCloser, error) {
+			first := int(atomic.AddUint32(&turn, 1) - 1)
+			var lastErr error
+			for i := range urls {
+				body, err := openRange(ctx, config, urls[(first+i)%len(urls)], start, end)
+				if err == nil {
+					return body, nil
+				}
+				if ctx.Err() != nil {
+					return nil, err
+				}
+				lastErr = err
+			}
+			return nil, lastErr
+		})
+}
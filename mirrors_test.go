@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseLinkMirrors(t *testing.T) {
+	base, _ := url.Parse("https://download.example.org/pub/distro.iso")
+	tests := []struct {
+		name  string
+		links []string
+		geo   string
+		want  []linkMirror
+	}{
+		{
+			name:  "ordered by pri",
+			links: []string{`<https://b.example.net/distro.iso>; rel=duplicate; pri=2, <https://a.example.net/distro.iso>; rel=duplicate; pri=1`},
+			want: []linkMirror{
+				{URL: "https://a.example.net/distro.iso", Priority: 1},
+				{URL: "https://b.example.net/distro.iso", Priority: 2},
+			},
+		},
+		{
+			name: "geo breaks ties",
+			links: []string{
+				`<http://us.example.net/distro.iso>; rel=duplicate; pri=1; geo=us`,
+				`<http://de.example.net/distro.iso>; rel="duplicate"; pri=1; geo=DE`,
+			},
+			geo: "de",
+			want: []linkMirror{
+				{URL: "http://de.example.net/distro.iso", Priority: 1, Geo: "de"},
+				{URL: "http://us.example.net/distro.iso", Priority: 1, Geo: "us"},
+			},
+		},
+		{
+			name:  "relative targets and missing pri",
+			links: []string{`</mirror/distro.iso>; rel=duplicate, <//cdn.example.net/distro.iso>; rel=duplicate; pri=5`},
+			want: []linkMirror{
+				{URL: "https://cdn.example.net/distro.iso", Priority: 5},
+				{URL: "https://download.example.org/mirror/distro.iso", Priority: defaultLinkPriority},
+			},
+		},
+		{
+			name: "other relations, schemes and bad pri are skipped or ignored",
+			links: []string{
+				`<https://example.net/distro.iso.meta4>; rel=describedby; type="application/metalink4+xml"`,
+				`<ftp://ftp.example.net/distro.iso>; rel=duplicate`,
+				`<https://x.example.net/distro.iso>; rel="alternate duplicate"; pri=-3`,
+			},
+			want: []linkMirror{{URL: "https://x.example.net/distro.iso", Priority: defaultLinkPriority}},
+		},
+		{
+			name:  "commas and semicolons inside quotes",
+			links: []string{`<https://a.example.net/d.iso>; title="a, b; c"; rel=duplicate; pri=3, <https://b.example.net/d.iso>; rel=duplicate; pri=4`},
+			want: []linkMirror{
+				{URL: "https://a.example.net/d.iso", Priority: 3},
+				{URL: "https://b.example.net/d.iso", Priority: 4},
+			},
+		},
+		{
+			name:  "malformed",
+			links: []string{`https://a.example.net/d.iso; rel=duplicate`, `>broken<; rel=duplicate`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{"Link": tt.links}
+			if got := parseLinkMirrors(base, header, tt.geo); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseLinkMirrors = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseDigest(t *testing.T) {
+	sum := sha256.Sum256([]byte("hello"))
+	sha256B64 := base64.StdEncoding.EncodeToString(sum[:])
+	md5B64 := "XUFAKrxLKna5cZ2REBfFkg==" // MD5 of "hello"
+	tests := []struct {
+		name            string
+		values          []string
+		algorithm, want string
+	}{
+		{"sha-256", []string{"SHA-256=" + sha256B64}, "sha256", hex.EncodeToString(sum[:])},
+		{"md5", []string{"md5=" + md5B64}, "md5", "5d41402abc4b2a76b9719d911017c592"},
+		{"strongest wins", []string{"MD5=" + md5B64 + ", SHA-256=" + sha256B64}, "sha256", hex.EncodeToString(sum[:])},
+		{"strongest across headers", []string{"sha-256=" + sha256B64, "md5=" + md5B64}, "sha256", hex.EncodeToString(sum[:])},
+		{"wrong length", []string{"SHA-256=" + md5B64}, "", ""},
+		{"bad base64", []string{"SHA-256=not*base64"}, "", ""},
+		{"unknown algorithm", []string{"UNIXsum=30637"}, "", ""},
+		{"none", nil, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alg, got := parseDigest(http.Header{"Digest": tt.values})
+			if alg != tt.algorithm || got != tt.want {
+				t.Errorf("parseDigest = %q, %q; want %q, %q", alg, got, tt.algorithm, tt.want)
+			}
+		})
+	}
+}
+
+func TestSwitchMirror(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"server error", &HTTPError{StatusCode: 503, Status: "503 Service Unavailable"}, true},
+		{"network error", &net.OpError{Op: "dial", Err: errors.New("connection refused")}, true},
+		{"not found", &HTTPError{StatusCode: 404, Status: "404 Not Found"}, true},
+		{"gone", fmt.Errorf("mirror: %w", &HTTPError{StatusCode: 410, Status: "410 Gone"}), true},
+		{"forbidden", &HTTPError{StatusCode: 403, Status: "403 Forbidden"}, false},
+		{"unauthorized", &HTTPError{StatusCode: 401, Status: "401 Unauthorized"}, false},
+		{"checksum", &ChecksumError{Algorithm: "sha256", Expected: "aa", Actual: "bb"}, false},
+		{"changed", &RemoteChangedError{OldETag: `"a"`, NewETag: `"b"`}, false},
+		{"usage", &UsageError{errors.New("bad flag")}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{
+				URL:     "https://a.example.net/d.iso",
+				Quiet:   true,
+				mirrors: []string{"https://a.example.net/d.iso", "https://b.example.net/d.iso"},
+			}
+			if got := switchMirror(config, tt.err); got != tt.want {
+				t.Fatalf("switchMirror(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+			want := "https://a.example.net/d.iso"
+			if tt.want {
+				want = "https://b.example.net/d.iso"
+			}
+			if config.URL != want {
+				t.Errorf("URL = %s, want %s", config.URL, want)
+			}
+		})
+	}
+
+	config := &Config{URL: "https://a.example.net/d.iso", Quiet: true}
+	if switchMirror(config, &HTTPError{StatusCode: 503}) {
+		t.Error("switched without mirrors")
+	}
+}
+
+// digestFileServer serves body with the given Digest header, ignoring Range
+// requests so a resume has to start over
+func digestFileServer(body, digest string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Digest", digest)
+		fmt.Fprint(w, body)
+	}))
+}
+
+func TestServerDigestIsAnExtraCheck(t *testing.T) {
+	body := "release contents\n"
+	sum := sha256.Sum256([]byte(body))
+	good := "SHA-256=" + base64.StdEncoding.EncodeToString(sum[:])
+	wrong := sha256.Sum256([]byte("tampered"))
+	bad := "SHA-256=" + base64.StdEncoding.EncodeToString(wrong[:])
+
+	tests := []struct {
+		name     string
+		digest   string
+		checksum string // -sha256
+		resume   bool   // a partial file the server will not resume
+		ok       bool
+	}{
+		{"matching digest", good, "", false, true},
+		{"mismatching digest", bad, "", false, false},
+		{"checksum and matching digest", good, hex.EncodeToString(sum[:]), false, true},
+		{"checksum does not hide a mismatching digest", bad, hex.EncodeToString(sum[:]), false, false},
+		{"digest kept when the download starts over", bad, "", true, false},
+		{"digest checked when the download starts over", good, "", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := digestFileServer(body, tt.digest)
+			defer srv.Close()
+			path := filepath.Join(t.TempDir(), "release.txt")
+			if tt.resume {
+				if err := ioutil.WriteFile(path, []byte("old"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			config := &Config{URL: srv.URL + "/release.txt", FilePath: path, Quiet: true, Resume: tt.resume}
+			if tt.checksum != "" {
+				config.Checksum, config.ChecksumAlg = tt.checksum, "sha256"
+			}
+
+			err := downloadWithRetry(context.Background(), config)
+			var checksumErr *ChecksumError
+			if tt.ok && err != nil {
+				t.Fatal(err)
+			}
+			if !tt.ok && !errors.As(err, &checksumErr) {
+				t.Fatalf("downloadWithRetry = %v, want a ChecksumError", err)
+			}
+			// The user's checksum is never replaced by the server's
+			if config.Checksum != tt.checksum {
+				t.Errorf("Checksum = %q, want %q", config.Checksum, tt.checksum)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// netrcMachine is one "machine" (or "default") entry of a .netrc file
+type netrcMachine struct {
+	Name     string // empty for the default entry
+	Login    string
+	Password string
+}
+
+// defaultNetrcPath returns $NETRC or ~/.netrc (~/_netrc on Windows)
+func defaultNetrcPath() string {
+	if path := os.Getenv("NETRC"); path != "" {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	name := ".netrc"
+	if runtime.GOOS == "windows" {
+		name = "_netrc"
+	}
+	return filepath.Join(home, name)
+}
+
+// parseNetrc parses the contents of a .netrc file. Macro definitions are
+// skipped and comments start with '#'.
+func parseNetrc(data string) []netrcMachine {
+	var machines []netrcMachine
+	var current *netrcMachine
+
+	lines := strings.Split(data, "\n")
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		if idx := strings.Index(line, "#"); idx >= 0 {
+			line = line[:idx]
+		}
+		fields := strings.Fields(line)
+		for j := 0; j < len(fields); j++ {
+			next := func() string {
+				if j+1 < len(fields) {
+					j++
+					return fields[j]
+				}
+				return ""
+			}
+			switch fields[j] {
+			case "machine":
+				machines = append(machines, netrcMachine{Name: next()})
+				current = &machines[len(machines)-1]
+			case "default":
+				machines = append(machines, netrcMachine{})
+				current = &machines[len(machines)-1]
+			case "login":
+				if current != nil {
+					current.Login = next()
+				} else {
+					next()
+				}
+			case "password":
+				if current != nil {
+					current.Password = next()
+				} else {
+					next()
+				}
+			case "account":
+				next()
+			case "macdef":
+				// A macro body runs until the next empty line
+				for i+1 < len(lines) && strings.TrimSpace(lines[i+1]) != "" {
+					i++
+				}
+				j = len(fields)
+			}
+		}
+	}
+	return machines
+}
+
+// lookupNetrc returns the login and password for host from the .netrc file at
+// path, falling back to the default entry
+func lookupNetrc(path, host string) (login, password string, ok bool) {
+	if path == "" {
+		return "", "", false
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", "", false
+	}
+
+	var fallback *netrcMachine
+	machines := parseNetrc(string(data))
+	for i := range machines {
+		m := &machines[i]
+		if m.Name == "" {
+			if fallback == nil {
+				fallback = m
+			}
+			continue
+		}
+		if strings.EqualFold(m.Name, host) {
+			return m.Login, m.Password, true
+		}
+	}
+	if fallback != nil {
+		return fallback.Login, fallback.Password, true
+	}
+	return "", "", false
+}
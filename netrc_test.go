@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseNetrc(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want []netrcMachine
+	}{
+		{
+			name: "one line",
+			data: "machine example.com login alice password secret",
+			want: []netrcMachine{{Name: "example.com", Login: "alice", Password: "secret"}},
+		},
+		{
+			name: "one token per line",
+			data: "machine example.com\n  login alice\n  password secret\n",
+			want: []netrcMachine{{Name: "example.com", Login: "alice", Password: "secret"}},
+		},
+		{
+			name: "several machines and default",
+			data: "machine a.example.com login a password pa\nmachine b.example.com login b password pb\ndefault login anon password guest\n",
+			want: []netrcMachine{
+				{Name: "a.example.com", Login: "a", Password: "pa"},
+				{Name: "b.example.com", Login: "b", Password: "pb"},
+				{Login: "anon", Password: "guest"},
+			},
+		},
+		{
+			name: "account is skipped",
+			data: "machine example.com login alice account acct password secret",
+			want: []netrcMachine{{Name: "example.com", Login: "alice", Password: "secret"}},
+		},
+		{
+			name: "comments",
+			data: "# work\nmachine example.com login alice # the CI user\npassword secret\n",
+			want: []netrcMachine{{Name: "example.com", Login: "alice", Password: "secret"}},
+		},
+		{
+			name: "macro body",
+			data: "macdef init\ncd /pub\nmachine hidden login x password y\n\nmachine example.com login alice password secret\n",
+			want: []netrcMachine{{Name: "example.com", Login: "alice", Password: "secret"}},
+		},
+		{
+			name: "tokens before any machine",
+			data: "login stray password stray\nmachine example.com login alice",
+			want: []netrcMachine{{Name: "example.com", Login: "alice"}},
+		},
+		{
+			name: "truncated",
+			data: "machine example.com login",
+			want: []netrcMachine{{Name: "example.com"}},
+		},
+		{
+			name: "empty",
+			data: "",
+			want: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseNetrc(tt.data); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseNetrc = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLookupNetrc(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "netrc")
+	data := "machine files.example.com login alice password a1\n" +
+		"default login anon password guest\n" +
+		"machine other.example.com login bob password b2\n"
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host, login, password string
+		ok                    bool
+	}{
+		{"files.example.com", "alice", "a1", true},
+		{"FILES.example.com", "alice", "a1", true},
+		{"other.example.com", "bob", "b2", true},
+		{"unknown.example.com", "anon", "guest", true},
+	}
+	for _, tt := range tests {
+		login, password, ok := lookupNetrc(path, tt.host)
+		if login != tt.login || password != tt.password || ok != tt.ok {
+			t.Errorf("lookupNetrc(%s) = %q, %q, %v; want %q, %q, %v", tt.host, login, password, ok, tt.login, tt.password, tt.ok)
+		}
+	}
+
+	if _, _, ok := lookupNetrc(filepath.Join(t.TempDir(), "missing"), "files.example.com"); ok {
+		t.Error("lookupNetrc found credentials in a missing file")
+	}
+	if _, _, ok := lookupNetrc("", "files.example.com"); ok {
+		t.Error("lookupNetrc found credentials with no file")
+	}
+}
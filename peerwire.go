@@ -0,0 +1,509 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Peer wire message IDs (BEP 3, and BEP 10 for extended messages)
+const (
+	msgChoke byte = iota
+	msgUnchoke
+	msgInterested
+	msgNotInterested
+	msgHave
+	msgBitfield
+	msgRequest
+	msgPiece
+	msgCancel
+	msgExtended byte = 20
+)
+
+const (
+	protocolName    = "BitTorrent protocol"
+	maxMessageSize  = 1 << 20 // bitfields of very large torrents are the longest messages
+	maxRequestSize  = 128 << 10
+	pipelineDepth   = 16 // outstanding block requests per peer
+	peerIdleTimeout = 3 * time.Minute
+	keepAlivePeriod = 90 * time.Second
+	utMetadataID    = 1 // the extended message ID we assign to ut_metadata (BEP 9)
+)
+
+// peerMessage is one length-prefixed message; keep-alives are not delivered
+type peerMessage struct {
+	id      byte
+	payload []byte
+}
+
+// peerConn is a connection to one peer. Its state belongs to the goroutine
+// running run; other goroutines only use notifyHave.
+type peerConn struct {
+	s          *swarm
+	conn       net.Conn
+	addr       string
+	r          io.Reader
+	w          *bufio.Writer
+	extensions bool     // the peer supports BEP 10 extended messages
+	have       chan int // pieces to announce with HAVE
+
+	peerChoking    bool
+	peerInterested bool
+	amChoking      bool
+	amInterested   bool
+	bits           bitfield
+	utMetadata     int // the peer's ID for ut_metadata, 0 if unsupported
+	metaRequested  bool
+	piece          *pieceDownload
+	inflight       int
+	lastWrite      time.Time
+}
+
+// handshakePeer exchanges handshakes: an outgoing connection sends first, an
+// incoming one first checks that the peer wants our torrent
+func handshakePeer(ctx context.Context, s *swarm, conn net.Conn, addr string, outgoing bool) (*peerConn, error) {
+	timeout := s.config.Timeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	ours := make([]byte, 0, 68)
+	ours = append(ours, byte(len(protocolName)))
+	ours = append(ours, protocolName...)
+	reserved := make([]byte, 8)
+	reserved[5] |= 0x10 // extension protocol
+	ours = append(ours, reserved...)
+	ours = append(ours, s.meta.InfoHash[:]...)
+	ours = append(ours, s.peerID[:]...)
+
+	if outgoing {
+		if _, err := conn.Write(ours); err != nil {
+			return nil, err
+		}
+	}
+	theirs := make([]byte, 68)
+	if _, err := io.ReadFull(conn, theirs); err != nil {
+		return nil, err
+	}
+	if theirs[0] != byte(len(protocolName)) || string(theirs[1:20]) != protocolName {
+		return nil, errors.New("not a BitTorrent peer")
+	}
+	if !bytes.Equal(theirs[28:48], s.meta.InfoHash[:]) {
+		return nil, errors.New("peer serves another torrent")
+	}
+	if bytes.Equal(theirs[48:68], s.peerID[:]) {
+		return nil, errors.New("connected to ourselves")
+	}
+	if !outgoing {
+		if _, err := conn.Write(ours); err != nil {
+			return nil, err
+		}
+	}
+	conn.SetDeadline(time.Time{})
+
+	return &peerConn{
+		s:           s,
+		conn:        conn,
+		addr:        addr,
+		r:           bufio.NewReaderSize(limitReader(ctx, s.config, conn), 64<<10),
+		w:           bufio.NewWriterSize(conn, 64<<10),
+		extensions:  theirs[25]&0x10 != 0,
+		have:        make(chan int, 1024),
+		peerChoking: true,
+		amChoking:   true,
+		lastWrite:   time.Now(),
+	}, nil
+}
+
+// notifyHave queues a HAVE for piece i. If the peer is too far behind the
+// announcement is dropped, which only costs it an opportunity.
+func (p *peerConn) notifyHave(i int) {
+	select {
+	case p.have <- i:
+	default:
+	}
+}
+
+// send queues a message; write errors surface in flush
+func (p *peerConn) send(id byte, payload ...[]byte) {
+	n := 1
+	for _, b := range payload {
+		n += len(b)
+	}
+	var hdr [5]byte
+	binary.BigEndian.PutUint32(hdr[:], uint32(n))
+	hdr[4] = id
+	p.w.Write(hdr[:])
+	for _, b := range payload {
+		p.w.Write(b)
+	}
+	p.lastWrite = time.Now()
+}
+
+func (p *peerConn) flush() error {
+	p.conn.SetWriteDeadline(time.Now().Add(peerIdleTimeout))
+	return p.w.Flush()
+}
+
+// uint32s encodes the integer fields of HAVE, REQUEST and PIECE messages
+func uint32s(values ...int) []byte {
+	b := make([]byte, 4*len(values))
+	for i, v := range values {
+		binary.BigEndian.PutUint32(b[4*i:], uint32(v))
+	}
+	return b
+}
+
+// readLoop delivers messages to msgs until the connection fails or quit
+// is closed
+func (p *peerConn) readLoop(msgs chan<- peerMessage, quit <-chan struct{}) error {
+	var lenBuf [4]byte
+	for {
+		p.conn.SetReadDeadline(time.Now().Add(peerIdleTimeout))
+		if _, err := io.ReadFull(p.r, lenBuf[:]); err != nil {
+			return err
+		}
+		n := binary.BigEndian.Uint32(lenBuf[:])
+		if n == 0 {
+			continue // keep-alive
+		}
+		if n > maxMessageSize {
+			return fmt.Errorf("message of %d bytes is too large", n)
+		}
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(p.r, buf); err != nil {
+			return err
+		}
+		select {
+		case msgs <- peerMessage{id: buf[0], payload: buf[1:]}:
+		case <-quit:
+			return nil
+		}
+	}
+}
+
+// run exchanges messages with the peer until the connection fails, the peer
+// misbehaves or ctx is done
+func (p *peerConn) run(ctx context.Context) error {
+	msgs := make(chan peerMessage, 32)
+	readErr := make(chan error, 1)
+	quit := make(chan struct{})
+	defer close(quit)
+	go func() { readErr <- p.readLoop(msgs, quit) }()
+
+	if p.extensions {
+		p.sendExtendedHandshake()
+	}
+	infoReady := p.s.infoReady
+	select {
+	case <-infoReady:
+		infoReady = nil
+		p.sendBitfield()
+	default:
+	}
+
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		if err := p.update(); err != nil {
+			return err
+		}
+		if err := p.flush(); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-readErr:
+			return err
+		case m := <-msgs:
+			if err := p.handle(m); err != nil {
+				return err
+			}
+		case i := <-p.have:
+			p.send(msgHave, uint32s(i))
+		case <-infoReady:
+			infoReady = nil
+			p.sendBitfield()
+		case <-ticker.C:
+			if time.Since(p.lastWrite) > keepAlivePeriod {
+				p.w.Write([]byte{0, 0, 0, 0})
+				p.lastWrite = time.Now()
+			}
+		}
+	}
+}
+
+// sendBitfield announces the pieces we have, if any
+func (p *peerConn) sendBitfield() {
+	p.s.mu.Lock()
+	bits := append(bitfield(nil), p.s.have...)
+	p.s.mu.Unlock()
+	for _, b := range bits {
+		if b != 0 {
+			p.send(msgBitfield, bits)
+			return
+		}
+	}
+}
+
+// handle processes one message from the peer
+func (p *peerConn) handle(m peerMessage) error {
+	switch m.id {
+	case msgChoke:
+		p.peerChoking = true
+		// The peer discards our outstanding requests
+		if p.piece != nil {
+			for b := range p.piece.requested {
+				p.piece.requested[b] = p.piece.received[b]
+			}
+		}
+		p.inflight = 0
+	case msgUnchoke:
+		p.peerChoking = false
+	case msgInterested:
+		p.peerInterested = true
+		// Everyone connected may download from us; -max-peers bounds the cost
+		if p.amChoking {
+			p.amChoking = false
+			p.send(msgUnchoke)
+		}
+	case msgNotInterested:
+		p.peerInterested = false
+	case msgHave:
+		if len(m.payload) != 4 {
+			return errors.New("invalid HAVE message")
+		}
+		i := int(binary.BigEndian.Uint32(m.payload))
+		if info := p.s.getInfo(); (info != nil && i >= len(info.Pieces)) || i >= 8*maxMessageSize {
+			return fmt.Errorf("HAVE for unknown piece %d", i)
+		}
+		p.bits = p.bits.set(i)
+	case msgBitfield:
+		if info := p.s.getInfo(); info != nil && len(m.payload) != (len(info.Pieces)+7)/8 {
+			return errors.New("bitfield has the wrong length")
+		}
+		p.bits = bitfield(m.payload)
+	case msgRequest:
+		if len(m.payload) != 12 {
+			return errors.New("invalid REQUEST message")
+		}
+		return p.serve(int(binary.BigEndian.Uint32(m.payload)), int(binary.BigEndian.Uint32(m.payload[4:])), int(binary.BigEndian.Uint32(m.payload[8:])))
+	case msgPiece:
+		if len(m.payload) < 8 {
+			return errors.New("invalid PIECE message")
+		}
+		return p.receive(int(binary.BigEndian.Uint32(m.payload)), int(binary.BigEndian.Uint32(m.payload[4:])), m.payload[8:])
+	case msgExtended:
+		return p.handleExtended(m.payload)
+	}
+	// CANCEL needs no handling since requests are answered immediately
+	return nil
+}
+
+// serve uploads a block the peer requested
+func (p *peerConn) serve(index, begin, length int) error {
+	info := p.s.getInfo()
+	if info == nil || p.amChoking || length <= 0 || length > maxRequestSize || index >= len(info.Pieces) ||
+		begin < 0 || int64(begin+length) > info.pieceSize(index) || !p.s.hasPiece(index) {
+		return nil
+	}
+	block := make([]byte, length)
+	if err := p.s.storage.ReadAt(block, int64(index)*info.PieceLength+int64(begin)); err != nil {
+		return err
+	}
+	p.send(msgPiece, uint32s(index, begin), block)
+	atomic.AddInt64(&p.s.uploaded, int64(length))
+	return nil
+}
+
+// receive stores a block of the piece being downloaded
+func (p *peerConn) receive(index, begin int, block []byte) error {
+	pd := p.piece
+	if pd == nil || index != pd.index || begin%blockSize != 0 || begin >= len(pd.data) {
+		return nil // late reply to a request we gave up on
+	}
+	b := begin / blockSize
+	want := len(pd.data) - begin
+	if want > blockSize {
+		want = blockSize
+	}
+	if pd.received[b] || len(block) != want {
+		return nil
+	}
+	copy(pd.data[begin:], block)
+	pd.received[b] = true
+	pd.requested[b] = true
+	pd.missing--
+	if p.inflight > 0 {
+		p.inflight--
+	}
+	p.s.received(pd, len(block))
+	if pd.missing > 0 {
+		return nil
+	}
+
+	p.piece = nil
+	p.inflight = 0
+	err := p.s.finishPiece(p.addr, pd)
+	if errors.Is(err, errBadPiece) {
+		p.s.mu.Lock()
+		bad := p.s.bad[p.addr]
+		p.s.mu.Unlock()
+		if bad < 3 {
+			return nil
+		}
+	}
+	return err
+}
+
+// update expresses interest, picks a piece and keeps requests in flight
+func (p *peerConn) update() error {
+	if p.s.getInfo() == nil {
+		p.requestMetadata()
+		return nil
+	}
+	select {
+	case <-p.s.done:
+		if p.piece != nil {
+			p.s.release(p.piece)
+			p.piece = nil
+		}
+		if p.amInterested {
+			p.amInterested = false
+			p.send(msgNotInterested)
+		}
+		return nil
+	default:
+	}
+
+	if p.piece == nil {
+		if !p.amInterested {
+			if p.s.needs(p.bits) {
+				p.amInterested = true
+				p.send(msgInterested)
+			}
+			return nil
+		}
+		if p.peerChoking {
+			return nil
+		}
+		if p.piece = p.s.pick(p.bits); p.piece == nil {
+			p.amInterested = false
+			p.send(msgNotInterested)
+			return nil
+		}
+	}
+	if p.peerChoking {
+		return nil
+	}
+
+	pd := p.piece
+	for b := range pd.requested {
+		if p.inflight >= pipelineDepth {
+			break
+		}
+		if pd.requested[b] {
+			continue
+		}
+		length := len(pd.data) - b*blockSize
+		if length > blockSize {
+			length = blockSize
+		}
+		p.send(msgRequest, uint32s(pd.index, b*blockSize, length))
+		pd.requested[b] = true
+		p.inflight++
+	}
+	return nil
+}
+
+// sendExtended sends a BEP 10 extended message with a bencoded dictionary
+// and optional trailing data
+func (p *peerConn) sendExtended(id int, d map[string]interface{}, data []byte) {
+	p.send(msgExtended, []byte{byte(id)}, bencode(d), data)
+}
+
+func (p *peerConn) sendExtendedHandshake() {
+	d := map[string]interface{}{
+		"m": map[string]interface{}{"ut_metadata": utMetadataID},
+		"p": p.s.port,
+		"v": "dl",
+	}
+	p.s.mu.Lock()
+	if p.s.infoBytes != nil {
+		d["metadata_size"] = len(p.s.infoBytes)
+	}
+	p.s.mu.Unlock()
+	p.sendExtended(0, d, nil)
+}
+
+// handleExtended processes the extended handshake and ut_metadata messages
+func (p *peerConn) handleExtended(payload []byte) error {
+	if len(payload) < 1 {
+		return errors.New("invalid extended message")
+	}
+	v, n, err := bdecodePrefix(payload[1:])
+	if err != nil {
+		return err
+	}
+	d, _ := v.(map[string]interface{})
+	data := payload[1+n:]
+
+	switch payload[0] {
+	case 0:
+		p.utMetadata = int(bint(bdict(d, "m"), "ut_metadata"))
+		if size := bint(d, "metadata_size"); size > 0 {
+			p.s.setMetadataSize(int(size))
+		}
+	case utMetadataID:
+		piece := int(bint(d, "piece"))
+		switch bint(d, "msg_type") {
+		case 0: // request
+			if p.utMetadata == 0 {
+				return nil
+			}
+			p.s.mu.Lock()
+			raw := p.s.infoBytes
+			p.s.mu.Unlock()
+			if raw == nil || piece < 0 || piece*blockSize >= len(raw) {
+				p.sendExtended(p.utMetadata, map[string]interface{}{"msg_type": 2, "piece": piece}, nil)
+				return nil
+			}
+			end := (piece + 1) * blockSize
+			if end > len(raw) {
+				end = len(raw)
+			}
+			p.sendExtended(p.utMetadata, map[string]interface{}{"msg_type": 1, "piece": piece, "total_size": len(raw)}, raw[piece*blockSize:end])
+		case 1: // data
+			atomic.StoreInt64(&p.s.lastData, time.Now().UnixNano())
+			p.s.metadataPiece(piece, append([]byte(nil), data...))
+		}
+	}
+	return nil
+}
+
+// requestMetadata asks a peer supporting ut_metadata for the whole info
+// dictionary of a magnet link
+func (p *peerConn) requestMetadata() {
+	if p.utMetadata == 0 || p.metaRequested {
+		return
+	}
+	p.s.mu.Lock()
+	pieces := len(p.s.metadata)
+	p.s.mu.Unlock()
+	if pieces == 0 {
+		return
+	}
+	p.metaRequested = true
+	for i := 0; i < pieces; i++ {
+		p.sendExtended(p.utMetadata, map[string]interface{}{"msg_type": 0, "piece": i}, nil)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// ProxyError reports a failure to reach the destination through a proxy,
+// either because the proxy could not be contacted or because it refused the
+// CONNECT (or, for plain HTTP proxies, the request itself).
+type ProxyError struct {
+	Proxy      string // proxy URL with credentials removed
+	StatusCode int    // status returned by the proxy, if any
+	Status     string
+	Err        error
+}
+
+func (e *ProxyError) Error() string {
+	if e.StatusCode != 0 {
+		return fmt.Sprintf("proxy %s refused connection: %s", e.Proxy, e.Status)
+	}
+	return fmt.Sprintf("proxy %s: %v", e.Proxy, e.Err)
+}
+
+func (e *ProxyError) Unwrap() error { return e.Err }
+
+// parseProxyURL validates a proxy URL, defaulting to http:// when no scheme is given
+func parseProxyURL(raw string) (*url.URL, error) {
+	if !strings.Contains(raw, "://") {
+		raw = "http://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q (use http, https, socks5 or socks5h)", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy URL %q: missing host", raw)
+	}
+	return u, nil
+}
+
+// getenvAny returns the first non-empty environment variable from names
+func getenvAny(names ...string) string {
+	for _, name := range names {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// proxyFunc returns the Transport.Proxy function for config. An explicit
+// -proxy wins over HTTP_PROXY, HTTPS_PROXY and ALL_PROXY, and the NO_PROXY
+// list (or -noproxy) is honored in every case.
+func proxyFunc(config *Config) func(*http.Request) (*url.URL, error) {
+	noProxy := config.NoProxy
+	if noProxy == "" {
+		noProxy = getenvAny("NO_PROXY", "no_proxy")
+	}
+
+	return func(req *http.Request) (*url.URL, error) {
+		// A Unix socket is a local connection; proxies do not apply
+		if config.Dial.UnixSocket != "" {
+			return nil, nil
+		}
+		raw := config.Proxy
+		if raw == "" {
+			if req.URL.Scheme == "https" {
+				raw = getenvAny("HTTPS_PROXY", "https_proxy")
+			} else {
+				// Lower case only: HTTP_PROXY may be injected by CGI environments
+				raw = os.Getenv("http_proxy")
+				if raw == "" {
+					raw = os.Getenv("HTTP_PROXY")
+				}
+			}
+			if raw == "" {
+				raw = getenvAny("ALL_PROXY", "all_proxy")
+			}
+		}
+		if raw == "" || bypassProxy(req.URL, noProxy) {
+			return nil, nil
+		}
+		return parseProxyURL(raw)
+	}
+}
+
+// bypassProxy reports whether u matches the NO_PROXY list. Entries are
+// separated by commas or spaces and may be "*", an IP address, a CIDR block,
+// or a domain that also matches its subdomains ("example.com", ".example.com"
+// and "*.example.com" are equivalent). A domain or IP may carry a ":port".
+func bypassProxy(u *url.URL, noProxy string) bool {
+	host := strings.ToLower(u.Hostname())
+	port := u.Port()
+	if port == "" {
+		if u.Scheme == "https" {
+			port = "443"
+		} else {
+			port = "80"
+		}
+	}
+	ip := net.ParseIP(host)
+
+	for _, entry := range strings.FieldsFunc(noProxy, func(r rune) bool { return r == ',' || r == ' ' }) {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "*" {
+			return true
+		}
+		if _, cidr, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && cidr.Contains(ip) {
+				return true
+			}
+			continue
+		}
+
+		entryHost, entryPort := entry, ""
+		if h, p, err := net.SplitHostPort(entry); err == nil {
+			entryHost, entryPort = h, p
+		}
+		if entryPort != "" && entryPort != port {
+			continue
+		}
+		entryHost = strings.Trim(entryHost, "[]")
+		if entryIP := net.ParseIP(entryHost); entryIP != nil {
+			if ip != nil && entryIP.Equal(ip) {
+				return true
+			}
+			continue
+		}
+
+		entryHost = strings.TrimPrefix(strings.TrimPrefix(entryHost, "*"), ".")
+		if entryHost != "" && (host == entryHost || strings.HasSuffix(host, "."+entryHost)) {
+			return true
+		}
+	}
+	return false
+}
+
+// onProxyConnectResponse turns a refused CONNECT into a ProxyError
+func onProxyConnectResponse(ctx context.Context, proxyURL *url.URL, connectReq *http.Request, connectRes *http.Response) error {
+	if connectRes.StatusCode == http.StatusOK {
+		return nil
+	}
+	return &ProxyError{
+		Proxy:      redactURL(proxyURL),
+		StatusCode: connectRes.StatusCode,
+		Status:     connectRes.Status,
+	}
+}
+
+// asProxyError classifies an error from the transport as a proxy failure when
+// it happened while dialing or negotiating with the proxy
+func asProxyError(req *http.Request, proxy func(*http.Request) (*url.URL, error), err error) error {
+	var proxyErr *ProxyError
+	if errors.As(err, &proxyErr) {
+		return err
+	}
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || (opErr.Op != "proxyconnect" && !strings.HasPrefix(opErr.Op, "socks")) {
+		return err
+	}
+	proxyURL, _ := proxy(req)
+	return &ProxyError{Proxy: redactURL(proxyURL), Err: err}
+}
+
+// redactURL renders u without its password, for messages
+func redactURL(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+	return u.Redacted()
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket shared by every reader that transfers data,
+// so the limit applies to the whole process rather than to each connection.
+// The bucket holds at most one second worth of tokens.
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second, 0 means unlimited
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter creates a limiter allowing rate bytes per second
+func NewRateLimiter(rate int64) *RateLimiter {
+	return &RateLimiter{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// Rate returns the current limit in bytes per second
+func (l *RateLimiter) Rate() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int64(l.rate)
+}
+
+// SetRate changes the limit while transfers are running. Zero disables limiting.
+func (l *RateLimiter) SetRate(rate int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(time.Now())
+	l.rate = float64(rate)
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+}
+
+// refill adds the tokens accumulated since the last call. Caller holds mu.
+func (l *RateLimiter) refill(now time.Time) {
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+}
+
+// WaitN blocks until n bytes may be transferred or ctx is done. The bucket
+// may go into debt so that large reads are paid for by waiting rather than by
+// starving others.
+func (l *RateLimiter) WaitN(ctx context.Context, n int) error {
+	l.mu.Lock()
+	if l.rate <= 0 {
+		l.mu.Unlock()
+		return nil
+	}
+	l.refill(time.Now())
+	l.tokens -= float64(n)
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// chunkSize returns how many bytes a single read may take so that waits stay short
+func (l *RateLimiter) chunkSize() int {
+	rate := l.Rate()
+	if rate <= 0 {
+		return 0
+	}
+	chunk := int(rate / 10)
+	if chunk < 512 {
+		chunk = 512
+	}
+	return chunk
+}
+
+// rateLimitedReader throttles reads from r through a shared RateLimiter
+type rateLimitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *RateLimiter
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	if chunk := r.limiter.chunkSize(); chunk > 0 && len(p) > chunk {
+		p = p[:chunk]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if waitErr := r.limiter.WaitN(r.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+// limitReader wraps r with the configured rate limiter, if any. Waiting for
+// the limiter stops when ctx is done.
+func limitReader(ctx context.Context, config *Config, r io.Reader) io.Reader {
+	if config.RateLimit == nil {
+		return r
+	}
+	return &rateLimitedReader{ctx: ctx, r: r, limiter: config.RateLimit}
+}
+
+// parseByteSize parses sizes such as "500K", "5M" or "1.5G" (powers of 1024)
+func parseByteSize(s string) (int64, error) {
+	s = strings.TrimSpace(strings.ToUpper(s))
+	s = strings.TrimSuffix(s, "B")
+	multiplier := float64(1)
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		}
+		if multiplier > 1 {
+			s = s[:len(s)-1]
+		}
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || !(v >= 0) {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	// float64(math.MaxInt64) rounds up to 2^63, which int64 cannot hold
+	if v*multiplier >= math.MaxInt64 {
+		return 0, fmt.Errorf("size %q is too large", s)
+	}
+	return int64(v * multiplier), nil
+}
+
+// formatByteSize renders a byte rate for messages, e.g. "5.0M"
+func formatByteSize(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1fG", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fM", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fK", float64(n)/(1<<10))
+	}
+	return strconv.FormatInt(n, 10)
+}
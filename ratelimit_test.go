@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterWaitNStopsOnCancel(t *testing.T) {
+	l := NewRateLimiter(100)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+
+	// 10 KiB at 100 B/s would otherwise wait for about 100 seconds
+	start := time.Now()
+	if err := l.WaitN(ctx, 10<<10); err != context.Canceled {
+		t.Fatalf("WaitN = %v, want context.Canceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("WaitN returned after %v", elapsed)
+	}
+}
+
+func TestRateLimiterUnlimited(t *testing.T) {
+	l := NewRateLimiter(0)
+	if err := l.WaitN(context.Background(), 1<<30); err != nil {
+		t.Fatalf("WaitN = %v", err)
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+		ok   bool
+	}{
+		{"500", 500, true},
+		{"500K", 500 << 10, true},
+		{"5M", 5 << 20, true},
+		{"1.5G", 3 << 29, true},
+		{"2mb", 2 << 20, true},
+		{"", 0, false},
+		{"-1K", 0, false},
+		{"fast", 0, false},
+		{"NaN", 0, false},
+		{"Inf", 0, false},
+		{"1e20G", 0, false},
+		{"8589934591G", 8589934591 << 30, true},
+		{"9223372036854775808", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := parseByteSize(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseByteSize(%q) = %d, %v; want %d, ok %v", tt.in, got, err, tt.want, tt.ok)
+		}
+	}
+}
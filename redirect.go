@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// defaultMaxRedirects matches the limit of Go's default redirect policy
+const defaultMaxRedirects = 10
+
+// RedirectError is returned when a redirect violates the configured policy
+type RedirectError struct {
+	From   string
+	To     string
+	Reason string
+}
+
+func (e *RedirectError) Error() string {
+	return fmt.Sprintf("redirect from %s to %s refused: %s", e.From, e.To, e.Reason)
+}
+
+// redirectHop is one step of a redirect chain
+type redirectHop struct {
+	URL    string `json:"url"`
+	Status int    `json:"status"`
+}
+
+// redirectAllowed reports whether host is in the -redirect-allow list. Each
+// entry matches the host itself and its subdomains.
+func redirectAllowed(host string, allow []string) bool {
+	host = strings.ToLower(host)
+	for _, entry := range allow {
+		entry = strings.TrimPrefix(strings.ToLower(entry), ".")
+		if host == entry || strings.HasSuffix(host, "."+entry) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRedirect returns the http.Client redirect policy for config
+func checkRedirect(config *Config) func(*http.Request, []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		prev := via[len(via)-1]
+		from, to := redactQuery(prev.URL.String()), redactQuery(req.URL.String())
+
+		if len(via) > config.MaxRedirects {
+			return &RedirectError{From: from, To: to, Reason: fmt.Sprintf("more than %d redirects", config.MaxRedirects)}
+		}
+		if config.NoDowngrade && prev.URL.Scheme == "https" && req.URL.Scheme == "http" {
+			return &RedirectError{From: from, To: to, Reason: "HTTPS to HTTP downgrade"}
+		}
+		// Redirects within the original host are always allowed
+		host := req.URL.Hostname()
+		if len(config.RedirectAllow) > 0 && host != via[0].URL.Hostname() && !redirectAllowed(host, config.RedirectAllow) {
+			return &RedirectError{From: from, To: to, Reason: "host not in -redirect-allow"}
+		}
+
+		status := 0
+		if req.Response != nil {
+			status = req.Response.StatusCode
+		}
+		if config.Verbose && !config.Quiet {
+			fmt.Printf("Redirect %d: %s -> %s\n", status, from, to)
+		}
+		return nil
+	}
+}
+
+// redirectChain reconstructs the redirects that led to resp, oldest first,
+// ending with the final URL. It returns nil when there were no redirects.
+func redirectChain(resp *http.Response) []redirectHop {
+	if resp.Request == nil || resp.Request.Response == nil {
+		return nil
+	}
+	chain := []redirectHop{{URL: redactQuery(resp.Request.URL.String()), Status: resp.StatusCode}}
+	for r := resp.Request; r.Response != nil; r = r.Response.Request {
+		prev := r.Response.Request
+		chain = append([]redirectHop{{URL: redactQuery(prev.URL.String()), Status: r.Response.StatusCode}}, chain...)
+	}
+	return chain
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRedirectAllowed(t *testing.T) {
+	allow := []string{"example.com", ".cdn.example.net"}
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"example.com", true},
+		{"EXAMPLE.com", true},
+		{"dl.example.com", true},
+		{"cdn.example.net", true},
+		{"a.b.cdn.example.net", true},
+		{"badexample.com", false},
+		{"example.com.evil.org", false},
+		{"example.net", false},
+	}
+	for _, tt := range tests {
+		if got := redirectAllowed(tt.host, allow); got != tt.want {
+			t.Errorf("redirectAllowed(%s) = %v, want %v", tt.host, got, tt.want)
+		}
+	}
+}
+
+// hopServer redirects /hop/N to /hop/N-1 and serves the file at /hop/0
+func hopServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/hop/"))
+		if n > 0 {
+			http.Redirect(w, r, fmt.Sprintf("/hop/%d?sig=secret", n-1), http.StatusFound)
+			return
+		}
+		fmt.Fprint(w, "landed")
+	}))
+}
+
+func TestRedirectPolicy(t *testing.T) {
+	srv := hopServer()
+	defer srv.Close()
+	// The same server under another host name
+	other := strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)
+	away := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, other+"/hop/0", http.StatusMovedPermanently)
+	}))
+	defer away.Close()
+	secure := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, srv.URL+"/hop/0", http.StatusFound)
+	}))
+	defer secure.Close()
+
+	tests := []struct {
+		name   string
+		url    string
+		config Config
+		reason string // "" when the redirects are followed
+	}{
+		{"within the limit", srv.URL + "/hop/3", Config{MaxRedirects: 3}, ""},
+		{"over the limit", srv.URL + "/hop/4", Config{MaxRedirects: 3}, "more than 3 redirects"},
+		{"downgrade allowed", secure.URL, Config{MaxRedirects: 10}, ""},
+		{"downgrade refused", secure.URL, Config{MaxRedirects: 10, NoDowngrade: true}, "HTTPS to HTTP downgrade"},
+		{"host allowed", away.URL, Config{MaxRedirects: 10, RedirectAllow: []string{"localhost"}}, ""},
+		{"host not allowed", away.URL, Config{MaxRedirects: 10, RedirectAllow: []string{"example.com"}}, "host not in -redirect-allow"},
+		{"same host always allowed", srv.URL + "/hop/1", Config{MaxRedirects: 10, RedirectAllow: []string{"example.com"}}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := tt.config
+			config.URL = tt.url
+			config.FilePath = filepath.Join(t.TempDir(), "file")
+			config.Quiet = true
+			config.TLS = &tls.Config{InsecureSkipVerify: true}
+			err := downloadWithRetry(context.Background(), &config)
+			if tt.reason == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			var redirectErr *RedirectError
+			if !errors.As(err, &redirectErr) || redirectErr.Reason != tt.reason {
+				t.Fatalf("download = %v, want a RedirectError for %s", err, tt.reason)
+			}
+			if strings.Contains(err.Error(), "secret") {
+				t.Errorf("error shows the query: %v", err)
+			}
+		})
+	}
+}
+
+func TestRedirectChainEvent(t *testing.T) {
+	srv := hopServer()
+	defer srv.Close()
+	var events bytes.Buffer
+	config := &Config{
+		URL:          srv.URL + "/hop/2",
+		FilePath:     filepath.Join(t.TempDir(), "file"),
+		MaxRedirects: 10,
+		Quiet:        true,
+		Events:       NewEventLog(&events),
+	}
+	if err := downloadWithRetry(context.Background(), config); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range readEvents(t, &events) {
+		if e["event"] != "start" {
+			continue
+		}
+		got := fmt.Sprint(e["redirects"])
+		want := fmt.Sprintf("[map[status:302 url:%[1]s/hop/2] map[status:302 url:%[1]s/hop/1] map[status:200 url:%[1]s/hop/0]]", srv.URL)
+		if got != want {
+			t.Errorf("redirects = %s\nwant %s", got, want)
+		}
+		if e["final_url"] != srv.URL+"/hop/0" {
+			t.Errorf("final_url = %v", e["final_url"])
+		}
+		return
+	}
+	t.Fatal("no start event")
+}
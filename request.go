@@ -0,0 +1,150 @@
+package main
+
+import (
+	"DLError"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// headerList collects repeatable -H "Name: value" flags
+type headerList []string
+
+func (h *headerList) String() string { return strings.Join(*h, ", ") }
+
+func (h *headerList) Set(value string) error {
+	if !strings.Contains(value, ":") {
+		return fmt.Errorf("invalid header %q, expected 'Name: value'", value)
+	}
+	*h = append(*h, value)
+	return nil
+}
+
+// Header parses the collected flags into an http.Header
+func (h headerList) Header() http.Header {
+	header := http.Header{}
+	for _, line := range h {
+		parts := strings.SplitN(line, ":", 2)
+		name := http.CanonicalHeaderKey(strings.TrimSpace(parts[0]))
+		header.Add(name, strings.TrimSpace(parts[1]))
+	}
+	return header
+}
+
+// readRequestBody resolves the -d argument: "@file" reads a file, "@-" reads
+// stdin, and anything else is sent as is
+func readRequestBody(data string) ([]byte, error) {
+	if !strings.HasPrefix(data, "@") {
+		return []byte(data), nil
+	}
+	name := data[1:]
+	if name == "-" {
+		return ioutil.ReadAll(os.Stdin)
+	}
+	return ioutil.ReadFile(name)
+}
+
+// newRequest builds a request for config.URL with the configured method, body
+// and headers. It is called for every attempt, so each one gets a fresh body.
+func newRequest(ctx context.Context, config *Config) (*http.Request, error) {
+	method := config.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	var body io.Reader
+	if config.Body != nil {
+		body = bytes.NewReader(config.Body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, config.URL, body)
+	if err != nil {
+		return nil, DLError.New("Creating request error", err)
+	}
+
+	if isFormBody(config.Body) {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	applyHeaders(config, req)
+	return req, nil
+}
+
+// isFormBody reports whether body reads as key=value pairs joined by '&',
+// the only kind of -d body given a default Content-Type. JSON and other
+// documents are sent without one unless -H sets it.
+func isFormBody(body []byte) bool {
+	if len(body) == 0 {
+		return false
+	}
+	for _, pair := range strings.Split(string(body), "&") {
+		key, _, ok := strings.Cut(pair, "=")
+		if !ok || key == "" || strings.ContainsAny(key, " \t\r\n{}\"':,") {
+			return false
+		}
+	}
+	return true
+}
+
+// applyHeaders sets the User-Agent and the -H headers on req
+func applyHeaders(config *Config, req *http.Request) {
+	if config.UserAgent != "" {
+		req.Header.Set("User-Agent", config.UserAgent)
+	}
+	// Headers from -H replace any default with the same name
+	for name, values := range config.Headers {
+		req.Header[name] = append([]string(nil), values...)
+		if name == "Host" {
+			req.Host = values[0]
+		}
+	}
+}
+
+// fetchDocument reads a small document such as a .torrent or Metalink file
+// from an http(s) or file:// config.URL
+func fetchDocument(ctx context.Context, config *Config, limit int64) ([]byte, error) {
+	if isFileURL(config.URL) {
+		path, err := fileURLPath(config.URL)
+		if err != nil {
+			return nil, &UsageError{err}
+		}
+		return ioutil.ReadFile(path)
+	}
+	req, err := newRequest(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := doRequest(config, httpClient(config), req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &HTTPError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, limit))
+}
+
+// openRange requests the inclusive byte range [start, end] of an http(s)
+// URL and returns the body of the 206 response
+func openRange(ctx context.Context, config *Config, rawURL string, start, end int64) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	applyHeaders(config, req)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	resp, err := doRequest(config, httpClient(config), req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, &HTTPError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	return resp.Body, nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestHeaderList(t *testing.T) {
+	var h headerList
+	for _, v := range []string{"x-token: abc", "Accept:application/json", "X-Token: def", "Host: api.internal"} {
+		if err := h.Set(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := h.Set("no colon"); err == nil {
+		t.Error("Set accepted a header without a colon")
+	}
+	want := http.Header{
+		"X-Token": {"abc", "def"},
+		"Accept":  {"application/json"},
+		"Host":    {"api.internal"},
+	}
+	if got := h.Header(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Header() = %v, want %v", got, want)
+	}
+}
+
+func TestReadRequestBody(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "query.json")
+	if err := ioutil.WriteFile(path, []byte(`{"q":1}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := readRequestBody("@" + path); err != nil || string(got) != `{"q":1}` {
+		t.Errorf("readRequestBody(@file) = %q, %v", got, err)
+	}
+	if got, err := readRequestBody("a=1"); err != nil || string(got) != "a=1" {
+		t.Errorf("readRequestBody(a=1) = %q, %v", got, err)
+	}
+	if _, err := readRequestBody("@" + path + ".missing"); err == nil {
+		t.Error("readRequestBody read a missing file")
+	}
+}
+
+func TestIsFormBody(t *testing.T) {
+	tests := []struct {
+		body string
+		want bool
+	}{
+		{"name=dl&version=2", true},
+		{"q=", true},
+		{"ids[]=1&ids[]=2", true},
+		{"a=b%20c&d=e+f", true},
+		{"", false},
+		{`{"name":"dl"}`, false},
+		{`{"q":"a=b"}`, false},
+		{`[1,2]`, false},
+		{"plain text", false},
+		{"a=1&b", false},
+		{"=1", false},
+		{"key: value=1", false},
+	}
+	for _, tt := range tests {
+		if got := isFormBody([]byte(tt.body)); got != tt.want {
+			t.Errorf("isFormBody(%q) = %v, want %v", tt.body, got, tt.want)
+		}
+	}
+}
+
+func TestRequestOptions(t *testing.T) {
+	type seen struct {
+		method, contentType, agent, token, body string
+	}
+	tests := []struct {
+		name    string
+		config  Config
+		want    seen
+		headers []string
+	}{
+		{
+			name:   "plain GET",
+			config: Config{},
+			want:   seen{method: "GET"},
+		},
+		{
+			name:   "form body",
+			config: Config{Method: "POST", Body: []byte("a=1&b=2")},
+			want:   seen{method: "POST", contentType: "application/x-www-form-urlencoded", body: "a=1&b=2"},
+		},
+		{
+			name:   "JSON body has no default type",
+			config: Config{Method: "POST", Body: []byte(`{"a":1}`)},
+			want:   seen{method: "POST", body: `{"a":1}`},
+		},
+		{
+			name:    "headers replace defaults",
+			config:  Config{Method: "PUT", Body: []byte("a=1"), UserAgent: "dl-test/1"},
+			headers: []string{"Content-Type: text/csv", "X-Token: t1"},
+			want:    seen{method: "PUT", contentType: "text/csv", agent: "dl-test/1", token: "t1", body: "a=1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got seen
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := ioutil.ReadAll(r.Body)
+				got = seen{r.Method, r.Header.Get("Content-Type"), r.Header.Get("User-Agent"), r.Header.Get("X-Token"), string(body)}
+				w.Write([]byte("ok"))
+			}))
+			defer srv.Close()
+
+			var h headerList
+			for _, v := range tt.headers {
+				h.Set(v)
+			}
+			config := tt.config
+			config.URL = srv.URL + "/export"
+			config.FilePath = filepath.Join(t.TempDir(), "export")
+			config.Headers = h.Header()
+			config.Quiet = true
+			if err := downloadWithRetry(context.Background(), &config); err != nil {
+				t.Fatal(err)
+			}
+			if tt.want.agent == "" {
+				got.agent = ""
+			}
+			if got != tt.want {
+				t.Errorf("server saw %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// emptySHA256 is the hex SHA-256 of an empty payload, sent with GET and HEAD
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// S3Options are the S3 related command line settings
+type S3Options struct {
+	Endpoint  string // e.g. http://127.0.0.1:9000 for MinIO; empty for AWS
+	Region    string // default from AWS_REGION, AWS_DEFAULT_REGION or the profile
+	Profile   string // default from AWS_PROFILE, otherwise "default"
+	PathStyle bool   // address buckets as endpoint/bucket/key instead of bucket.endpoint/key
+}
+
+// awsCredentials sign S3 requests
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// S3Client resolves s3:// URLs and signs requests to the endpoint
+type S3Client struct {
+	creds     awsCredentials
+	region    string
+	endpoint  *url.URL
+	pathStyle bool
+}
+
+// isS3URL reports whether raw is an s3:// URL
+func isS3URL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && u.Scheme == "s3"
+}
+
+// readINI parses an AWS style INI file into sections of key/value pairs
+func readINI(file string) (map[string]map[string]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sections := map[string]map[string]string{}
+	var current map[string]string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			name := strings.TrimSpace(line[1 : len(line)-1])
+			current = map[string]string{}
+			sections[name] = current
+			continue
+		}
+		if current == nil {
+			continue
+		}
+		if i := strings.Index(line, "="); i > 0 {
+			current[strings.TrimSpace(line[:i])] = strings.TrimSpace(line[i+1:])
+		}
+	}
+	return sections, scanner.Err()
+}
+
+// awsFile returns the path of an AWS CLI file, honoring its override variable
+func awsFile(envName, name string) string {
+	if file := os.Getenv(envName); file != "" {
+		return file
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".aws", name)
+}
+
+// NewS3Client loads credentials from AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY
+// or the shared credentials file, and the region from the environment or
+// the shared config file
+func NewS3Client(opts S3Options) (*S3Client, error) {
+	profile := opts.Profile
+	if profile == "" {
+		profile = getenvAny("AWS_PROFILE")
+	}
+	if profile == "" {
+		profile = "default"
+	}
+
+	c := &S3Client{region: opts.Region, pathStyle: opts.PathStyle}
+	if opts.Profile == "" && os.Getenv("AWS_ACCESS_KEY_ID") != "" {
+		c.creds = awsCredentials{
+			AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}
+	} else {
+		file := awsFile("AWS_SHARED_CREDENTIALS_FILE", "credentials")
+		sections, err := readINI(file)
+		if err != nil {
+			return nil, fmt.Errorf("no AWS credentials in the environment and cannot read %s: %w", file, err)
+		}
+		section, ok := sections[profile]
+		if !ok {
+			return nil, fmt.Errorf("AWS profile %q not found in %s", profile, file)
+		}
+		c.creds = awsCredentials{
+			AccessKeyID:     section["aws_access_key_id"],
+			SecretAccessKey: section["aws_secret_access_key"],
+			SessionToken:    section["aws_session_token"],
+		}
+	}
+	if c.creds.AccessKeyID == "" || c.creds.SecretAccessKey == "" {
+		return nil, errors.New("AWS access key ID and secret access key are required")
+	}
+
+	if c.region == "" {
+		c.region = getenvAny("AWS_REGION", "AWS_DEFAULT_REGION")
+	}
+	if c.region == "" {
+		// The config file names profiles other than the default "profile <name>"
+		name := "profile " + profile
+		if profile == "default" {
+			name = "default"
+		}
+		if sections, err := readINI(awsFile("AWS_CONFIG_FILE", "config")); err == nil {
+			c.region = sections[name]["region"]
+		}
+	}
+	if c.region == "" {
+		c.region = "us-east-1"
+	}
+
+	endpoint := opts.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + c.region + ".amazonaws.com"
+	} else {
+		// Stand-ins such as MinIO usually only support path-style addressing
+		c.pathStyle = true
+	}
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid -s3-endpoint %q", opts.Endpoint)
+	}
+	c.endpoint = u
+	return c, nil
+}
+
+// awsURIEncode escapes s as SigV4 requires: everything but unreserved
+// characters, optionally keeping '/'
+func awsURIEncode(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		switch {
+		case 'A' <= ch && ch <= 'Z', 'a' <= ch && ch <= 'z', '0' <= ch && ch <= '9',
+			ch == '-', ch == '_', ch == '.', ch == '~', ch == '/' && keepSlash:
+			b.WriteByte(ch)
+		default:
+			fmt.Fprintf(&b, "%%%02X", ch)
+		}
+	}
+	return b.String()
+}
+
+// ObjectURL maps s3://bucket/key to the endpoint URL of the object. Bucket
+// names with dots use path-style addressing, since they break TLS wildcards.
+func (c *S3Client) ObjectURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	bucket, key := u.Host, strings.TrimPrefix(u.Path, "/")
+	if bucket == "" || key == "" {
+		return nil, fmt.Errorf("invalid S3 URL %q, expected s3://bucket/key", raw)
+	}
+
+	target := *c.endpoint
+	prefix := strings.TrimSuffix(c.endpoint.Path, "/")
+	if c.pathStyle || strings.Contains(bucket, ".") {
+		prefix += "/" + bucket
+	} else {
+		target.Host = bucket + "." + target.Host
+	}
+	target.Path = prefix + "/" + key
+	target.RawPath = awsURIEncode(target.Path, true)
+	return &target, nil
+}
+
+// hmacSHA256 returns HMAC-SHA256(key, data)
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// sign adds AWS Signature Version 4 headers to req, which must not have a body
+func (c *S3Client) sign(req *http.Request, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", emptySHA256)
+	if c.creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.creds.SessionToken)
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") || name == "range" {
+			headers[name] = strings.Join(strings.Fields(strings.Join(values, ",")), " ")
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	query := req.URL.Query()
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var params []string
+	for _, key := range keys {
+		values := append([]string(nil), query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			params = append(params, awsURIEncode(key, false)+"="+awsURIEncode(value, false))
+		}
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		awsURIEncode(req.URL.Path, true),
+		strings.Join(params, "&"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		emptySHA256,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := day + "/" + c.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+c.creds.SecretAccessKey), day)
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// s3Transport signs every request to the S3 endpoint just before it is sent,
+// so retries, resumes and ranged requests each get a fresh signature
+type s3Transport struct {
+	base http.RoundTripper
+	s3   *S3Client
+}
+
+func (t *s3Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := strings.ToLower(req.URL.Hostname())
+	endpoint := strings.ToLower(t.s3.endpoint.Hostname())
+	if host != endpoint && !strings.HasSuffix(host, "."+endpoint) {
+		return t.base.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	// Ask for the object's stored checksums so the download can be verified
+	req.Header.Set("X-Amz-Checksum-Mode", "ENABLED")
+	t.s3.sign(req, time.Now())
+	return t.base.RoundTrip(req)
+}
+
+// s3ObjectCheck is a digest S3 reports for an object
+type s3ObjectCheck struct {
+	name   string // header the value came from
+	hash   func() hash.Hash
+	base64 bool
+	want   string
+}
+
+// s3ObjectChecks collects the digests in an object's response headers that
+// describe the whole object: the x-amz-checksum-* values and, for objects
+// not uploaded in parts, the MD5 ETag. Composite checksums ("...-N") cover
+// parts rather than the object and are skipped.
+func s3ObjectChecks(header http.Header) []s3ObjectCheck {
+	var checks []s3ObjectCheck
+	add := func(name string, h func() hash.Hash) {
+		if v := header.Get(name); v != "" && !strings.Contains(v, "-") {
+			checks = append(checks, s3ObjectCheck{name: name, hash: h, base64: true, want: v})
+		}
+	}
+	add("X-Amz-Checksum-Sha256", sha256.New)
+	add("X-Amz-Checksum-Sha1", sha1.New)
+	add("X-Amz-Checksum-Crc32c", func() hash.Hash { return crc32.New(crc32.MakeTable(crc32.Castagnoli)) })
+	add("X-Amz-Checksum-Crc32", func() hash.Hash { return crc32.NewIEEE() })
+
+	// Objects encrypted with SSE-KMS or SSE-C have ETags that are not MD5s
+	etag := strings.Trim(header.Get("ETag"), `"`)
+	if header.Get("X-Amz-Server-Side-Encryption") != "aws:kms" &&
+		header.Get("X-Amz-Server-Side-Encryption-Customer-Algorithm") == "" &&
+		len(etag) == 32 && !strings.Contains(etag, "-") {
+		if _, err := hex.DecodeString(etag); err == nil {
+			checks = append(checks, s3ObjectCheck{name: "ETag", hash: md5.New, want: strings.ToLower(etag)})
+		}
+	}
+	return checks
+}
+
+// verifyS3Object checks filePath against the digests S3 reported
+func verifyS3Object(filePath string, checks []s3ObjectCheck) error {
+	for _, check := range checks {
+		f, err := os.Open(filePath)
+		if err != nil {
+			return fmt.Errorf("cannot open file for checksum: %w", err)
+		}
+		h := check.hash()
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("error reading file for checksum: %w", err)
+		}
+		actual := hex.EncodeToString(h.Sum(nil))
+		if check.base64 {
+			actual = base64.StdEncoding.EncodeToString(h.Sum(nil))
+		}
+		if actual != check.want {
+			return &ChecksumError{Algorithm: check.name, Expected: check.want, Actual: actual}
+		}
+	}
+	return nil
+}
+
+// downloadS3 fetches an s3:// URL. A HEAD request gives the size, ETag and
+// stored checksums; the object is then downloaded over the regular HTTP path,
+// or in parallel ranges with -segments, and verified against them.
+func downloadS3(ctx context.Context, config *Config) error {
+	// The client is only set up for an s3:// -url
+	if config.S3 == nil {
+		return &UsageError{fmt.Errorf("%s can only be downloaded as -url", redactQuery(config.URL))}
+	}
+	target, err := config.S3.ObjectURL(config.URL)
+	if err != nil {
+		return &UsageError{err}
+	}
+	client := httpClient(config)
+
+	head, err := http.NewRequestWithContext(ctx, http.MethodHead, target.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := doRequest(config, client, head)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &HTTPError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	if err := checkETag(config, resp); err != nil {
+		return err
+	}
+	// Segments compare against this copy; checkETag would store the first
+	// one seen from every worker when the HEAD response had none
+	etag := config.etag
+	checks := s3ObjectChecks(resp.Header)
+
+	if config.FilePath == "" {
+		config.FilePath = path.Base(target.Path)
+	}
+
+	if config.Segments > 1 && resp.ContentLength > 0 {
+		if !config.Quiet {
+			fmt.Printf("Downloading to: %s\n", config.FilePath)
+		}
+		config.Events.Emit("start", map[string]interface{}{
+			"url":      config.URL,
+			"path":     config.FilePath,
+			"status":   resp.StatusCode,
+			"headers":  resp.Header,
+			"size":     resp.ContentLength,
+			"segments": config.Segments,
+		})
+		err = downloadSegments(ctx, config, config.FilePath, resp.ContentLength, etag, config.Segments,
+			func(ctx context.Context, start, end int64) (io.ReadCloser, error) {
+				req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+				if err != nil {
+					return nil, err
+				}
+				req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+				resp, err := doRequest(config, client, req)
+				if err != nil {
+					return nil, err
+				}
+				if resp.StatusCode != http.StatusPartialContent {
+					resp.Body.Close()
+					return nil, &HTTPError{StatusCode: resp.StatusCode, Status: resp.Status}
+				}
+				if got := resp.Header.Get("ETag"); etag != "" && got != "" && got != etag {
+					resp.Body.Close()
+					return nil, &RemoteChangedError{OldETag: etag, NewETag: got}
+				}
+				return resp.Body, nil
+			})
+	} else {
+		object := *config
+		object.URL = target.String()
+		err = downloadFile(ctx, &object)
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(checks) > 0 && !config.Quiet {
+		fmt.Println("Verifying against S3 object checksums...")
+	}
+	return verifyS3Object(config.FilePath, checks)
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cheggaaa/pb"
+)
+
+// minSegmentSize keeps small files from being split into tiny requests
+const minSegmentSize = 1 << 20
+
+// segment is one byte range of a parallel download
+type segment struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`  // inclusive
+	Done  int64 `json:"done"` // bytes written so far, updated atomically
+}
+
+// segmentState is saved next to the output file as <file>.dlparts while a
+// parallel download is in progress, so retries and -r continue each segment
+// where it stopped
+type segmentState struct {
+	Size      int64      `json:"size"`
+	Validator string     `json:"validator"` // ETag or similar; a change discards the state
+	Segments  []*segment `json:"segments"`
+}
+
+// fetchRange opens the inclusive byte range [start, end] of the remote file
+type fetchRange func(ctx context.Context, start, end int64) (io.ReadCloser, error)
+
+// segmentStatePath returns where the state of a parallel download of filePath is kept
+func segmentStatePath(filePath string) string {
+	return filePath + ".dlparts"
+}
+
+// newSegmentState splits size bytes into at most n segments
+func newSegmentState(size int64, validator string, n int) *segmentState {
+	if max := int((size + minSegmentSize - 1) / minSegmentSize); n > max {
+		n = max
+	}
+	if n < 1 {
+		n = 1
+	}
+	state := &segmentState{Size: size, Validator: validator}
+	for i := 0; i < n; i++ {
+		start := size * int64(i) / int64(n)
+		end := size*int64(i+1)/int64(n) - 1
+		state.Segments = append(state.Segments, &segment{Start: start, End: end})
+	}
+	return state
+}
+
+// loadSegmentState returns the saved state for filePath if it describes the
+// same remote file and the partial output still exists
+func loadSegmentState(filePath string, size int64, validator string) *segmentState {
+	if _, err := os.Stat(filePath); err != nil {
+		return nil
+	}
+	data, err := ioutil.ReadFile(segmentStatePath(filePath))
+	if err != nil {
+		return nil
+	}
+	var state segmentState
+	if json.Unmarshal(data, &state) != nil || state.Size != size || state.Validator != validator {
+		return nil
+	}
+	return &state
+}
+
+// seed marks the first n bytes as written, as left by an earlier download
+// that fetched the file in one piece
+func (s *segmentState) seed(n int64) {
+	for _, seg := range s.Segments {
+		done := n - seg.Start
+		if length := seg.End - seg.Start + 1; done > length {
+			done = length
+		}
+		if done > 0 {
+			seg.Done = done
+		}
+	}
+}
+
+// save writes the state file. Segments may still be running.
+func (s *segmentState) save(filePath string) error {
+	snapshot := segmentState{Size: s.Size, Validator: s.Validator}
+	for _, seg := range s.Segments {
+		snapshot.Segments = append(snapshot.Segments, &segment{Start: seg.Start, End: seg.End, Done: atomic.LoadInt64(&seg.Done)})
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(segmentStatePath(filePath), data, 0666)
+}
+
+// completed returns the number of bytes already written
+func (s *segmentState) completed() int64 {
+	var n int64
+	for _, seg := range s.Segments {
+		n += atomic.LoadInt64(&seg.Done)
+	}
+	return n
+}
+
+// segmentWriter writes a segment's bytes at their place in the file
+type segmentWriter struct {
+	f   *os.File
+	seg *segment
+}
+
+func (w *segmentWriter) Write(p []byte) (int, error) {
+	n, err := w.f.WriteAt(p, w.seg.Start+atomic.LoadInt64(&w.seg.Done))
+	atomic.AddInt64(&w.seg.Done, int64(n))
+	return n, err
+}
+
+// downloadSegments downloads size bytes into filePath over n parallel ranged
+// requests. validator identifies the remote version; saved progress is only
+// reused while it stays the same. With -r and no saved progress, the bytes
+// already in filePath count as done. The progress bar, JSON progress events
+// and rate limit cover all segments together.
+func downloadSegments(ctx context.Context, config *Config, filePath string, size int64, validator string, n int, fetch fetchRange) error {
+	state := loadSegmentState(filePath, size, validator)
+	flags := os.O_WRONLY
+	if state == nil {
+		state = newSegmentState(size, validator, n)
+		flags |= os.O_CREATE | os.O_TRUNC
+		if config.Resume {
+			if local, err := os.Stat(filePath); err == nil && local.Size() > 0 {
+				if local.Size() > size {
+					return fmt.Errorf("resume failed: local file is larger than the remote file (%d > %d bytes)", local.Size(), size)
+				}
+				state.seed(local.Size())
+				flags &^= os.O_TRUNC
+			}
+		}
+	}
+	if state.completed() > 0 && !config.Quiet {
+		fmt.Println("Resuming download...")
+	}
+	f, err := os.OpenFile(filePath, flags, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := state.save(filePath); err != nil {
+		return err
+	}
+
+	offset := state.completed()
+	var read int64
+	stopEvents := startProgressEvents(config, func() int64 { return atomic.LoadInt64(&read) }, offset, size)
+	bar := newProgressBar(config, offset, size)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	for _, seg := range state.Segments {
+		if seg.Start+seg.Done > seg.End {
+			continue
+		}
+		wg.Add(1)
+		go func(seg *segment) {
+			defer wg.Done()
+			if err := fetchSegment(ctx, config, f, seg, fetch, &read, bar); err != nil {
+				once.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}(seg)
+	}
+
+	// Save progress regularly so a crash loses little
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for waiting := true; waiting; {
+		select {
+		case <-done:
+			waiting = false
+		case <-ticker.C:
+			state.save(filePath)
+		}
+	}
+
+	stopEvents()
+	if bar != nil {
+		bar.Finish()
+	}
+	if firstErr != nil {
+		state.save(filePath)
+		return firstErr
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Remove(segmentStatePath(filePath))
+}
+
+// fetchSegment downloads the rest of one segment
+func fetchSegment(ctx context.Context, config *Config, f *os.File, seg *segment, fetch fetchRange, read *int64, bar *pb.ProgressBar) error {
+	start := seg.Start + atomic.LoadInt64(&seg.Done)
+	body, err := fetch(ctx, start, seg.End)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	want := seg.End - start + 1
+	r := io.LimitReader(limitReader(ctx, config, body), want)
+	buf := make([]byte, 32*1024)
+	w := &segmentWriter{f: f, seg: seg}
+	var got int64
+	for {
+		n, rerr := r.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return err
+			}
+			got += int64(n)
+			atomic.AddInt64(read, int64(n))
+			if bar != nil {
+				bar.Add(n)
+			}
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			return rerr
+		}
+	}
+	if got != want {
+		return fmt.Errorf("segment %d-%d ended after %d of %d bytes: %w", seg.Start, seg.End, got, want, io.ErrUnexpectedEOF)
+	}
+	return nil
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SSHOptions are the SSH related command line settings
+type SSHOptions struct {
+	KeyFile    string // private key, default ~/.ssh/id_ed25519, id_ecdsa and id_rsa
+	KnownHosts string // known_hosts file, default ~/.ssh/known_hosts
+	Insecure   bool   // skip host key verification (-insecure)
+}
+
+// SSHError reports an SFTP failure that retrying will not fix: an unknown or
+// changed host key, rejected credentials, or a missing or unreadable file
+type SSHError struct {
+	Host   string
+	Reason string // "host key", "authentication", "not found" or "permission denied"
+	Err    error
+}
+
+func (e *SSHError) Error() string {
+	return fmt.Sprintf("SSH error on %s (%s): %v", e.Host, e.Reason, e.Err)
+}
+
+func (e *SSHError) Unwrap() error { return e.Err }
+
+// isSFTPURL reports whether raw is an sftp:// URL
+func isSFTPURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && u.Scheme == "sftp"
+}
+
+// sshHostKeyCallback checks host keys against known_hosts unless -insecure
+// is given
+func sshHostKeyCallback(opts SSHOptions) (ssh.HostKeyCallback, error) {
+	if opts.Insecure {
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+	file := opts.KnownHosts
+	if file == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		file = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	return knownhosts.New(file)
+}
+
+// sshAuthMethods offers the ssh-agent keys, then the private key files, and
+// finally a password from the URL or credential lookup. The agent connection,
+// if any, is returned so the caller can close it after the handshake. Default
+// key files that are missing or unusable are skipped, but a -ssh-key file must
+// load.
+func sshAuthMethods(opts SSHOptions, password string) ([]ssh.AuthMethod, io.Closer, error) {
+	var methods []ssh.AuthMethod
+	var agentConn io.Closer
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if conn, err := net.Dial("unix", sock); err == nil {
+			agentConn = conn
+			methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+
+	keyFiles := []string{opts.KeyFile}
+	if opts.KeyFile == "" {
+		keyFiles = nil
+		if home, err := os.UserHomeDir(); err == nil {
+			for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+				keyFiles = append(keyFiles, filepath.Join(home, ".ssh", name))
+			}
+		}
+	}
+	var signers []ssh.Signer
+	for _, file := range keyFiles {
+		pem, err := ioutil.ReadFile(file)
+		if err != nil {
+			if opts.KeyFile != "" {
+				return nil, agentConn, &UsageError{fmt.Errorf("cannot read -ssh-key %s: %w", file, err)}
+			}
+			continue
+		}
+		signer, err := ssh.ParsePrivateKey(pem)
+		if err == nil {
+			signers = append(signers, signer)
+			continue
+		}
+		// Encrypted keys are left to ssh-agent
+		var encrypted *ssh.PassphraseMissingError
+		if opts.KeyFile != "" && !(errors.As(err, &encrypted) && agentConn != nil) {
+			return nil, agentConn, &UsageError{fmt.Errorf("cannot use -ssh-key %s: %w", file, err)}
+		}
+	}
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+
+	if password != "" {
+		methods = append(methods, ssh.Password(password))
+	}
+	return methods, agentConn, nil
+}
+
+// sftpPath maps the URL path to a remote path. As with curl, "/~/" starts a
+// path relative to the home directory and anything else is absolute.
+func sftpPath(u *url.URL) string {
+	if strings.HasPrefix(u.Path, "/~/") {
+		return strings.TrimPrefix(u.Path, "/~/")
+	}
+	return u.Path
+}
+
+// asSSHError classifies errors that retrying will not fix
+func asSSHError(host string, err error) error {
+	var keyErr *knownhosts.KeyError
+	switch {
+	case errors.As(err, &keyErr):
+		if len(keyErr.Want) > 0 {
+			return &SSHError{Host: host, Reason: "host key", Err: fmt.Errorf("host key changed: %w", err)}
+		}
+		return &SSHError{Host: host, Reason: "host key", Err: fmt.Errorf("host not in known_hosts: %w", err)}
+	case strings.Contains(err.Error(), "unable to authenticate"):
+		return &SSHError{Host: host, Reason: "authentication", Err: err}
+	case errors.Is(err, os.ErrNotExist):
+		return &SSHError{Host: host, Reason: "not found", Err: err}
+	case errors.Is(err, os.ErrPermission):
+		return &SSHError{Host: host, Reason: "permission denied", Err: err}
+	}
+	return err
+}
+
+// dialSFTP opens an SSH connection to u and starts the SFTP subsystem
+func dialSFTP(ctx context.Context, config *Config, u *url.URL) (*sftp.Client, error) {
+	host := u.Hostname()
+	port := u.Port()
+	if port == "" {
+		port = "22"
+	}
+
+	user, password := "", ""
+	if u.User != nil {
+		user = u.User.Username()
+		password, _ = u.User.Password()
+	} else {
+		creds, err := config.Credentials.Lookup(u)
+		if err != nil {
+			return nil, err
+		}
+		if creds != nil {
+			user, password = creds.Username, creds.Password
+		}
+	}
+	if user == "" {
+		user = getenvAny("USER", "USERNAME")
+	}
+
+	hostKeyCallback, err := sshHostKeyCallback(config.SSH)
+	if err != nil {
+		return nil, &UsageError{fmt.Errorf("cannot read known_hosts: %w", err)}
+	}
+	auth, agentConn, err := sshAuthMethods(config.SSH, password)
+	if agentConn != nil {
+		// The agent is only asked for signatures during the handshake
+		defer agentConn.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	sshConfig := &ssh.ClientConfig{
+		User:            user,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         config.Timeout,
+	}
+
+	addr := net.JoinHostPort(host, port)
+	conn, err := newDialContext(config)(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	// Unblock the handshake if interrupted
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Unix(1, 0)) })
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, sshConfig)
+	stop()
+	if err != nil {
+		conn.Close()
+		return nil, asSSHError(host, err)
+	}
+	client, err := sftp.NewClient(ssh.NewClient(sshConn, chans, reqs))
+	if err != nil {
+		sshConn.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// downloadSFTP retrieves an sftp:// URL, seeking past the partial file when
+// resuming. The remote modification time is applied to the file.
+func downloadSFTP(ctx context.Context, config *Config) error {
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return err
+	}
+	remotePath := sftpPath(u)
+	if remotePath == "" || strings.HasSuffix(remotePath, "/") {
+		return &UsageError{fmt.Errorf("SFTP URL %s does not name a file", redactURL(u))}
+	}
+
+	if config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.Timeout)
+		defer cancel()
+	}
+
+	client, err := dialSFTP(ctx, config, u)
+	if err != nil {
+		return timeoutError(ctx, err)
+	}
+	defer client.Close()
+	stop := context.AfterFunc(ctx, func() { client.Close() })
+	defer stop()
+
+	remote, err := client.Open(remotePath)
+	if err != nil {
+		return timeoutError(ctx, asSSHError(u.Hostname(), err))
+	}
+	defer remote.Close()
+	fi, err := remote.Stat()
+	if err != nil {
+		return timeoutError(ctx, asSSHError(u.Hostname(), err))
+	}
+	size := fi.Size()
+
+	filePath := config.FilePath
+	if filePath == "" {
+		filePath = path.Base(remotePath)
+		config.FilePath = filePath
+	}
+
+	offset := int64(0)
+	if config.Resume {
+		if local, err := os.Stat(filePath); err == nil {
+			offset = local.Size()
+		}
+	}
+	if offset > size {
+		return fmt.Errorf("resume failed: local file is larger than the remote file (%d > %d bytes)", offset, size)
+	}
+	if offset > 0 {
+		if _, err := remote.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		if !config.Quiet {
+			fmt.Println("Resuming download...")
+		}
+	}
+
+	var f *os.File
+	if offset > 0 {
+		f, err = os.OpenFile(filePath, os.O_APPEND|os.O_WRONLY, 0666)
+	} else {
+		f, err = os.Create(filePath)
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if !config.Quiet {
+		fmt.Printf("Downloading to: %s\n", filePath)
+	}
+	config.Events.Emit("start", map[string]interface{}{
+		"url":    redactURL(u),
+		"path":   filePath,
+		"size":   size,
+		"offset": offset,
+		"mtime":  fi.ModTime().UTC().Format(time.RFC3339),
+	})
+
+	// Large reads let the client keep several requests in flight
+	body := bufio.NewReaderSize(remote, 1<<20)
+	if err := copyBody(ctx, config, f, body, offset, size); err != nil {
+		return timeoutError(ctx, err)
+	}
+	if err := ctx.Err(); err != nil {
+		return timeoutError(ctx, err)
+	}
+	if local, err := f.Stat(); err == nil && local.Size() != size {
+		return fmt.Errorf("SFTP transfer incomplete: got %d of %d bytes: %w", local.Size(), size, io.ErrUnexpectedEOF)
+	}
+	f.Close()
+	os.Chtimes(filePath, fi.ModTime(), fi.ModTime())
+	return nil
+}
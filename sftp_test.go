@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// writeSSHKey creates an ed25519 key in dir, encrypted when passphrase is set
+func writeSSHKey(t *testing.T, dir, name, passphrase string) (string, ssh.PublicKey) {
+	t.Helper()
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var block *pem.Block
+	if passphrase == "" {
+		block, err = ssh.MarshalPrivateKey(key, "dl test")
+	} else {
+		block, err = ssh.MarshalPrivateKeyWithPassphrase(key, "dl test", []byte(passphrase))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, sshPub
+}
+
+// startSFTPServer serves the local file system over SFTP on a loopback port
+// to user "ci", who logs in with password or key. It returns the address and
+// a known_hosts file listing the server's host key.
+func startSFTPServer(t *testing.T, password string, key ssh.PublicKey) (addr, knownHosts string) {
+	t.Helper()
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if c.User() == "ci" && password != "" && string(pass) == password {
+				return nil, nil
+			}
+			return nil, errors.New("wrong password")
+		},
+		PublicKeyCallback: func(c ssh.ConnMetadata, pub ssh.PublicKey) (*ssh.Permissions, error) {
+			if c.User() == "ci" && key != nil && bytes.Equal(pub.Marshal(), key.Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("unknown key")
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveSFTP(conn, config)
+		}
+	}()
+
+	addr = ln.Addr().String()
+	knownHosts = filepath.Join(t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(addr)}, hostSigner.PublicKey()) + "\n"
+	if err := ioutil.WriteFile(knownHosts, []byte(line), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return addr, knownHosts
+}
+
+// serveSFTP runs the SFTP subsystem for each session on conn
+func serveSFTP(conn net.Conn, config *ssh.ServerConfig) {
+	defer conn.Close()
+	sshConn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	defer sshConn.Close()
+	go ssh.DiscardRequests(reqs)
+	for newChan := range chans {
+		if newChan.ChannelType() != "session" {
+			newChan.Reject(ssh.UnknownChannelType, "sessions only")
+			continue
+		}
+		ch, requests, err := newChan.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range requests {
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if !ok {
+					continue
+				}
+				if server, err := sftp.NewServer(ch); err == nil {
+					go func() {
+						server.Serve()
+						ch.Close()
+					}()
+				}
+			}
+		}()
+	}
+}
+
+func TestSSHAuthMethodsKeyFile(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	dir := t.TempDir()
+	key, _ := writeSSHKey(t, dir, "id_ed25519", "")
+	encrypted, _ := writeSSHKey(t, dir, "id_encrypted", "secret")
+	garbage := filepath.Join(dir, "garbage")
+	ioutil.WriteFile(garbage, []byte("not a key\n"), 0600)
+
+	tests := []struct {
+		name string
+		file string
+		err  bool
+	}{
+		{"valid key", key, false},
+		{"missing key", filepath.Join(dir, "missing"), true},
+		{"not a key", garbage, true},
+		{"encrypted key without an agent", encrypted, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			methods, _, err := sshAuthMethods(SSHOptions{KeyFile: tt.file}, "")
+			if !tt.err {
+				if err != nil || len(methods) != 1 {
+					t.Fatalf("sshAuthMethods = %d methods, %v; want the key", len(methods), err)
+				}
+				return
+			}
+			var usageErr *UsageError
+			if !errors.As(err, &usageErr) || !strings.Contains(err.Error(), tt.file) {
+				t.Fatalf("sshAuthMethods = %v, want a usage error naming %s", err, tt.file)
+			}
+		})
+	}
+
+	// Unusable default keys are skipped
+	home := t.TempDir()
+	os.Mkdir(filepath.Join(home, ".ssh"), 0700)
+	ioutil.WriteFile(filepath.Join(home, ".ssh", "id_rsa"), []byte("not a key\n"), 0600)
+	t.Setenv("HOME", home)
+	if methods, _, err := sshAuthMethods(SSHOptions{}, "pw"); err != nil || len(methods) != 1 {
+		t.Errorf("sshAuthMethods with default keys = %d methods, %v; want only the password", len(methods), err)
+	}
+}
+
+func TestSFTPPath(t *testing.T) {
+	tests := []struct {
+		url, want string
+	}{
+		{"sftp://host/srv/file.bin", "/srv/file.bin"},
+		{"sftp://host/~/file.bin", "file.bin"},
+		{"sftp://host/~/dir/file.bin", "dir/file.bin"},
+		{"sftp://host//abs/file.bin", "//abs/file.bin"},
+	}
+	for _, tt := range tests {
+		u, _ := url.Parse(tt.url)
+		if got := sftpPath(u); got != tt.want {
+			t.Errorf("sftpPath(%s) = %q, want %q", tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestDownloadSFTP(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	dir := t.TempDir()
+	body := bytes.Repeat([]byte("sftp data "), 20000)
+	remote := filepath.Join(dir, "remote.bin")
+	if err := ioutil.WriteFile(remote, body, 0644); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC)
+	os.Chtimes(remote, mtime, mtime)
+
+	keyFile, pub := writeSSHKey(t, dir, "id_ed25519", "")
+	addr, knownHosts := startSFTPServer(t, "hunter2", pub)
+	empty := filepath.Join(dir, "empty_known_hosts")
+	ioutil.WriteFile(empty, nil, 0600)
+
+	tests := []struct {
+		name     string
+		userinfo string
+		path     string
+		ssh      SSHOptions
+		partial  int    // bytes already on disk, resumed with -r
+		reason   string // the SSHError reason, "" on success
+	}{
+		{name: "password", userinfo: "ci:hunter2", path: remote},
+		{name: "key", userinfo: "ci", path: remote, ssh: SSHOptions{KeyFile: keyFile}},
+		{name: "resume", userinfo: "ci:hunter2", path: remote, partial: 54321},
+		{name: "wrong password", userinfo: "ci:wrong", path: remote, reason: "authentication"},
+		{name: "missing file", userinfo: "ci:hunter2", path: remote + ".missing", reason: "not found"},
+		{name: "unknown host", userinfo: "ci:hunter2", path: remote, ssh: SSHOptions{KnownHosts: empty}, reason: "host key"},
+		{name: "insecure", userinfo: "ci:hunter2", path: remote, ssh: SSHOptions{KnownHosts: empty, Insecure: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "file.bin")
+			if tt.partial > 0 {
+				if err := ioutil.WriteFile(path, body[:tt.partial], 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			opts := tt.ssh
+			if opts.KnownHosts == "" {
+				opts.KnownHosts = knownHosts
+			}
+			config := &Config{
+				URL:      fmt.Sprintf("sftp://%s@%s%s", tt.userinfo, addr, filepath.ToSlash(tt.path)),
+				FilePath: path,
+				Resume:   tt.partial > 0,
+				Quiet:    true,
+				SSH:      opts,
+			}
+			err := downloadWithRetry(context.Background(), config)
+			if tt.reason != "" {
+				var sshErr *SSHError
+				if !errors.As(err, &sshErr) || sshErr.Reason != tt.reason {
+					t.Fatalf("download = %v, want an SSHError for %s", err, tt.reason)
+				}
+				if strings.Contains(err.Error(), "wrong") {
+					t.Errorf("error shows the password: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := ioutil.ReadFile(path); !bytes.Equal(got, body) {
+				t.Fatalf("downloaded %d bytes that differ from the file", len(got))
+			}
+			if fi, err := os.Stat(path); err != nil || !fi.ModTime().Equal(mtime) {
+				t.Errorf("modification time = %v, want %v", fi.ModTime(), mtime)
+			}
+		})
+	}
+}
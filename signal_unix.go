@@ -0,0 +1,46 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// watchRateSignals lets the rate limit be adjusted while a download runs:
+// SIGUSR1 halves the limit and SIGUSR2 doubles it.
+func watchRateSignals(ctx context.Context, config *Config) {
+	if config.RateLimit == nil {
+		return
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		defer signal.Stop(sigs)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case sig := <-sigs:
+				rate := config.RateLimit.Rate()
+				if sig == syscall.SIGUSR1 {
+					rate /= 2
+				} else {
+					rate *= 2
+				}
+				if rate < 1 {
+					rate = 1
+				}
+				config.RateLimit.SetRate(rate)
+				if !config.Quiet {
+					fmt.Fprintf(os.Stderr, "\nRate limit set to %s/s\n", formatByteSize(rate))
+				}
+				config.Events.Emit("rate", map[string]interface{}{"bytes_per_s": rate})
+			}
+		}
+	}()
+}
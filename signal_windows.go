@@ -0,0 +1,8 @@
+//go:build windows
+
+package main
+
+import "context"
+
+// watchRateSignals is a no-op on Windows, which has no SIGUSR1/SIGUSR2
+func watchRateSignals(ctx context.Context, config *Config) {}
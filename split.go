@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/cheggaaa/pb"
+)
+
+// partPlaceholder matches the run of '#' that -parts replaces with the part
+// number. '#' never reaches the server, so it cannot clash with the URL.
+var partPlaceholder = regexp.MustCompile(`#+`)
+
+// expandPartPattern returns the URLs of parts first..last of pattern, where
+// spec is "last" (counting from 1) or "first-last". The number is
+// zero-padded to the length of the '#' run.
+func expandPartPattern(pattern, spec string) ([]string, error) {
+	if len(partPlaceholder.FindAllStringIndex(pattern, -1)) != 1 {
+		return nil, errors.New("-parts needs exactly one run of '#' in -url, e.g. image.iso.###")
+	}
+	first, last := 1, 0
+	var err error
+	if a, b, ok := strings.Cut(spec, "-"); ok {
+		if first, err = strconv.Atoi(a); err == nil {
+			last, err = strconv.Atoi(b)
+		}
+	} else {
+		last, err = strconv.Atoi(spec)
+	}
+	if err != nil || first < 0 || last < first {
+		return nil, fmt.Errorf("invalid -parts %q", spec)
+	}
+	if last-first >= maxGlobURLs {
+		return nil, fmt.Errorf("-parts %q is more than %d parts", spec, maxGlobURLs)
+	}
+
+	var parts []string
+	for n := first; n <= last; n++ {
+		parts = append(parts, partPlaceholder.ReplaceAllStringFunc(pattern, func(run string) string {
+			return fmt.Sprintf("%0*d", len(run), n)
+		}))
+	}
+	return parts, nil
+}
+
+// readPartList reads part URLs, one per line, from path ("-" for stdin).
+// Blank lines and lines starting with '#' are skipped.
+func readPartList(path string) ([]string, error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	var parts []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts = append(parts, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("%s lists no URLs", path)
+	}
+	return parts, nil
+}
+
+// splitOutputName names the assembled file after the first part, dropping
+// a numeric extension such as ".001"
+func splitOutputName(first string) string {
+	u, err := url.Parse(first)
+	if err != nil {
+		return "downloaded_file"
+	}
+	name := path.Base(u.Path)
+	if ext := path.Ext(name); ext != "" {
+		if _, err := strconv.Atoi(ext[1:]); err == nil {
+			name = strings.TrimSuffix(name, ext)
+		}
+	}
+	if name == "" || name == "." || name == "/" {
+		return "downloaded_file"
+	}
+	return name
+}
+
+// splitState is saved in the work directory so an interrupted download only
+// reuses parts of the same list
+type splitState struct {
+	Parts []string `json:"parts"`
+}
+
+// splitDownload fetches the parts of one split file
+type splitDownload struct {
+	config *Config
+	dir    string
+}
+
+// partPath returns where part i is kept once complete; it is downloaded to
+// the same name with ".part" appended
+func (d *splitDownload) partPath(i int) string {
+	return filepath.Join(d.dir, fmt.Sprintf("%05d", i+1))
+}
+
+// prepare creates the work directory, keeping parts from an earlier attempt
+// at the same list, and returns how many are complete
+func (d *splitDownload) prepare() (int, error) {
+	state := splitState{Parts: d.config.Parts}
+	statePath := filepath.Join(d.dir, "state.json")
+	data, err := json.Marshal(state)
+	if err != nil {
+		return 0, err
+	}
+	if saved, err := ioutil.ReadFile(statePath); err != nil || string(saved) != string(data) {
+		if err := os.RemoveAll(d.dir); err != nil {
+			return 0, err
+		}
+	}
+	if err := os.MkdirAll(d.dir, 0777); err != nil {
+		return 0, err
+	}
+	if err := ioutil.WriteFile(statePath, data, 0666); err != nil {
+		return 0, err
+	}
+
+	done := 0
+	for i := range d.config.Parts {
+		if _, err := os.Stat(d.partPath(i)); err == nil {
+			done++
+		}
+	}
+	return done, nil
+}
+
+// fetchPart downloads part i once, continuing a partial download left by an
+// earlier attempt. Retries are left to the loop around downloadParts, which
+// keeps the finished parts.
+func (d *splitDownload) fetchPart(ctx context.Context, i int) error {
+	part := d.partPath(i) + ".part"
+	file := *d.config
+	file.URL = d.config.Parts[i]
+	file.Parts = nil
+	file.FilePath = part
+	file.Method = ""
+	file.Body = nil
+	file.Checksum = ""
+	file.etag = ""
+	file.mirrors = nil
+	file.MaxRetries = 0
+	// Parts report through the overall progress instead
+	file.Quiet = true
+	file.Events = nil
+	fi, err := os.Stat(part)
+	file.Resume = err == nil && fi.Size() > 0
+	if err := downloadWithRetry(ctx, &file); err != nil {
+		return err
+	}
+	if fi, err = os.Stat(part); err != nil {
+		return err
+	}
+	d.config.Events.Emit("part", map[string]interface{}{
+		"index": i + 1,
+		"url":   redactQuery(file.URL),
+		"bytes": fi.Size(),
+	})
+	return os.Rename(part, d.partPath(i))
+}
+
+// run downloads the missing parts over config.Parallel workers
+func (d *splitDownload) run(ctx context.Context, bar *pb.ProgressBar) error {
+	// Build the shared client before the workers would race to
+	httpClient(d.config)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	todo := make(chan int)
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	for w := 0; w < d.config.Parallel; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range todo {
+				if err := d.fetchPart(ctx, i); err != nil {
+					once.Do(func() {
+						firstErr = fmt.Errorf("part %d (%s): %w", i+1, redactQuery(d.config.Parts[i]), err)
+						cancel()
+					})
+					continue
+				}
+				if bar != nil {
+					bar.Increment()
+				}
+			}
+		}()
+	}
+	for i := range d.config.Parts {
+		if _, err := os.Stat(d.partPath(i)); err == nil {
+			continue
+		}
+		select {
+		case todo <- i:
+		case <-ctx.Done():
+		}
+	}
+	close(todo)
+	wg.Wait()
+	if firstErr == nil && ctx.Err() != nil {
+		firstErr = ctx.Err()
+	}
+	return firstErr
+}
+
+// assemble concatenates the parts into output in order
+func (d *splitDownload) assemble(output string) error {
+	out, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	for i := range d.config.Parts {
+		f, err := os.Open(d.partPath(i))
+		if err != nil {
+			out.Close()
+			return err
+		}
+		_, err = io.Copy(out, f)
+		f.Close()
+		if err != nil {
+			out.Close()
+			return err
+		}
+	}
+	return out.Close()
+}
+
+// downloadParts downloads the parts of a split file (-parts or -part-list)
+// in parallel into <output>.dlsplit and concatenates them in order. Parts
+// already complete are kept, and partial ones continue, when the same
+// command is run again.
+func downloadParts(ctx context.Context, config *Config) error {
+	if config.FilePath == "" {
+		config.FilePath = splitOutputName(config.Parts[0])
+	}
+	d := &splitDownload{config: config, dir: config.FilePath + ".dlsplit"}
+	done, err := d.prepare()
+	if err != nil {
+		return err
+	}
+	if !config.Quiet {
+		if done > 0 {
+			fmt.Println("Resuming download...")
+		}
+		fmt.Printf("Downloading %d parts to: %s\n", len(config.Parts), config.FilePath)
+	}
+	config.Events.Emit("start", map[string]interface{}{
+		"url":    redactQuery(config.Parts[0]),
+		"path":   config.FilePath,
+		"parts":  len(config.Parts),
+		"offset": done,
+	})
+
+	var bar *pb.ProgressBar
+	if !config.Quiet && config.Events == nil {
+		bar = pb.New(len(config.Parts))
+		bar.ShowTimeLeft = true
+		bar.Start()
+		bar.Set(done)
+	}
+	err = d.run(ctx, bar)
+	if bar != nil {
+		bar.Finish()
+	}
+	if err != nil {
+		return err
+	}
+
+	if !config.Quiet {
+		fmt.Printf("Joining %d parts...\n", len(config.Parts))
+	}
+	if err := d.assemble(config.FilePath); err != nil {
+		return err
+	}
+	return os.RemoveAll(d.dir)
+}
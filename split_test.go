@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+)
+
+func TestExpandPartPattern(t *testing.T) {
+	tests := []struct {
+		pattern, spec string
+		want          []string // nil when an error is expected
+	}{
+		{"https://example.com/image.iso.###", "3", []string{
+			"https://example.com/image.iso.001",
+			"https://example.com/image.iso.002",
+			"https://example.com/image.iso.003",
+		}},
+		{"https://example.com/disk#.bin", "0-2", []string{
+			"https://example.com/disk0.bin",
+			"https://example.com/disk1.bin",
+			"https://example.com/disk2.bin",
+		}},
+		{"https://example.com/a.##", "9-11", []string{
+			"https://example.com/a.09",
+			"https://example.com/a.10",
+			"https://example.com/a.11",
+		}},
+		{"https://example.com/a.#", "5-5", []string{"https://example.com/a.5"}},
+		{"https://example.com/a.iso", "3", nil},
+		{"https://example.com/#/a.###", "3", nil},
+		{"https://example.com/a.###", "0", nil},
+		{"https://example.com/a.###", "3-1", nil},
+		{"https://example.com/a.###", "-1-3", nil},
+		{"https://example.com/a.###", "x", nil},
+		{"https://example.com/a.###", "1-", nil},
+		{"https://example.com/a.###", fmt.Sprint(maxGlobURLs + 1), nil},
+		{"https://example.com/a.###", "1-999999999999", nil},
+	}
+	for _, tt := range tests {
+		got, err := expandPartPattern(tt.pattern, tt.spec)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("expandPartPattern(%s, %s) = %d URLs, want an error", tt.pattern, tt.spec, len(got))
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("expandPartPattern(%s, %s) = %v, %v; want %v", tt.pattern, tt.spec, got, err, tt.want)
+		}
+	}
+
+	if got, err := expandPartPattern("https://example.com/a.#", fmt.Sprint(maxGlobURLs)); err != nil || len(got) != maxGlobURLs {
+		t.Errorf("expandPartPattern of %d parts = %d URLs, %v", maxGlobURLs, len(got), err)
+	}
+}
+
+func TestDownloadPartsRetriesOnce(t *testing.T) {
+	var failing int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/a.2" {
+			atomic.AddInt32(&failing, 1)
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, r.URL.Path)
+	}))
+	defer srv.Close()
+
+	config := &Config{
+		Parts:      []string{srv.URL + "/a.1", srv.URL + "/a.2"},
+		FilePath:   filepath.Join(t.TempDir(), "a"),
+		Parallel:   2,
+		MaxRetries: 1,
+		Quiet:      true,
+	}
+	if err := downloadWithRetry(context.Background(), config); err == nil {
+		t.Fatal("downloadWithRetry succeeded with a failing part")
+	}
+	// One request per attempt, not MaxRetries+1 for each of them
+	if n := atomic.LoadInt32(&failing); n != int32(config.MaxRetries+1) {
+		t.Errorf("failing part requested %d times, want %d", n, config.MaxRetries+1)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// TLSOptions are the TLS related command line settings
+type TLSOptions struct {
+	CACert     string // PEM bundle replacing the system roots
+	CAPath     string // directory of PEM certificates replacing the system roots
+	ClientCert string // PEM client certificate for mutual TLS
+	ClientKey  string // PEM private key, defaults to ClientCert
+	Pins       string // "sha256//<base64>" public key pins separated by ';'
+	MinVersion string // "1.0", "1.1", "1.2" or "1.3"
+	Insecure   bool   // skip certificate verification
+}
+
+// TLSError reports a certificate problem: an unknown authority, a hostname
+// mismatch, an expired or otherwise invalid certificate, a pin mismatch, or
+// the server refusing our client certificate
+type TLSError struct {
+	Reason string
+	Err    error
+}
+
+func (e *TLSError) Error() string {
+	return fmt.Sprintf("TLS certificate error (%s): %v", e.Reason, e.Err)
+}
+
+func (e *TLSError) Unwrap() error { return e.Err }
+
+// errPinMismatch is returned when no certificate matches a -pin hash
+var errPinMismatch = errors.New("server public key does not match any pinned key")
+
+// buildTLSConfig turns TLSOptions into a tls.Config, or returns nil when the
+// defaults should be used
+func buildTLSConfig(opts TLSOptions) (*tls.Config, error) {
+	cfg := &tls.Config{}
+	custom := false
+
+	if opts.CACert != "" || opts.CAPath != "" {
+		pool := x509.NewCertPool()
+		files := []string{}
+		if opts.CACert != "" {
+			files = append(files, opts.CACert)
+		}
+		if opts.CAPath != "" {
+			entries, err := ioutil.ReadDir(opts.CAPath)
+			if err != nil {
+				return nil, fmt.Errorf("cannot read -capath: %w", err)
+			}
+			for _, entry := range entries {
+				if !entry.IsDir() {
+					files = append(files, filepath.Join(opts.CAPath, entry.Name()))
+				}
+			}
+		}
+		loaded := 0
+		for _, file := range files {
+			pem, err := ioutil.ReadFile(file)
+			if err != nil {
+				return nil, fmt.Errorf("cannot read CA certificate: %w", err)
+			}
+			if pool.AppendCertsFromPEM(pem) {
+				loaded++
+			}
+		}
+		if loaded == 0 {
+			return nil, errors.New("no PEM certificates found in -cacert/-capath")
+		}
+		cfg.RootCAs = pool
+		custom = true
+	}
+
+	if opts.ClientCert != "" {
+		key := opts.ClientKey
+		if key == "" {
+			key = opts.ClientCert
+		}
+		cert, err := tls.LoadX509KeyPair(opts.ClientCert, key)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+		custom = true
+	} else if opts.ClientKey != "" {
+		return nil, errors.New("-key requires -cert")
+	}
+
+	if opts.MinVersion != "" {
+		versions := map[string]uint16{
+			"1.0": tls.VersionTLS10,
+			"1.1": tls.VersionTLS11,
+			"1.2": tls.VersionTLS12,
+			"1.3": tls.VersionTLS13,
+		}
+		v, ok := versions[opts.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("invalid -tls-min %q (use 1.0, 1.1, 1.2 or 1.3)", opts.MinVersion)
+		}
+		cfg.MinVersion = v
+		custom = true
+	}
+
+	if opts.Pins != "" {
+		pins := map[string]bool{}
+		for _, pin := range strings.Split(opts.Pins, ";") {
+			pin = strings.TrimSpace(pin)
+			if !strings.HasPrefix(pin, "sha256//") {
+				return nil, fmt.Errorf("invalid -pin %q, expected sha256//<base64>", pin)
+			}
+			pins[strings.TrimPrefix(pin, "sha256//")] = true
+		}
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			// Pin the server's own key, as curl does
+			if len(cs.PeerCertificates) > 0 {
+				sum := sha256.Sum256(cs.PeerCertificates[0].RawSubjectPublicKeyInfo)
+				if pins[base64.StdEncoding.EncodeToString(sum[:])] {
+					return nil
+				}
+			}
+			return errPinMismatch
+		}
+		custom = true
+	}
+
+	if opts.Insecure {
+		fmt.Fprintln(os.Stderr, "WARNING: -insecure disables TLS certificate and SSH host key verification.")
+		fmt.Fprintln(os.Stderr, "WARNING: anyone on the network path can read or alter this download.")
+		cfg.InsecureSkipVerify = true
+		custom = true
+	}
+
+	if !custom {
+		return nil, nil
+	}
+	return cfg, nil
+}
+
+// asTLSError classifies certificate verification failures as a TLSError
+func asTLSError(err error) error {
+	var tlsErr *TLSError
+	if errors.As(err, &tlsErr) {
+		return err
+	}
+
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	var verification *tls.CertificateVerificationError
+	var alert *net.OpError
+	switch {
+	case errors.Is(err, errPinMismatch):
+		return &TLSError{Reason: "pin mismatch", Err: err}
+	case errors.As(err, &unknownAuthority):
+		return &TLSError{Reason: "unknown authority", Err: err}
+	case errors.As(err, &hostname):
+		return &TLSError{Reason: "hostname mismatch", Err: err}
+	case errors.As(err, &invalid):
+		reason := "invalid certificate"
+		if invalid.Reason == x509.Expired {
+			reason = "expired or not yet valid"
+		}
+		return &TLSError{Reason: reason, Err: err}
+	case errors.As(err, &verification):
+		return &TLSError{Reason: "verification failed", Err: err}
+	case errors.As(err, &alert) && alert.Op == "remote error":
+		// The server rejected us, typically for a missing or untrusted client certificate
+		return &TLSError{Reason: "rejected by server", Err: err}
+	}
+	return err
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writePEM writes blocks of the given type to a new file in dir
+func writePEM(t *testing.T, dir, name, typ string, der ...[]byte) string {
+	t.Helper()
+	var out []byte
+	for _, d := range der {
+		out = append(out, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: d})...)
+	}
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, out, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// clientCertificate creates a self-signed client certificate and key in dir
+func clientCertificate(t *testing.T, dir string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "dl test client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return writePEM(t, dir, "client.pem", "CERTIFICATE", der), writePEM(t, dir, "client.key", "EC PRIVATE KEY", keyDER)
+}
+
+func TestBuildTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	empty := filepath.Join(dir, "empty.pem")
+	ioutil.WriteFile(empty, []byte("not a certificate\n"), 0600)
+	cert, key := clientCertificate(t, dir)
+
+	tests := []struct {
+		name string
+		opts TLSOptions
+		err  string // "" when the options are valid
+	}{
+		{"defaults", TLSOptions{}, ""},
+		{"client certificate", TLSOptions{ClientCert: cert, ClientKey: key}, ""},
+		{"minimum version", TLSOptions{MinVersion: "1.3"}, ""},
+		{"pins", TLSOptions{Pins: "sha256//AAAA; sha256//BBBB"}, ""},
+		{"no certificates in -cacert", TLSOptions{CACert: empty}, "no PEM certificates"},
+		{"missing -cacert", TLSOptions{CACert: filepath.Join(dir, "missing.pem")}, "cannot read CA certificate"},
+		{"missing -capath", TLSOptions{CAPath: filepath.Join(dir, "missing")}, "cannot read -capath"},
+		{"key without cert", TLSOptions{ClientKey: key}, "-key requires -cert"},
+		{"bad key", TLSOptions{ClientCert: cert, ClientKey: empty}, "cannot load client certificate"},
+		{"bad version", TLSOptions{MinVersion: "1.4"}, "invalid -tls-min"},
+		{"bad pin", TLSOptions{Pins: "md5//AAAA"}, "invalid -pin"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := buildTLSConfig(tt.opts)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if (cfg == nil) != (tt.opts == TLSOptions{}) {
+					t.Errorf("buildTLSConfig = %v, want nil only for the defaults", cfg)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("buildTLSConfig = %v, want an error mentioning %q", err, tt.err)
+			}
+		})
+	}
+	if cfg, _ := buildTLSConfig(TLSOptions{MinVersion: "1.2"}); cfg == nil || cfg.MinVersion != tls.VersionTLS12 {
+		t.Errorf("-tls-min 1.2 gave %+v", cfg)
+	}
+}
+
+func TestTLSDownload(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := clientCertificate(t, dir)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/mtls/") && len(r.TLS.PeerCertificates) == 0 {
+			http.Error(w, "no client certificate", http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, "secure payload")
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+
+	ca := writePEM(t, dir, "ca.pem", "CERTIFICATE", srv.Certificate().Raw)
+	sum := sha256.Sum256(srv.Certificate().RawSubjectPublicKeyInfo)
+	pin := "sha256//" + base64.StdEncoding.EncodeToString(sum[:])
+
+	tests := []struct {
+		name   string
+		path   string
+		opts   TLSOptions
+		reason string // the TLSError reason, "" when the download succeeds
+		status int    // the HTTPError status otherwise expected
+	}{
+		{"unknown authority", "/file", TLSOptions{}, "unknown authority", 0},
+		{"custom CA", "/file", TLSOptions{CACert: ca}, "", 0},
+		{"matching pin", "/file", TLSOptions{CACert: ca, Pins: "sha256//AAAA;" + pin}, "", 0},
+		{"pin mismatch", "/file", TLSOptions{CACert: ca, Pins: "sha256//AAAA"}, "pin mismatch", 0},
+		{"insecure", "/file", TLSOptions{Insecure: true}, "", 0},
+		{"client certificate", "/mtls/file", TLSOptions{CACert: ca, ClientCert: cert, ClientKey: key}, "", 0},
+		{"missing client certificate", "/mtls/file", TLSOptions{CACert: ca}, "", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := buildTLSConfig(tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			config := &Config{URL: srv.URL + tt.path, FilePath: filepath.Join(t.TempDir(), "file"), Quiet: true, TLS: cfg}
+			err = downloadWithRetry(context.Background(), config)
+
+			var tlsErr *TLSError
+			var httpErr *HTTPError
+			switch {
+			case tt.reason != "":
+				if !errors.As(err, &tlsErr) || tlsErr.Reason != tt.reason || exitCode(err) != ExitTLS {
+					t.Fatalf("download = %v, want a TLSError for %s", err, tt.reason)
+				}
+			case tt.status != 0:
+				if !errors.As(err, &httpErr) || httpErr.StatusCode != tt.status {
+					t.Fatalf("download = %v, want status %d", err, tt.status)
+				}
+			case err != nil:
+				t.Fatal(err)
+			default:
+				if got, _ := ioutil.ReadFile(config.FilePath); string(got) != "secure payload" {
+					t.Errorf("downloaded %q", got)
+				}
+			}
+		})
+	}
+}
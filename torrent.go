@@ -0,0 +1,993 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	mrand "math/rand"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TorrentOptions are the BitTorrent related command line settings
+type TorrentOptions struct {
+	Follow    bool          // download what a .torrent URL describes rather than the file itself
+	SeedRatio float64       // keep seeding until uploaded/size reaches this; 0 disables
+	SeedTime  time.Duration // keep seeding this long; 0 disables
+	MaxPeers  int           // connected peers, incoming and outgoing
+	Port      int           // listen port for incoming peers
+}
+
+// maxTorrentFileSize bounds .torrent files and magnet metadata
+const maxTorrentFileSize = 16 << 20
+
+// maxPieceLength bounds the piece length, as every piece is held in memory
+// while it is checked. Real torrents stay well below it.
+const maxPieceLength = 64 << 20
+
+// isTorrentURL reports whether config.URL is a magnet link or, unless
+// -follow-torrent=false, an http(s) or file URL of a .torrent file
+func isTorrentURL(config *Config) bool {
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return false
+	}
+	switch u.Scheme {
+	case "magnet":
+		return true
+	case "http", "https", "file":
+		return config.Torrent.Follow && strings.HasSuffix(strings.ToLower(u.Path), ".torrent")
+	}
+	return false
+}
+
+// torrentFile is one file of a torrent's content
+type torrentFile struct {
+	Path   []string // components below the torrent's root
+	Length int64
+}
+
+// torrentInfo is a parsed info dictionary (BEP 3)
+type torrentInfo struct {
+	Name        string
+	PieceLength int64
+	Pieces      [][sha1.Size]byte
+	Files       []torrentFile // a single entry named Name for single-file torrents
+	Multi       bool
+	Length      int64
+}
+
+// pieceSize returns the length of piece i; the last one may be short
+func (info *torrentInfo) pieceSize(i int) int64 {
+	if i == len(info.Pieces)-1 {
+		return info.Length - int64(i)*info.PieceLength
+	}
+	return info.PieceLength
+}
+
+// safePathComponent rejects file names that would escape the download
+// directory
+func safePathComponent(name string) bool {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\\x00") {
+		return false
+	}
+	return !strings.Contains(name, ":") || filepath.Separator == '/'
+}
+
+// parseTorrentInfo parses the raw bencoded info dictionary
+func parseTorrentInfo(raw []byte) (*torrentInfo, error) {
+	v, err := bdecode(raw)
+	if err != nil {
+		return nil, err
+	}
+	d, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("info is not a dictionary")
+	}
+	info := &torrentInfo{Name: bstring(d, "name"), PieceLength: bint(d, "piece length")}
+	if !safePathComponent(info.Name) {
+		return nil, fmt.Errorf("unsafe name %q", info.Name)
+	}
+	if info.PieceLength <= 0 {
+		return nil, errors.New("missing piece length")
+	}
+	if info.PieceLength > maxPieceLength {
+		return nil, fmt.Errorf("piece length %d is over the %d byte limit", info.PieceLength, maxPieceLength)
+	}
+	pieces := bstring(d, "pieces")
+	if len(pieces) == 0 || len(pieces)%sha1.Size != 0 {
+		return nil, errors.New("invalid pieces")
+	}
+	for i := 0; i < len(pieces); i += sha1.Size {
+		var h [sha1.Size]byte
+		copy(h[:], pieces[i:])
+		info.Pieces = append(info.Pieces, h)
+	}
+
+	if files := blist(d, "files"); files != nil {
+		info.Multi = true
+		for _, f := range files {
+			fd, ok := f.(map[string]interface{})
+			if !ok {
+				return nil, errors.New("invalid file entry")
+			}
+			file := torrentFile{Length: bint(fd, "length")}
+			for _, p := range blist(fd, "path") {
+				name, _ := p.(string)
+				if !safePathComponent(name) {
+					return nil, fmt.Errorf("unsafe file path component %q", name)
+				}
+				file.Path = append(file.Path, name)
+			}
+			if len(file.Path) == 0 || file.Length < 0 {
+				return nil, errors.New("invalid file entry")
+			}
+			info.Files = append(info.Files, file)
+			info.Length += file.Length
+		}
+	} else {
+		info.Length = bint(d, "length")
+		info.Files = []torrentFile{{Path: []string{info.Name}, Length: info.Length}}
+	}
+	if n := (info.Length + info.PieceLength - 1) / info.PieceLength; n != int64(len(info.Pieces)) {
+		return nil, fmt.Errorf("%d bytes need %d pieces, found %d", info.Length, n, len(info.Pieces))
+	}
+	return info, nil
+}
+
+// torrentMeta is what is known about a torrent before connecting: the
+// contents of a .torrent file, or of a magnet link whose info dictionary
+// still has to be fetched from peers
+type torrentMeta struct {
+	InfoHash  [sha1.Size]byte
+	InfoBytes []byte // nil for magnet links
+	Name      string // display name of a magnet link
+	Trackers  []string
+	Peers     []string // host:port addresses given directly (magnet x.pe)
+}
+
+// parseTorrentFile parses a .torrent file
+func parseTorrentFile(data []byte) (*torrentMeta, error) {
+	v, err := bdecode(data)
+	if err != nil {
+		return nil, err
+	}
+	d, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("not a dictionary")
+	}
+	raw, err := bdictRaw(data, "info")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := parseTorrentInfo(raw); err != nil {
+		return nil, err
+	}
+	meta := &torrentMeta{InfoHash: sha1.Sum(raw), InfoBytes: raw}
+	// announce-list (BEP 12) supersedes announce
+	for _, tier := range blist(d, "announce-list") {
+		list, _ := tier.([]interface{})
+		for _, t := range list {
+			if s, ok := t.(string); ok {
+				meta.addTracker(s)
+			}
+		}
+	}
+	meta.addTracker(bstring(d, "announce"))
+	return meta, nil
+}
+
+func (m *torrentMeta) addTracker(tracker string) {
+	if tracker == "" {
+		return
+	}
+	for _, t := range m.Trackers {
+		if t == tracker {
+			return
+		}
+	}
+	m.Trackers = append(m.Trackers, tracker)
+}
+
+// parseMagnet parses a magnet link with a BitTorrent info hash (BEP 9)
+func parseMagnet(raw string) (*torrentMeta, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	meta := &torrentMeta{Name: q.Get("dn")}
+	found := false
+	for _, xt := range q["xt"] {
+		if !strings.HasPrefix(xt, "urn:btih:") {
+			continue
+		}
+		hash := strings.TrimPrefix(xt, "urn:btih:")
+		var b []byte
+		switch len(hash) {
+		case 40:
+			b, err = hex.DecodeString(hash)
+		case 32:
+			b, err = base32.StdEncoding.DecodeString(strings.ToUpper(hash))
+		default:
+			err = fmt.Errorf("bad length %d", len(hash))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid info hash %q: %w", hash, err)
+		}
+		copy(meta.InfoHash[:], b)
+		found = true
+	}
+	if !found {
+		return nil, errors.New("magnet link has no urn:btih info hash")
+	}
+	for _, tr := range q["tr"] {
+		meta.addTracker(tr)
+	}
+	meta.Peers = q["x.pe"]
+	return meta, nil
+}
+
+// loadTorrent parses the magnet link or fetches the .torrent file named by
+// config.URL
+func loadTorrent(ctx context.Context, config *Config) (*torrentMeta, error) {
+	if strings.HasPrefix(config.URL, "magnet:") {
+		meta, err := parseMagnet(config.URL)
+		if err != nil {
+			return nil, &UsageError{err}
+		}
+		return meta, nil
+	}
+
+	data, err := fetchDocument(ctx, config, maxTorrentFileSize)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := parseTorrentFile(data)
+	if err != nil {
+		return nil, &UsageError{fmt.Errorf("invalid torrent file: %w", err)}
+	}
+	return meta, nil
+}
+
+// bitfield records which pieces are available, most significant bit first
+type bitfield []byte
+
+func newBitfield(n int) bitfield { return make(bitfield, (n+7)/8) }
+
+func (b bitfield) has(i int) bool {
+	return i >= 0 && i/8 < len(b) && b[i/8]&(0x80>>uint(i%8)) != 0
+}
+
+// set marks piece i, growing b if needed, and returns the result
+func (b bitfield) set(i int) bitfield {
+	for i/8 >= len(b) {
+		b = append(b, 0)
+	}
+	b[i/8] |= 0x80 >> uint(i%8)
+	return b
+}
+
+// torrentStorage maps the torrent's byte stream onto its files
+type torrentStorage struct {
+	mu    sync.Mutex
+	paths []string
+	files []*os.File // opened on first use
+	info  *torrentInfo
+}
+
+// newTorrentStorage places a single-file torrent at root and a multi-file
+// torrent's files below the directory root
+func newTorrentStorage(info *torrentInfo, root string) *torrentStorage {
+	s := &torrentStorage{info: info, files: make([]*os.File, len(info.Files))}
+	for _, f := range info.Files {
+		if info.Multi {
+			s.paths = append(s.paths, filepath.Join(append([]string{root}, f.Path...)...))
+		} else {
+			s.paths = append(s.paths, root)
+		}
+	}
+	return s
+}
+
+// file returns file i, creating it and its directories for writing
+func (s *torrentStorage) file(i int, create bool) (*os.File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.files[i] != nil {
+		return s.files[i], nil
+	}
+	if !create {
+		// Opening read-only would hide the file from a later write
+		if _, err := os.Stat(s.paths[i]); err != nil {
+			return nil, err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(s.paths[i]), 0777); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(s.paths[i], os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	s.files[i] = f
+	return f, nil
+}
+
+// access calls fn for each file region covering [off, off+len(p))
+func (s *torrentStorage) access(p []byte, off int64, fn func(i int, p []byte, off int64) error) error {
+	var start int64
+	for i, f := range s.info.Files {
+		end := start + f.Length
+		if off < end && len(p) > 0 {
+			n := int64(len(p))
+			if n > end-off {
+				n = end - off
+			}
+			if err := fn(i, p[:n], off-start); err != nil {
+				return err
+			}
+			p, off = p[n:], off+n
+		}
+		start = end
+	}
+	return nil
+}
+
+func (s *torrentStorage) ReadAt(p []byte, off int64) error {
+	return s.access(p, off, func(i int, p []byte, off int64) error {
+		f, err := s.file(i, false)
+		if err != nil {
+			return err
+		}
+		_, err = f.ReadAt(p, off)
+		return err
+	})
+}
+
+func (s *torrentStorage) WriteAt(p []byte, off int64) error {
+	return s.access(p, off, func(i int, p []byte, off int64) error {
+		f, err := s.file(i, true)
+		if err != nil {
+			return err
+		}
+		_, err = f.WriteAt(p, off)
+		return err
+	})
+}
+
+// createEmpty creates the zero-length files, which no piece writes to
+func (s *torrentStorage) createEmpty() error {
+	for i, f := range s.info.Files {
+		if f.Length == 0 {
+			if _, err := s.file(i, true); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *torrentStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var firstErr error
+	for _, f := range s.files {
+		if f != nil {
+			if err := f.Close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// pieceDownload is a piece being fetched from one peer
+type pieceDownload struct {
+	index     int
+	data      []byte
+	requested []bool // per block
+	received  []bool
+	missing   int   // blocks not yet received
+	counted   int64 // bytes already reported as progress
+}
+
+// blockSize is the request size every client accepts
+const blockSize = 16 << 10
+
+func newPieceDownload(index int, length int64) *pieceDownload {
+	blocks := int((length + blockSize - 1) / blockSize)
+	return &pieceDownload{
+		index:     index,
+		data:      make([]byte, length),
+		requested: make([]bool, blocks),
+		received:  make([]bool, blocks),
+		missing:   blocks,
+	}
+}
+
+// swarm is the state shared by all peer connections of one torrent
+type swarm struct {
+	config *Config
+	meta   *torrentMeta
+	peerID [20]byte
+	port   int
+
+	mu         sync.Mutex
+	info       *torrentInfo // nil until a magnet link's metadata arrives
+	infoBytes  []byte
+	storage    *torrentStorage
+	have       bitfield
+	active     map[int]int // pieces being downloaded, and by how many peers
+	left       int64
+	peers      map[string]*peerConn
+	tried      map[string]time.Time // when each address was last dialed
+	bad        map[string]int       // pieces from each address that failed verification
+	metadata   [][]byte             // ut_metadata pieces received so far
+	metaSize   int
+	trackerErr error // the last failed announce, reported if no peer is found
+
+	partial  int64 // bytes received for pieces not yet verified, updated atomically
+	verified int64 // bytes of pieces downloaded and verified this run
+	uploaded int64
+	lastData int64 // UnixNano of the last block received
+
+	infoReady chan struct{} // closed once the info dictionary is known
+	done      chan struct{} // closed once every piece is verified
+	failed    chan error    // fatal errors such as a full disk
+}
+
+func newSwarm(config *Config, meta *torrentMeta) *swarm {
+	s := &swarm{
+		config:    config,
+		meta:      meta,
+		active:    map[int]int{},
+		peers:     map[string]*peerConn{},
+		tried:     map[string]time.Time{},
+		bad:       map[string]int{},
+		infoReady: make(chan struct{}),
+		done:      make(chan struct{}),
+		failed:    make(chan error, 1),
+		lastData:  time.Now().UnixNano(),
+	}
+	copy(s.peerID[:], "-DL0100-")
+	rand.Read(s.peerID[8:])
+	return s
+}
+
+// outputPath is where the torrent's content goes: -o, or the torrent's name
+func (s *swarm) outputPath(info *torrentInfo) string {
+	if s.config.FilePath != "" {
+		return s.config.FilePath
+	}
+	return info.Name
+}
+
+// setInfo installs the info dictionary and checks which pieces are already
+// on disk, so interrupted downloads continue where they stopped
+func (s *swarm) setInfo(raw []byte) error {
+	info, err := parseTorrentInfo(raw)
+	if err != nil {
+		return err
+	}
+	storage := newTorrentStorage(info, s.outputPath(info))
+	have := newBitfield(len(info.Pieces))
+	left := info.Length
+	buf := make([]byte, info.PieceLength)
+	checked := false
+	for i := range info.Pieces {
+		n := info.pieceSize(i)
+		if storage.ReadAt(buf[:n], int64(i)*info.PieceLength) != nil {
+			continue
+		}
+		if !checked && !s.config.Quiet {
+			fmt.Println("Checking existing data...")
+			checked = true
+		}
+		if sha1.Sum(buf[:n]) == info.Pieces[i] {
+			have.set(i)
+			left -= n
+		}
+	}
+	if err := storage.createEmpty(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.info, s.infoBytes, s.storage, s.have, s.left = info, raw, storage, have, left
+	s.metadata = nil
+	s.mu.Unlock()
+	close(s.infoReady)
+	if left == 0 {
+		close(s.done)
+	}
+	return nil
+}
+
+// getInfo returns the info dictionary, or nil while it is unknown
+func (s *swarm) getInfo() *torrentInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.info
+}
+
+// needs reports whether a peer with bits has a piece we lack
+func (s *swarm) needs(bits bitfield) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.info == nil {
+		return false
+	}
+	for i := range s.info.Pieces {
+		if !s.have.has(i) && bits.has(i) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasPiece reports whether piece i is verified and can be uploaded
+func (s *swarm) hasPiece(i int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.have.has(i)
+}
+
+// pick chooses a piece for a peer with bits: a random one nobody is
+// downloading or, near the end, one another peer is already fetching
+func (s *swarm) pick(bits bitfield) *pieceDownload {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.info == nil {
+		return nil
+	}
+	var idle, busy []int
+	for i := range s.info.Pieces {
+		if s.have.has(i) || !bits.has(i) {
+			continue
+		}
+		if s.active[i] == 0 {
+			idle = append(idle, i)
+		} else {
+			busy = append(busy, i)
+		}
+	}
+	candidates := idle
+	if len(candidates) == 0 {
+		candidates = busy
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	i := candidates[mrand.Intn(len(candidates))]
+	s.active[i]++
+	return newPieceDownload(i, s.info.pieceSize(i))
+}
+
+// received reports n bytes of piece data as progress
+func (s *swarm) received(pd *pieceDownload, n int) {
+	pd.counted += int64(n)
+	atomic.AddInt64(&s.partial, int64(n))
+	atomic.StoreInt64(&s.lastData, time.Now().UnixNano())
+}
+
+// release gives up on pd, taking back the progress it reported
+func (s *swarm) release(pd *pieceDownload) {
+	s.mu.Lock()
+	s.active[pd.index]--
+	s.mu.Unlock()
+	atomic.AddInt64(&s.partial, -pd.counted)
+	pd.counted = 0
+}
+
+// progress returns the bytes verified so far plus those received for
+// pieces still in progress
+func (s *swarm) progress() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.info == nil {
+		return 0
+	}
+	return s.info.Length - s.left + atomic.LoadInt64(&s.partial)
+}
+
+// errBadPiece is returned when a peer sends data that fails verification
+var errBadPiece = errors.New("piece failed hash check")
+
+// finishPiece verifies a completely received piece and writes it to disk
+func (s *swarm) finishPiece(addr string, pd *pieceDownload) error {
+	info := s.getInfo()
+	if sha1.Sum(pd.data) != info.Pieces[pd.index] {
+		s.release(pd)
+		s.mu.Lock()
+		s.bad[addr]++
+		s.mu.Unlock()
+		return fmt.Errorf("piece %d from %s: %w", pd.index, addr, errBadPiece)
+	}
+	if s.hasPiece(pd.index) {
+		// Another peer finished it first
+		s.release(pd)
+		return nil
+	}
+	if err := s.storage.WriteAt(pd.data, int64(pd.index)*info.PieceLength); err != nil {
+		s.fail(err)
+		return err
+	}
+
+	s.mu.Lock()
+	if s.have.has(pd.index) {
+		s.mu.Unlock()
+		s.release(pd)
+		return nil
+	}
+	s.active[pd.index]--
+	atomic.AddInt64(&s.partial, -pd.counted)
+	atomic.AddInt64(&s.verified, int64(len(pd.data)))
+	s.have = s.have.set(pd.index)
+	s.left -= int64(len(pd.data))
+	complete := s.left == 0
+	peers := make([]*peerConn, 0, len(s.peers))
+	for _, p := range s.peers {
+		peers = append(peers, p)
+	}
+	s.mu.Unlock()
+
+	for _, p := range peers {
+		p.notifyHave(pd.index)
+	}
+	if complete {
+		close(s.done)
+	}
+	return nil
+}
+
+// fail stops the download with a local error retrying peers will not fix
+func (s *swarm) fail(err error) {
+	select {
+	case s.failed <- err:
+	default:
+	}
+}
+
+// metadataPiece stores piece i of the info dictionary from ut_metadata and
+// installs the dictionary once it is complete and matches the info hash
+func (s *swarm) metadataPiece(i int, data []byte) {
+	s.mu.Lock()
+	if s.info != nil || i < 0 || i >= len(s.metadata) || s.metadata[i] != nil {
+		s.mu.Unlock()
+		return
+	}
+	s.metadata[i] = data
+	for _, piece := range s.metadata {
+		if piece == nil {
+			s.mu.Unlock()
+			return
+		}
+	}
+	var raw []byte
+	for _, piece := range s.metadata {
+		raw = append(raw, piece...)
+	}
+	size := s.metaSize
+	// Start over if it is wrong, taking the size from the next peer to
+	// announce one; other peers may send the right dictionary
+	if len(raw) != size || sha1.Sum(raw) != s.meta.InfoHash {
+		s.metadata, s.metaSize = nil, 0
+		s.mu.Unlock()
+		return
+	}
+	s.metadata = nil
+	s.mu.Unlock()
+
+	if err := s.setInfo(raw); err != nil {
+		s.fail(&UsageError{fmt.Errorf("invalid torrent metadata: %w", err)})
+	}
+}
+
+// setMetadataSize records the info dictionary size the first peer announced
+// and reports whether size agrees with it. Later peers cannot change it, so
+// one announcing another size does not discard the pieces collected so far.
+func (s *swarm) setMetadataSize(size int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.info != nil || size <= 0 || size > maxTorrentFileSize {
+		return false
+	}
+	if s.metaSize == 0 {
+		s.metaSize = size
+		s.metadata = make([][]byte, (size+blockSize-1)/blockSize)
+	}
+	return size == s.metaSize
+}
+
+// addPeers dials the given addresses while there is room for more peers.
+// Addresses are not redialed within a minute.
+func (s *swarm) addPeers(ctx context.Context, addrs []string) {
+	for _, addr := range addrs {
+		s.mu.Lock()
+		_, connected := s.peers[addr]
+		recent := time.Since(s.tried[addr]) < time.Minute
+		full := len(s.peers) >= s.config.Torrent.MaxPeers
+		if connected || recent || full || s.bad[addr] >= 3 {
+			s.mu.Unlock()
+			continue
+		}
+		s.tried[addr] = time.Now()
+		s.mu.Unlock()
+		go s.dial(ctx, addr)
+	}
+}
+
+// dial connects to a peer and runs the connection until it ends
+func (s *swarm) dial(ctx context.Context, addr string) {
+	conn, err := newDialContext(s.config)(ctx, "tcp", addr)
+	if err != nil {
+		return
+	}
+	p, err := handshakePeer(ctx, s, conn, addr, true)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	s.runPeer(ctx, p)
+}
+
+// accept serves incoming peer connections
+func (s *swarm) accept(ctx context.Context, l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			p, err := handshakePeer(ctx, s, conn, conn.RemoteAddr().String(), false)
+			if err != nil {
+				conn.Close()
+				return
+			}
+			s.runPeer(ctx, p)
+		}()
+	}
+}
+
+// runPeer registers p and exchanges messages with it until it disconnects
+func (s *swarm) runPeer(ctx context.Context, p *peerConn) {
+	s.mu.Lock()
+	if _, dup := s.peers[p.addr]; dup || len(s.peers) >= s.config.Torrent.MaxPeers {
+		s.mu.Unlock()
+		p.conn.Close()
+		return
+	}
+	s.peers[p.addr] = p
+	s.mu.Unlock()
+
+	err := p.run(ctx)
+	p.conn.Close()
+	if p.piece != nil {
+		s.release(p.piece)
+	}
+	s.mu.Lock()
+	delete(s.peers, p.addr)
+	s.mu.Unlock()
+	if s.config.Verbose && !s.config.Quiet && err != nil && ctx.Err() == nil {
+		fmt.Printf("Peer %s: %v\n", p.addr, err)
+	}
+}
+
+// listen opens the port incoming peers connect to, falling back to any free
+// port when the configured one is taken
+func (s *swarm) listen() (net.Listener, error) {
+	l, err := net.Listen("tcp", ":"+strconv.Itoa(s.config.Torrent.Port))
+	if err != nil {
+		if l, err = net.Listen("tcp", ":0"); err != nil {
+			return nil, err
+		}
+	}
+	s.port = l.Addr().(*net.TCPAddr).Port
+	return l, nil
+}
+
+// waitFor waits until ch is closed. It fails if no piece data (or metadata)
+// has arrived for the -timeout period, so a dead swarm is retried rather
+// than waited on forever.
+func (s *swarm) waitFor(ctx context.Context, ch chan struct{}) error {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ch:
+			return nil
+		case err := <-s.failed:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			idle := time.Since(time.Unix(0, atomic.LoadInt64(&s.lastData)))
+			if s.config.Timeout <= 0 || idle <= s.config.Timeout {
+				continue
+			}
+			s.mu.Lock()
+			peers, trackerErr := len(s.peers), s.trackerErr
+			s.mu.Unlock()
+			if peers == 0 && trackerErr != nil {
+				return fmt.Errorf("torrent stalled: no peers in %v (tracker: %v): %w", s.config.Timeout, trackerErr, context.DeadlineExceeded)
+			}
+			return fmt.Errorf("torrent stalled: no data from %d peers in %v: %w", peers, s.config.Timeout, context.DeadlineExceeded)
+		}
+	}
+}
+
+// seed keeps uploading after the download until the -seed-ratio or
+// -seed-time limit is reached, whichever comes first, or until interrupted
+func (s *swarm) seed(ctx context.Context, size int64) {
+	opts := s.config.Torrent
+	if opts.SeedRatio <= 0 && opts.SeedTime <= 0 {
+		return
+	}
+	if !s.config.Quiet {
+		fmt.Println("Seeding... (Ctrl-C to stop)")
+	}
+	started := time.Now()
+	var deadline <-chan time.Time
+	if opts.SeedTime > 0 {
+		timer := time.NewTimer(opts.SeedTime)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	ratio := func() float64 {
+		if size == 0 {
+			return 0
+		}
+		return float64(atomic.LoadInt64(&s.uploaded)) / float64(size)
+	}
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			break loop
+		case <-deadline:
+			break loop
+		case <-ticker.C:
+			if opts.SeedRatio > 0 && ratio() >= opts.SeedRatio {
+				break loop
+			}
+		}
+	}
+	if !s.config.Quiet {
+		fmt.Printf("Uploaded %s (ratio %.2f)\n", formatByteSize(atomic.LoadInt64(&s.uploaded)), ratio())
+	}
+	s.config.Events.Emit("seed", map[string]interface{}{
+		"uploaded":   atomic.LoadInt64(&s.uploaded),
+		"ratio":      ratio(),
+		"duration_s": time.Since(started).Seconds(),
+	})
+}
+
+// startTorrentBar shows the progress bar, following s.progress until the
+// returned function is called
+func startTorrentBar(config *Config, s *swarm, offset, size int64) func() {
+	bar := newProgressBar(config, offset, size)
+	if bar == nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				bar.Set(int(s.progress()))
+				bar.Finish()
+				return
+			case <-ticker.C:
+				bar.Set(int(s.progress()))
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-finished
+	}
+}
+
+// downloadTorrent downloads the content of a .torrent file or magnet link
+// from the peers its trackers return. Pieces already on disk are verified
+// and kept, so retries and later runs continue where they stopped.
+func downloadTorrent(ctx context.Context, config *Config) error {
+	meta, err := loadTorrent(ctx, config)
+	if err != nil {
+		return err
+	}
+	if len(meta.Trackers) == 0 && len(meta.Peers) == 0 {
+		return &UsageError{errors.New("torrent has no trackers or peers (DHT is not supported)")}
+	}
+
+	s := newSwarm(config, meta)
+	if meta.InfoBytes != nil {
+		if err := s.setInfo(meta.InfoBytes); err != nil {
+			return err
+		}
+	}
+	l, err := s.listen()
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go s.accept(ctx, l)
+	s.addPeers(ctx, meta.Peers)
+	announced := s.announceAll(ctx)
+
+	if s.getInfo() == nil && !config.Quiet {
+		fmt.Println("Fetching torrent metadata from peers...")
+	}
+	if err := s.waitFor(ctx, s.infoReady); err != nil {
+		return err
+	}
+	info := s.getInfo()
+	defer s.storage.Close()
+	if info.Multi && config.Checksum != "" {
+		return &UsageError{fmt.Errorf("checksums cannot be verified for multi-file torrent %s", info.Name)}
+	}
+	config.FilePath = s.outputPath(info)
+
+	s.mu.Lock()
+	offset := info.Length - s.left
+	s.mu.Unlock()
+	if !config.Quiet {
+		if offset == info.Length {
+			fmt.Printf("Already complete: %s\n", config.FilePath)
+		} else {
+			if offset > 0 {
+				fmt.Println("Resuming download...")
+			}
+			fmt.Printf("Downloading to: %s\n", config.FilePath)
+		}
+	}
+	config.Events.Emit("start", map[string]interface{}{
+		"url":       redactQuery(config.URL),
+		"path":      config.FilePath,
+		"size":      info.Length,
+		"offset":    offset,
+		"info_hash": hex.EncodeToString(meta.InfoHash[:]),
+		"pieces":    len(info.Pieces),
+		"files":     len(info.Files),
+	})
+
+	stopEvents := startProgressEvents(config, func() int64 { return s.progress() - offset }, offset, info.Length)
+	stopBar := func() {}
+	if offset < info.Length {
+		stopBar = startTorrentBar(config, s, offset, info.Length)
+	}
+	atomic.StoreInt64(&s.lastData, time.Now().UnixNano())
+	err = s.waitFor(ctx, s.done)
+	stopEvents()
+	stopBar()
+	if err != nil {
+		return err
+	}
+
+	s.seed(ctx, info.Length)
+	// Let the trackers know we are leaving
+	cancel()
+	<-announced
+	return s.storage.Close()
+}
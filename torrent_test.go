@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testTorrent returns random content and the info dictionary describing it
+// as a single file split into 16 KiB pieces
+func testTorrent(t *testing.T, size int) (content, info []byte) {
+	t.Helper()
+	content = make([]byte, size)
+	rand.Read(content)
+	var pieces []byte
+	for off := 0; off < size; off += blockSize {
+		end := off + blockSize
+		if end > size {
+			end = size
+		}
+		sum := sha1.Sum(content[off:end])
+		pieces = append(pieces, sum[:]...)
+	}
+	info = bencode(map[string]interface{}{
+		"name":         "content.bin",
+		"length":       size,
+		"piece length": blockSize,
+		"pieces":       pieces,
+	})
+	return content, info
+}
+
+func TestParseTorrentFile(t *testing.T) {
+	_, info := testTorrent(t, 40000)
+	list := bencode([]interface{}{[]interface{}{"udp://t.example:6969"}, []interface{}{"http://t.example/ann"}})
+	data := []byte("d8:announce" + string(bencode("http://t.example/ann")) +
+		"13:announce-list" + string(list) + "4:info" + string(info) + "e")
+	meta, err := parseTorrentFile(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.InfoHash != sha1.Sum(info) || !bytes.Equal(meta.InfoBytes, info) {
+		t.Errorf("info hash taken over %q", meta.InfoBytes)
+	}
+	if want := []string{"udp://t.example:6969", "http://t.example/ann"}; len(meta.Trackers) != 2 || meta.Trackers[0] != want[0] || meta.Trackers[1] != want[1] {
+		t.Errorf("trackers = %q, want %q", meta.Trackers, want)
+	}
+
+	bad := []map[string]interface{}{
+		{"name": "../x", "length": 1, "piece length": 16, "pieces": string(make([]byte, 20))},
+		{"name": "x", "length": 100, "piece length": 16, "pieces": string(make([]byte, 20))},
+		{"name": "x", "length": 1, "piece length": 0, "pieces": string(make([]byte, 20))},
+		{"name": "x", "length": 1, "piece length": maxPieceLength + 1, "pieces": string(make([]byte, 20))},
+		{"name": "x", "piece length": 16, "pieces": string(make([]byte, 20)), "files": []interface{}{
+			map[string]interface{}{"length": 1, "path": []interface{}{"..", "etc"}},
+		}},
+	}
+	for _, d := range bad {
+		if _, err := parseTorrentInfo(bencode(d)); err == nil {
+			t.Errorf("parseTorrentInfo accepted %v", d)
+		}
+	}
+}
+
+func TestParseMagnet(t *testing.T) {
+	hash := "c12fe1c06bba254a9dc9f519b335aa7c1367a88a"
+	meta, err := parseMagnet("magnet:?xt=urn:btih:" + hash + "&dn=ubuntu.iso&tr=udp%3A%2F%2Ft.example%3A6969&tr=http%3A%2F%2Ft.example%2Fann&x.pe=10.0.0.1:6881")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(meta.InfoHash[:]) != hash || meta.Name != "ubuntu.iso" || len(meta.Trackers) != 2 || len(meta.Peers) != 1 {
+		t.Errorf("parseMagnet = %+v", meta)
+	}
+	base32, err := parseMagnet("magnet:?xt=urn:btih:YEX6DQDLXISUVHOJ6UM3GNNKPQJWPKEK")
+	if err != nil || base32.InfoHash != meta.InfoHash {
+		t.Errorf("base32 info hash = %x, %v", base32.InfoHash, err)
+	}
+	for _, raw := range []string{"magnet:?dn=x", "magnet:?xt=urn:btih:abc"} {
+		if _, err := parseMagnet(raw); err == nil {
+			t.Errorf("parseMagnet(%s) succeeded", raw)
+		}
+	}
+}
+
+// metadataSwarm returns a swarm waiting for the metadata of info
+func metadataSwarm(t *testing.T, info []byte) *swarm {
+	config := &Config{Quiet: true, FilePath: filepath.Join(t.TempDir(), "content.bin"), Torrent: TorrentOptions{MaxPeers: 4}}
+	return newSwarm(config, &torrentMeta{InfoHash: sha1.Sum(info)})
+}
+
+func TestSwarmMetadata(t *testing.T) {
+	_, info := testTorrent(t, 8000*blockSize) // 8000 piece hashes span 10 metadata pieces
+	s := metadataSwarm(t, info)
+	if !s.setMetadataSize(len(info)) {
+		t.Fatal("setMetadataSize rejected the first size")
+	}
+	pieces := (len(info) + blockSize - 1) / blockSize
+	for i := 0; i < pieces-1; i++ {
+		s.metadataPiece(i, info[i*blockSize:(i+1)*blockSize])
+	}
+
+	// A later peer announcing another size must not discard the pieces
+	if s.setMetadataSize(len(info) + 1) {
+		t.Error("setMetadataSize accepted a second size")
+	}
+	for _, i := range []int{-1, pieces, 1 << 30} {
+		s.metadataPiece(i, []byte("junk"))
+	}
+	if s.getInfo() != nil {
+		t.Fatal("info installed before the last piece")
+	}
+	s.metadataPiece(pieces-1, info[(pieces-1)*blockSize:])
+	select {
+	case <-s.infoReady:
+	default:
+		t.Fatal("info not installed once every piece arrived")
+	}
+	if got := s.getInfo(); got == nil || got.Length != 8000*blockSize {
+		t.Fatalf("info = %+v", got)
+	}
+}
+
+func TestSwarmMetadataStartsOverAfterBadData(t *testing.T) {
+	_, info := testTorrent(t, 100*blockSize)
+	s := metadataSwarm(t, info)
+	s.setMetadataSize(len(info) + 10)
+	s.metadataPiece(0, append(append([]byte(nil), info...), make([]byte, 10)...))
+	if s.getInfo() != nil {
+		t.Fatal("info installed from data that does not match the info hash")
+	}
+	// The size a lying peer announced is dropped along with its data
+	if !s.setMetadataSize(len(info)) {
+		t.Fatal("setMetadataSize rejected a new size after bad data")
+	}
+	s.metadataPiece(0, info)
+	if s.getInfo() == nil {
+		t.Fatal("info not installed from the right data")
+	}
+}
+
+func TestHandleExtendedNegativeMetadataPiece(t *testing.T) {
+	_, info := testTorrent(t, 4*blockSize)
+	s := metadataSwarm(t, info)
+	s.setMetadataSize(len(info))
+	p := &peerConn{s: s}
+
+	for _, piece := range []int{-1, -1 << 40} {
+		msg := append([]byte{utMetadataID}, bencode(map[string]interface{}{"msg_type": 1, "piece": piece})...)
+		if err := p.handleExtended(append(msg, "data"...)); err != nil {
+			t.Errorf("handleExtended(piece %d) = %v", piece, err)
+		}
+	}
+	if err := p.handleExtended([]byte{0, 'l'}); err == nil {
+		t.Error("handleExtended accepted a malformed handshake")
+	}
+}
+
+// testTracker hands every announcing peer the others' addresses over HTTP
+// (BEP 3, compact) and UDP (BEP 15)
+type testTracker struct {
+	mu    sync.Mutex
+	peers map[int]bool // listen ports on 127.0.0.1
+	seen  chan int     // ports as they announce
+}
+
+func newTestTracker() *testTracker {
+	return &testTracker{peers: map[int]bool{}, seen: make(chan int, 64)}
+}
+
+// announce records port and returns the others in compact form
+func (tr *testTracker) announce(port int, event string) []byte {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if event == "stopped" {
+		delete(tr.peers, port)
+		return nil
+	}
+	tr.peers[port] = true
+	select {
+	case tr.seen <- port:
+	default:
+	}
+	var compact []byte
+	for p := range tr.peers {
+		if p != port {
+			compact = append(compact, 127, 0, 0, 1, byte(p>>8), byte(p))
+		}
+	}
+	return compact
+}
+
+func (tr *testTracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	port, _ := strconv.Atoi(r.URL.Query().Get("port"))
+	peers := tr.announce(port, r.URL.Query().Get("event"))
+	w.Write(bencode(map[string]interface{}{"interval": 60, "peers": peers}))
+}
+
+func (tr *testTracker) serveUDP(conn net.PacketConn) {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if n < 16 {
+			continue
+		}
+		action, txID := binary.BigEndian.Uint32(buf[8:]), buf[12:16]
+		switch {
+		case action == 0 && binary.BigEndian.Uint64(buf) == 0x41727101980:
+			resp := make([]byte, 16)
+			copy(resp[4:], txID)
+			binary.BigEndian.PutUint64(resp[8:], 0xC0FFEE)
+			conn.WriteTo(resp, addr)
+		case action == 1 && n >= 98 && binary.BigEndian.Uint64(buf) == 0xC0FFEE:
+			event := map[uint32]string{1: "completed", 2: "started", 3: "stopped"}[binary.BigEndian.Uint32(buf[80:])]
+			peers := tr.announce(int(binary.BigEndian.Uint16(buf[96:])), event)
+			resp := make([]byte, 20, 20+len(peers))
+			binary.BigEndian.PutUint32(resp, 1)
+			copy(resp[4:], txID)
+			binary.BigEndian.PutUint32(resp[8:], 60)
+			conn.WriteTo(append(resp, peers...), addr)
+		}
+	}
+}
+
+func TestAnnounceUDP(t *testing.T) {
+	tr := newTestTracker()
+	tr.announce(6881, "started")
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go tr.serveUDP(pc)
+	addr := pc.LocalAddr().String()
+
+	tests := []struct {
+		name    string
+		tracker string
+		dial    DialOptions
+		ok      bool
+	}{
+		{"direct", "udp://" + addr, DialOptions{}, true},
+		{"-local-addr", "udp://" + addr, DialOptions{LocalAddr: net.ParseIP("127.0.0.1")}, true},
+		{"-connect-to", "udp://tracker.invalid:6969", DialOptions{ConnectTo: map[string]string{"tracker.invalid:6969": addr}}, true},
+		{"-6 with an IPv4 tracker", "udp://" + addr, DialOptions{Network: "tcp6"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := metadataSwarm(t, []byte("d4:name1:xe"))
+			s.config.Dial = tt.dial
+			u, _ := url.Parse(tt.tracker)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			peers, _, err := s.announceUDP(ctx, u, "started")
+			if !tt.ok {
+				if err == nil {
+					t.Fatalf("announce succeeded with peers %v", peers)
+				}
+				return
+			}
+			if err != nil || len(peers) != 1 || peers[0] != "127.0.0.1:6881" {
+				t.Fatalf("announce = %v, %v; want the other peer", peers, err)
+			}
+		})
+	}
+}
+
+func TestAnnounceUDPStopsWhenCancelled(t *testing.T) {
+	// A tracker that never answers
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	u, _ := url.Parse("udp://" + pc.LocalAddr().String())
+
+	tests := []struct {
+		name string
+		ctx  func() (context.Context, context.CancelFunc)
+	}{
+		{"cancelled", func() (context.Context, context.CancelFunc) {
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(100*time.Millisecond, cancel)
+			return ctx, cancel
+		}},
+		{"deadline", func() (context.Context, context.CancelFunc) {
+			return context.WithTimeout(context.Background(), 100*time.Millisecond)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := tt.ctx()
+			defer cancel()
+			start := time.Now()
+			_, _, err := metadataSwarm(t, []byte("d4:name1:xe")).announceUDP(ctx, u, "started")
+			if err == nil {
+				t.Fatal("announce to a silent tracker succeeded")
+			}
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Errorf("announce returned %v after the context ended", elapsed)
+			}
+		})
+	}
+}
+
+// startSeeder seeds content, with the .torrent file announcing to tracker,
+// until ctx is done. corrupt overwrites the content once the seeder has
+// checked it, so the seeder offers every piece but serves garbage.
+func startSeeder(ctx context.Context, t *testing.T, tr *testTracker, tracker string, content, info []byte, corrupt bool) <-chan error {
+	t.Helper()
+	dir := t.TempDir()
+	torrentFile := filepath.Join(dir, "content.torrent")
+	contentFile := filepath.Join(dir, "content.bin")
+	data := []byte("d8:announce" + string(bencode(tracker)) + "4:info" + string(info) + "e")
+	if err := ioutil.WriteFile(torrentFile, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(contentFile, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{
+		URL:      (&url.URL{Scheme: "file", Path: filepath.ToSlash(torrentFile)}).String(),
+		FilePath: contentFile,
+		Quiet:    true,
+		Timeout:  10 * time.Second,
+		Torrent:  TorrentOptions{Follow: true, MaxPeers: 8, SeedTime: time.Hour},
+	}
+	done := make(chan error, 1)
+	go func() { done <- downloadTorrent(ctx, config) }()
+
+	select {
+	case <-tr.seen:
+	case err := <-done:
+		t.Fatalf("seeder stopped: %v", err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("seeder did not announce")
+	}
+	if corrupt {
+		garbage := make([]byte, len(content))
+		for i := range garbage {
+			garbage[i] = ^content[i]
+		}
+		if err := ioutil.WriteFile(contentFile, garbage, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return done
+}
+
+// leech downloads the torrent from a magnet link naming only the tracker,
+// so the info dictionary has to come from the peers
+func leech(ctx context.Context, tracker string, info []byte, path string, timeout time.Duration) error {
+	hash := sha1.Sum(info)
+	config := &Config{
+		URL:      "magnet:?xt=urn:btih:" + hex.EncodeToString(hash[:]) + "&tr=" + url.QueryEscape(tracker),
+		FilePath: path,
+		Quiet:    true,
+		Timeout:  timeout,
+		Torrent:  TorrentOptions{MaxPeers: 8},
+	}
+	return downloadTorrent(ctx, config)
+}
+
+func TestTorrentDownloadFromMagnet(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs a swarm on localhost")
+	}
+	content, info := testTorrent(t, 9*blockSize+1234)
+
+	for _, scheme := range []string{"http", "udp"} {
+		t.Run(scheme, func(t *testing.T) {
+			tr := newTestTracker()
+			var tracker string
+			if scheme == "http" {
+				srv := httptest.NewServer(tr)
+				defer srv.Close()
+				tracker = srv.URL + "/announce"
+			} else {
+				conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer conn.Close()
+				go tr.serveUDP(conn)
+				tracker = "udp://" + conn.LocalAddr().String()
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			var seeders []<-chan error
+			defer func() {
+				cancel()
+				for _, done := range seeders {
+					if err := <-done; err != nil && !errors.Is(err, context.Canceled) {
+						t.Errorf("seeder: %v", err)
+					}
+				}
+			}()
+			path := filepath.Join(t.TempDir(), "content.bin")
+
+			// With only a peer serving corrupt pieces, every piece fails
+			// verification and the download stalls instead of finishing
+			seeders = append(seeders, startSeeder(ctx, t, tr, tracker, content, info, true))
+			err := leech(ctx, tracker, info, path, time.Second)
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Fatalf("download from a corrupt peer = %v, want a stall", err)
+			}
+
+			// A good seeder lets the download finish despite the corrupt one
+			seeders = append(seeders, startSeeder(ctx, t, tr, tracker, content, info, false))
+			if err := leech(ctx, tracker, info, path, 10*time.Second); err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, content) {
+				t.Fatal("downloaded content differs from the torrent")
+			}
+		})
+	}
+}
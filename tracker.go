@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Tracker announce intervals are bounded so a misconfigured tracker can
+// neither be hammered nor leave us without peers for hours
+const (
+	minAnnounceInterval = 30 * time.Second
+	maxAnnounceInterval = 30 * time.Minute
+)
+
+// announceAll announces to every tracker in the background, announcing again
+// at the interval each one asks for and when the download completes. The
+// returned channel is closed once the final "stopped" announces have been
+// sent after ctx is done.
+func (s *swarm) announceAll(ctx context.Context) <-chan struct{} {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, tracker := range s.meta.Trackers {
+		wg.Add(1)
+		go func(tracker string) {
+			defer wg.Done()
+			s.announceLoop(ctx, tracker)
+		}(tracker)
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	return done
+}
+
+func (s *swarm) announceLoop(ctx context.Context, tracker string) {
+	event := "started"
+	completed := s.done
+	select {
+	case <-s.done:
+		// Only a download that finishes now is reported as completed
+		completed = nil
+	default:
+	}
+
+	started := false
+	backoff := 15 * time.Second
+	for {
+		peers, interval, err := s.announce(ctx, tracker, event)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			s.mu.Lock()
+			s.trackerErr = err
+			s.mu.Unlock()
+			if s.config.Verbose && !s.config.Quiet {
+				fmt.Printf("Tracker %s: %v\n", redactQuery(tracker), err)
+			}
+			interval = backoff
+			if backoff < maxAnnounceInterval {
+				backoff *= 2
+			}
+		} else {
+			started, event, backoff = true, "", 15*time.Second
+			s.addPeers(ctx, peers)
+		}
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+		case <-timer.C:
+		case <-completed:
+			completed = nil
+			if started {
+				event = "completed"
+			}
+		}
+		timer.Stop()
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	if started {
+		stopCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		select {
+		case <-completed:
+			// Finished and leaving at once, without seeding
+			s.announce(stopCtx, tracker, "completed")
+		default:
+		}
+		s.announce(stopCtx, tracker, "stopped")
+		cancel()
+	}
+}
+
+// announce sends one announce and returns the peers and the interval until
+// the next one
+func (s *swarm) announce(ctx context.Context, tracker, event string) ([]string, time.Duration, error) {
+	u, err := url.Parse(tracker)
+	if err != nil {
+		return nil, 0, err
+	}
+	var peers []string
+	var interval time.Duration
+	switch u.Scheme {
+	case "http", "https":
+		peers, interval, err = s.announceHTTP(ctx, u, event)
+	case "udp":
+		peers, interval, err = s.announceUDP(ctx, u, event)
+	default:
+		return nil, 0, fmt.Errorf("unsupported tracker scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if interval < minAnnounceInterval {
+		interval = minAnnounceInterval
+	} else if interval > maxAnnounceInterval {
+		interval = maxAnnounceInterval
+	}
+	return peers, interval, nil
+}
+
+// announceStats returns the uploaded, downloaded and left counters trackers
+// expect. left is unknown until a magnet link's metadata arrives; reporting
+// a positive value keeps us listed as a leecher.
+func (s *swarm) announceStats() (uploaded, downloaded, left int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	left = 1
+	if s.info != nil {
+		left = s.left
+	}
+	return atomic.LoadInt64(&s.uploaded), atomic.LoadInt64(&s.verified), left
+}
+
+// escapeBytes percent-encodes binary query values such as the info hash
+func escapeBytes(b []byte) string {
+	var sb strings.Builder
+	for _, c := range b {
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("-._~", c) >= 0 {
+			sb.WriteByte(c)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
+
+// announceHTTP announces to an HTTP tracker (BEP 3), asking for the compact
+// peer list (BEP 23)
+func (s *swarm) announceHTTP(ctx context.Context, u *url.URL, event string) ([]string, time.Duration, error) {
+	uploaded, downloaded, left := s.announceStats()
+	query := fmt.Sprintf("info_hash=%s&peer_id=%s&port=%d&uploaded=%d&downloaded=%d&left=%d&compact=1&numwant=%d",
+		escapeBytes(s.meta.InfoHash[:]), escapeBytes(s.peerID[:]), s.port, uploaded, downloaded, left, s.config.Torrent.MaxPeers)
+	if event != "" {
+		query += "&event=" + event
+	}
+	target := *u
+	if target.RawQuery != "" {
+		target.RawQuery += "&" + query
+	} else {
+		target.RawQuery = query
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if s.config.UserAgent != "" {
+		req.Header.Set("User-Agent", s.config.UserAgent)
+	}
+	resp, err := doRequest(s.config, httpClient(s.config), req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, &HTTPError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, 0, err
+	}
+	v, err := bdecode(body)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid tracker response: %w", err)
+	}
+	d, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, 0, errors.New("invalid tracker response")
+	}
+	if reason := bstring(d, "failure reason"); reason != "" {
+		return nil, 0, fmt.Errorf("tracker refused announce: %s", reason)
+	}
+
+	var peers []string
+	switch p := d["peers"].(type) {
+	case string:
+		peers = parseCompactPeers([]byte(p), net.IPv4len)
+	case []interface{}:
+		// The original dictionary model
+		for _, item := range p {
+			pd, _ := item.(map[string]interface{})
+			if ip, port := bstring(pd, "ip"), bint(pd, "port"); ip != "" && port > 0 {
+				peers = append(peers, net.JoinHostPort(ip, strconv.FormatInt(port, 10)))
+			}
+		}
+	}
+	peers = append(peers, parseCompactPeers([]byte(bstring(d, "peers6")), net.IPv6len)...)
+	return peers, time.Duration(bint(d, "interval")) * time.Second, nil
+}
+
+// parseCompactPeers decodes peers packed as an address of ipLen bytes
+// followed by a two-byte port
+func parseCompactPeers(b []byte, ipLen int) []string {
+	var peers []string
+	for ; len(b) >= ipLen+2; b = b[ipLen+2:] {
+		ip := net.IP(append([]byte(nil), b[:ipLen]...))
+		port := binary.BigEndian.Uint16(b[ipLen:])
+		peers = append(peers, net.JoinHostPort(ip.String(), strconv.Itoa(int(port))))
+	}
+	return peers
+}
+
+// udpTrackerEvents numbers the announce events for UDP trackers
+var udpTrackerEvents = map[string]uint32{"": 0, "completed": 1, "started": 2, "stopped": 3}
+
+// announceUDP announces to a UDP tracker (BEP 15): a connect exchange for a
+// connection ID, then the announce itself
+func (s *swarm) announceUDP(ctx context.Context, u *url.URL, event string) ([]string, time.Duration, error) {
+	conn, err := newDialContext(s.config)(ctx, "udp", u.Host)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Unix(1, 0)) })
+	defer stop()
+
+	connect := make([]byte, 16)
+	binary.BigEndian.PutUint64(connect, 0x41727101980) // protocol magic
+	resp, err := udpTrackerRoundTrip(ctx, conn, connect, 0)
+	if err != nil || len(resp) < 16 {
+		return nil, 0, timeoutError(ctx, fmt.Errorf("UDP tracker connect failed: %v", err))
+	}
+	connID := binary.BigEndian.Uint64(resp[8:])
+
+	uploaded, downloaded, left := s.announceStats()
+	req := make([]byte, 98)
+	binary.BigEndian.PutUint64(req[0:], connID)
+	copy(req[16:], s.meta.InfoHash[:])
+	copy(req[36:], s.peerID[:])
+	binary.BigEndian.PutUint64(req[56:], uint64(downloaded))
+	binary.BigEndian.PutUint64(req[64:], uint64(left))
+	binary.BigEndian.PutUint64(req[72:], uint64(uploaded))
+	binary.BigEndian.PutUint32(req[80:], udpTrackerEvents[event])
+	rand.Read(req[88:92]) // key
+	binary.BigEndian.PutUint32(req[92:], uint32(s.config.Torrent.MaxPeers))
+	binary.BigEndian.PutUint16(req[96:], uint16(s.port))
+	resp, err = udpTrackerRoundTrip(ctx, conn, req, 1)
+	if err != nil {
+		return nil, 0, timeoutError(ctx, err)
+	}
+	if len(resp) < 20 {
+		return nil, 0, errors.New("short UDP tracker response")
+	}
+
+	ipLen := net.IPv4len
+	if addr, ok := conn.RemoteAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		ipLen = net.IPv6len
+	}
+	interval := time.Duration(binary.BigEndian.Uint32(resp[8:])) * time.Second
+	return parseCompactPeers(resp[20:], ipLen), interval, nil
+}
+
+// udpTrackerRoundTrip sends req with a fresh transaction ID and waits for the
+// matching response, retrying with growing timeouts that end no later than ctx
+func udpTrackerRoundTrip(ctx context.Context, conn net.Conn, req []byte, action uint32) ([]byte, error) {
+	binary.BigEndian.PutUint32(req[8:], action)
+	rand.Read(req[12:16])
+	txID := binary.BigEndian.Uint32(req[12:])
+
+	buf := make([]byte, 64<<10)
+	var err error
+	for attempt := uint(0); attempt < 3; attempt++ {
+		if _, err = conn.Write(req); err != nil {
+			return nil, err
+		}
+		deadline := time.Now().Add((5 * time.Second) << attempt)
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		conn.SetReadDeadline(deadline)
+		// This may have replaced the deadline set when ctx was cancelled
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		for {
+			var n int
+			if n, err = conn.Read(buf); err != nil {
+				break
+			}
+			if n < 8 || binary.BigEndian.Uint32(buf[4:]) != txID {
+				continue
+			}
+			switch binary.BigEndian.Uint32(buf) {
+			case action:
+				return buf[:n], nil
+			case 3:
+				return nil, fmt.Errorf("tracker refused announce: %s", buf[8:n])
+			}
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		var netErr net.Error
+		if !errors.As(err, &netErr) || !netErr.Timeout() {
+			return nil, err
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// RemoteChangedError is returned when a resumed request reports a different
+// ETag than the one the partial file was downloaded from
+type RemoteChangedError struct {
+	OldETag string
+	NewETag string
+}
+
+func (e *RemoteChangedError) Error() string {
+	return fmt.Sprintf("remote file changed during download (ETag %s, now %s); remove the partial file to start over", e.OldETag, e.NewETag)
+}
+
+// checkETag records the ETag of the first response and verifies that later
+// responses (after a retry, resume or URL refresh) still serve the same object
+func checkETag(config *Config, resp *http.Response) error {
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		return nil
+	}
+	// Duplicates (RFC 6249) serve the same file but need not share its ETag
+	if len(config.mirrors) > 0 && config.URL != config.mirrors[0] {
+		return nil
+	}
+	if config.etag == "" {
+		config.etag = etag
+		return nil
+	}
+	if etag != config.etag {
+		return &RemoteChangedError{OldETag: config.etag, NewETag: etag}
+	}
+	return nil
+}
+
+// etagPath is where the ETag of a partial download is kept between runs, so
+// a later -r notices when the remote file changed in the meantime
+func etagPath(filePath string) string {
+	return filePath + ".dletag"
+}
+
+// loadETag takes the ETag saved next to a partial file when this process
+// has not seen one yet
+func loadETag(config *Config, filePath string) {
+	if config.etag != "" {
+		return
+	}
+	if data, err := ioutil.ReadFile(etagPath(filePath)); err == nil {
+		config.etag = strings.TrimSpace(string(data))
+	}
+}
+
+// saveETag keeps config.etag next to the partial file until the download
+// completes, removing a stale one when the response had none
+func saveETag(config *Config, filePath string) {
+	if config.etag == "" {
+		os.Remove(etagPath(filePath))
+		return
+	}
+	ioutil.WriteFile(etagPath(filePath), []byte(config.etag+"\n"), 0666)
+}
+
+// shouldRefreshURL reports whether err looks like an expired presigned URL
+// that -url-cmd can replace: a 401 or 403 once part of the file is on disk
+func shouldRefreshURL(config *Config, err error) bool {
+	if config.URLCommand == "" || config.FilePath == "" {
+		return false
+	}
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) {
+		return false
+	}
+	if httpErr.StatusCode != http.StatusUnauthorized && httpErr.StatusCode != http.StatusForbidden {
+		return false
+	}
+	fi, statErr := os.Stat(config.FilePath)
+	return statErr == nil && fi.Size() > 0
+}
+
+// refreshURL runs -url-cmd and switches the download to the URL it prints on
+// the first non-empty line of stdout. The download then resumes with a Range
+// request from the current offset.
+func refreshURL(ctx context.Context, config *Config) error {
+	if !config.Quiet {
+		fmt.Println("URL rejected after partial download, requesting a fresh URL...")
+	}
+
+	cmd := shellCommand(ctx, config.URLCommand)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("-url-cmd failed: %w", err)
+	}
+
+	var fresh string
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			fresh = line
+			break
+		}
+	}
+	if _, err := url.ParseRequestURI(fresh); err != nil {
+		return fmt.Errorf("-url-cmd printed an invalid URL %q", fresh)
+	}
+
+	config.Events.Emit("url_refresh", map[string]interface{}{"url": redactQuery(fresh)})
+	config.URL = fresh
+	config.Resume = true
+	return nil
+}
+
+// redactQuery strips the query string, which carries the signature of a
+// presigned URL, before a URL is logged
+func redactQuery(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	u.RawQuery = ""
+	u.User = nil
+	return u.String()
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// objectServer serves body with an ETag and Range support. While cut is
+// set, a full GET is dropped after half the body, as by a failing network.
+type objectServer struct {
+	mu   sync.Mutex
+	body []byte
+	etag string
+	cut  bool
+	sig  string // when set, the query must carry sig=<sig> or the server answers 403
+}
+
+func (s *objectServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	body, etag, cut, sig := s.body, s.etag, s.cut, s.sig
+	s.mu.Unlock()
+	if sig != "" && r.URL.Query().Get("sig") != sig {
+		http.Error(w, "expired", http.StatusForbidden)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	if cut && r.Header.Get("Range") == "" {
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.Write(body[:len(body)/2])
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+}
+
+func (s *objectServer) set(f func(s *objectServer)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f(s)
+}
+
+func TestResumeChecksSavedETag(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789"), 10000)
+	tests := []struct {
+		name    string
+		newETag string
+		changed bool
+	}{
+		{"unchanged", `"v1"`, false},
+		{"changed", `"v2"`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			obj := &objectServer{body: body, etag: `"v1"`, cut: true}
+			srv := httptest.NewServer(obj)
+			defer srv.Close()
+			path := filepath.Join(t.TempDir(), "object.bin")
+
+			// The first run stops halfway, leaving the partial file and its ETag
+			first := &Config{URL: srv.URL + "/object.bin", FilePath: path, Quiet: true}
+			if err := downloadWithRetry(context.Background(), first); err == nil {
+				t.Fatal("the interrupted download succeeded")
+			}
+			if saved, err := ioutil.ReadFile(etagPath(path)); err != nil || string(saved) != "\"v1\"\n" {
+				t.Fatalf("saved ETag = %q, %v", saved, err)
+			}
+
+			// A new process resumes once the object may have changed
+			obj.set(func(s *objectServer) { s.cut, s.etag = false, tt.newETag })
+			second := &Config{URL: srv.URL + "/object.bin", FilePath: path, Quiet: true, Resume: true}
+			err := downloadWithRetry(context.Background(), second)
+			if tt.changed {
+				var changed *RemoteChangedError
+				if !errors.As(err, &changed) || changed.OldETag != `"v1"` || changed.NewETag != `"v2"` {
+					t.Fatalf("resume = %v, want a RemoteChangedError from \"v1\" to \"v2\"", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := ioutil.ReadFile(path); !bytes.Equal(got, body) {
+				t.Fatalf("resumed file has %d bytes that differ from the object", len(got))
+			}
+			if _, err := os.Stat(etagPath(path)); !os.IsNotExist(err) {
+				t.Errorf("%s left behind after the download completed", etagPath(path))
+			}
+		})
+	}
+}
+
+func TestRefreshExpiredURL(t *testing.T) {
+	body := bytes.Repeat([]byte("abcdefghij"), 10000)
+	obj := &objectServer{body: body, etag: `"v1"`, cut: true, sig: "old"}
+	srv := httptest.NewServer(obj)
+	defer srv.Close()
+
+	var events bytes.Buffer
+	config := &Config{
+		URL:        srv.URL + "/object.bin?sig=old",
+		FilePath:   filepath.Join(t.TempDir(), "object.bin"),
+		Quiet:      true,
+		MaxRetries: 2,
+		URLCommand: "echo " + srv.URL + "/object.bin?sig=new",
+		Events:     NewEventLog(&events),
+	}
+	// The first signature expires once half the file is on disk
+	go func() {
+		for {
+			if fi, err := os.Stat(config.FilePath); err == nil && fi.Size() > 0 {
+				obj.set(func(s *objectServer) { s.cut, s.sig = false, "new" })
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	if err := downloadWithRetry(context.Background(), config); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ioutil.ReadFile(config.FilePath); !bytes.Equal(got, body) {
+		t.Fatalf("file has %d bytes that differ from the object", len(got))
+	}
+	refreshed := false
+	for _, e := range readEvents(t, &events) {
+		if e["event"] == "url_refresh" {
+			refreshed = true
+			if e["url"] != srv.URL+"/object.bin" {
+				t.Errorf("url_refresh url = %v, want it without the signature", e["url"])
+			}
+		}
+	}
+	if !refreshed {
+		t.Error("no url_refresh event")
+	}
+}
+
+func TestShouldRefreshURL(t *testing.T) {
+	dir := t.TempDir()
+	partial := filepath.Join(dir, "partial")
+	if err := ioutil.WriteFile(partial, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		cmd  string
+		path string
+		err  error
+		want bool
+	}{
+		{"403 with data on disk", "echo", partial, &HTTPError{StatusCode: 403}, true},
+		{"401 with data on disk", "echo", partial, &HTTPError{StatusCode: 401}, true},
+		{"no -url-cmd", "", partial, &HTTPError{StatusCode: 403}, false},
+		{"nothing on disk", "echo", filepath.Join(dir, "missing"), &HTTPError{StatusCode: 403}, false},
+		{"other status", "echo", partial, &HTTPError{StatusCode: 404}, false},
+		{"not an HTTP error", "echo", partial, errors.New("reset"), false},
+	}
+	for _, tt := range tests {
+		config := &Config{URLCommand: tt.cmd, FilePath: tt.path}
+		if got := shouldRefreshURL(config, tt.err); got != tt.want {
+			t.Errorf("%s: shouldRefreshURL = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
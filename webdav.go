@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// propfindBody asks for the properties needed to mirror a collection
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<D:propfind xmlns:D="DAV:"><D:prop>
+<D:resourcetype/><D:getcontentlength/><D:getlastmodified/><D:getetag/>
+</D:prop></D:propfind>`
+
+// isWebDAVURL reports whether raw is a webdav:// or webdavs:// URL
+func isWebDAVURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && (u.Scheme == "webdav" || u.Scheme == "webdavs")
+}
+
+// webdavHTTPURL maps webdav:// to http:// and webdavs:// to https://
+func webdavHTTPURL(u *url.URL) *url.URL {
+	target := *u
+	target.Scheme = "http"
+	if u.Scheme == "webdavs" {
+		target.Scheme = "https"
+	}
+	return &target
+}
+
+// davMultistatus is the body of a PROPFIND reply (RFC 4918 section 14.16)
+type davMultistatus struct {
+	Responses []struct {
+		Href     string `xml:"DAV: href"`
+		Propstat []struct {
+			Status string `xml:"DAV: status"`
+			Prop   struct {
+				ResourceType struct {
+					Collection *struct{} `xml:"DAV: collection"`
+				} `xml:"DAV: resourcetype"`
+				ContentLength string `xml:"DAV: getcontentlength"`
+				LastModified  string `xml:"DAV: getlastmodified"`
+				ETag          string `xml:"DAV: getetag"`
+			} `xml:"DAV: prop"`
+		} `xml:"DAV: propstat"`
+	} `xml:"DAV: response"`
+}
+
+// davEntry is a resource listed by PROPFIND
+type davEntry struct {
+	URL        *url.URL
+	Collection bool
+	Size       int64
+	ModTime    time.Time // zero if the server did not report it
+	ETag       string
+}
+
+// propfind lists u and, for a collection, its direct members. Depth 1 is
+// used because many servers refuse "Depth: infinity". The returned URL is
+// where the request ended up after redirects.
+func propfind(ctx context.Context, config *Config, u *url.URL) (*url.URL, []davEntry, error) {
+	req, err := http.NewRequestWithContext(ctx, "PROPFIND", u.String(), strings.NewReader(propfindBody))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", `application/xml; charset="utf-8"`)
+	req.Header.Set("Depth", "1")
+	applyHeaders(config, req)
+
+	resp, err := doRequest(config, httpClient(config), req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, nil, &HTTPError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	var ms davMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, nil, fmt.Errorf("invalid PROPFIND response from %s: %w", redactURL(u), err)
+	}
+	base := resp.Request.URL
+	var entries []davEntry
+	for _, r := range ms.Responses {
+		href, err := base.Parse(strings.TrimSpace(r.Href))
+		if err != nil {
+			continue
+		}
+		entry := davEntry{URL: href, Size: -1}
+		for _, ps := range r.Propstat {
+			// Properties the server does not have come back as 404
+			if fields := strings.Fields(ps.Status); len(fields) < 2 || fields[1] != "200" {
+				continue
+			}
+			entry.Collection = entry.Collection || ps.Prop.ResourceType.Collection != nil
+			if n, err := strconv.ParseInt(strings.TrimSpace(ps.Prop.ContentLength), 10, 64); err == nil {
+				entry.Size = n
+			}
+			if t, err := http.ParseTime(strings.TrimSpace(ps.Prop.LastModified)); err == nil {
+				entry.ModTime = t
+			}
+			if etag := strings.TrimSpace(ps.Prop.ETag); etag != "" {
+				entry.ETag = etag
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return base, entries, nil
+}
+
+// sameDAVPath reports whether two hrefs name the same resource, ignoring
+// the trailing slash collections may or may not be given
+func sameDAVPath(a, b *url.URL) bool {
+	return strings.TrimSuffix(a.Path, "/") == strings.TrimSuffix(b.Path, "/")
+}
+
+// davManifestName is the file in a mirrored collection recording the ETag of
+// every file downloaded into it
+const davManifestName = ".dlwebdav"
+
+// davRecord is what the manifest keeps about one file
+type davRecord struct {
+	ETag     string `json:"etag"`
+	Complete bool   `json:"complete"` // false while the file is being downloaded
+}
+
+// davMirror downloads a collection into a local directory
+type davMirror struct {
+	config   *Config
+	root     *url.URL
+	dir      string
+	manifest map[string]davRecord // keyed by slash-separated relative path
+
+	downloaded, skipped int
+}
+
+func (m *davMirror) loadManifest() {
+	m.manifest = map[string]davRecord{}
+	if data, err := ioutil.ReadFile(filepath.Join(m.dir, davManifestName)); err == nil {
+		json.Unmarshal(data, &m.manifest)
+	}
+}
+
+func (m *davMirror) saveManifest() error {
+	data, err := json.MarshalIndent(m.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(m.dir, davManifestName), data, 0666)
+}
+
+// relPath returns the path of u below the root collection, or false if u
+// lies outside it
+func (m *davMirror) relPath(u *url.URL) (string, bool) {
+	rootPath := strings.TrimSuffix(m.root.Path, "/") + "/"
+	rel := path.Clean("/" + strings.TrimPrefix(u.Path, rootPath))
+	if !strings.HasPrefix(u.Path, rootPath) || rel == "/" {
+		return "", false
+	}
+	return strings.TrimPrefix(rel, "/"), true
+}
+
+// walk mirrors the collection at u and everything below it
+func (m *davMirror) walk(ctx context.Context, u *url.URL) error {
+	self, entries, err := propfind(ctx, m.config, u)
+	if err != nil {
+		return err
+	}
+	return m.mirror(ctx, self, entries)
+}
+
+// mirror downloads the members of the collection self listed in entries
+func (m *davMirror) mirror(ctx context.Context, self *url.URL, entries []davEntry) error {
+	for _, e := range entries {
+		if sameDAVPath(e.URL, self) {
+			continue
+		}
+		rel, ok := m.relPath(e.URL)
+		if !ok {
+			continue
+		}
+		// A remote entry must not replace the manifest
+		if rel == davManifestName {
+			if !m.config.Quiet {
+				fmt.Printf("Warning: skipping %s, which has the name of the mirror manifest\n", redactURL(e.URL))
+			}
+			m.config.Events.Emit("skip", map[string]interface{}{
+				"url":    redactURL(e.URL),
+				"reason": "reserved name",
+			})
+			continue
+		}
+		if e.Collection {
+			if err := os.MkdirAll(filepath.Join(m.dir, filepath.FromSlash(rel)), 0777); err != nil {
+				return err
+			}
+			if err := m.walk(ctx, e.URL); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := m.fetch(ctx, e, rel); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unchanged reports whether the local copy of e is current: the size matches
+// and so does the ETag recorded when it was downloaded or, without one, the
+// modification time
+func (m *davMirror) unchanged(e davEntry, rel string, local os.FileInfo) bool {
+	if e.Size >= 0 && local.Size() != e.Size {
+		return false
+	}
+	if rec, ok := m.manifest[rel]; ok && rec.ETag != "" && e.ETag != "" {
+		return rec.Complete && rec.ETag == e.ETag
+	}
+	return !e.ModTime.IsZero() && local.ModTime().Equal(e.ModTime)
+}
+
+// fetch downloads one file unless the local copy is unchanged
+func (m *davMirror) fetch(ctx context.Context, e davEntry, rel string) error {
+	localPath := filepath.Join(m.dir, filepath.FromSlash(rel))
+	local, statErr := os.Stat(localPath)
+	if statErr == nil && m.unchanged(e, rel, local) {
+		m.skipped++
+		if !m.config.Quiet {
+			fmt.Printf("Unchanged: %s\n", localPath)
+		}
+		m.config.Events.Emit("skip", map[string]interface{}{
+			"url":    redactURL(e.URL),
+			"path":   localPath,
+			"reason": "unchanged",
+		})
+		return nil
+	}
+
+	file := *m.config
+	file.URL = e.URL.String()
+	file.FilePath = localPath
+	file.Method = ""
+	file.Body = nil
+	file.Checksum = ""
+	file.etag = ""
+	file.digest = nil
+	// Continue a partial file only if it is still the same version
+	rec := m.manifest[rel]
+	file.Resume = m.config.Resume && statErr == nil && !rec.Complete && rec.ETag != "" && rec.ETag == e.ETag
+	if !file.Resume && statErr == nil {
+		if err := os.Remove(localPath); err != nil {
+			return err
+		}
+	}
+
+	m.manifest[rel] = davRecord{ETag: e.ETag}
+	if err := m.saveManifest(); err != nil {
+		return err
+	}
+	if err := downloadFile(ctx, &file); err != nil {
+		return err
+	}
+	// The manifest keeps the file incomplete, so a bad copy is fetched again
+	if d := file.digest; d != nil {
+		if err := checkDownload(&file, d.Algorithm, d.Sum, "digest"); err != nil {
+			return fmt.Errorf("server Digest verification failed for %s: %w", localPath, err)
+		}
+	}
+	if !e.ModTime.IsZero() {
+		os.Chtimes(localPath, e.ModTime, e.ModTime)
+	}
+	m.manifest[rel] = davRecord{ETag: e.ETag, Complete: true}
+	m.downloaded++
+	return m.saveManifest()
+}
+
+// downloadWebDAV retrieves a webdav:// or webdavs:// URL. A collection is
+// mirrored recursively into a directory, skipping files whose ETag or
+// modification time shows they have not changed since the last run; a
+// single file is downloaded as over HTTP.
+func downloadWebDAV(ctx context.Context, config *Config) error {
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return err
+	}
+	target := webdavHTTPURL(u)
+
+	root, entries, err := propfind(ctx, config, target)
+	if err != nil {
+		return err
+	}
+	collection := false
+	for _, e := range entries {
+		if sameDAVPath(e.URL, root) {
+			collection = e.Collection
+		}
+	}
+	if !collection {
+		file := *config
+		file.URL = target.String()
+		err := downloadFile(ctx, &file)
+		// downloadWithRetry verifies the Digest of the file
+		config.FilePath, config.digest = file.FilePath, file.digest
+		return err
+	}
+
+	if config.Checksum != "" {
+		return &UsageError{fmt.Errorf("checksums cannot be verified for collection %s", redactURL(u))}
+	}
+	if config.FilePath == "" {
+		config.FilePath = path.Base(strings.TrimSuffix(root.Path, "/"))
+		if config.FilePath == "/" || config.FilePath == "." {
+			config.FilePath = root.Hostname()
+		}
+	}
+	if err := os.MkdirAll(config.FilePath, 0777); err != nil {
+		return err
+	}
+	if !config.Quiet {
+		fmt.Printf("Mirroring collection to: %s\n", config.FilePath)
+	}
+
+	m := &davMirror{config: config, root: root, dir: config.FilePath}
+	m.loadManifest()
+	if err := m.mirror(ctx, root, entries); err != nil {
+		return err
+	}
+	if !config.Quiet {
+		fmt.Printf("Downloaded %d files, %d unchanged\n", m.downloaded, m.skipped)
+	}
+	return nil
+}
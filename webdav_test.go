@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// davFile is a file served by davServer
+type davFile struct {
+	body      string
+	etag      string
+	badDigest bool // send a Digest header that does not match the body
+}
+
+// davServer answers PROPFIND and GET for an in-memory tree of files. The
+// collections are implied by the file paths.
+type davServer struct {
+	mu    sync.Mutex
+	files map[string]davFile // keyed by absolute path
+	gets  map[string]int
+}
+
+var davModTime = time.Date(2024, 2, 1, 10, 0, 0, 0, time.UTC)
+
+func (s *davServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := strings.TrimSuffix(r.URL.Path, "/")
+	switch r.Method {
+	case http.MethodGet:
+		f, ok := s.files[p]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		s.gets[p]++
+		sum := sha256.Sum256([]byte(f.body))
+		if f.badDigest {
+			sum = sha256.Sum256([]byte("something else"))
+		}
+		w.Header().Set("Digest", "sha-256="+base64.StdEncoding.EncodeToString(sum[:]))
+		w.Header().Set("ETag", f.etag)
+		http.ServeContent(w, r, "", davModTime, strings.NewReader(f.body))
+	case "PROPFIND":
+		var out strings.Builder
+		out.WriteString(`<?xml version="1.0"?><D:multistatus xmlns:D="DAV:">`)
+		if f, ok := s.files[p]; ok {
+			writeDAVResponse(&out, p, &f)
+		} else {
+			writeDAVResponse(&out, p+"/", nil)
+			children := map[string]*davFile{}
+			for name, f := range s.files {
+				rest := strings.TrimPrefix(name, p+"/")
+				if rest == name {
+					continue
+				}
+				if dir, _, nested := strings.Cut(rest, "/"); nested {
+					children[p+"/"+dir+"/"] = nil
+				} else {
+					f := f
+					children[name] = &f
+				}
+			}
+			names := make([]string, 0, len(children))
+			for name := range children {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				writeDAVResponse(&out, name, children[name])
+			}
+		}
+		out.WriteString(`</D:multistatus>`)
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(http.StatusMultiStatus)
+		fmt.Fprint(w, out.String())
+	default:
+		http.Error(w, "not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// writeDAVResponse describes a file, or a collection when f is nil
+func writeDAVResponse(out *strings.Builder, href string, f *davFile) {
+	fmt.Fprintf(out, `<D:response><D:href>%s</D:href><D:propstat><D:prop>`, href)
+	if f == nil {
+		out.WriteString(`<D:resourcetype><D:collection/></D:resourcetype>`)
+	} else {
+		fmt.Fprintf(out, `<D:resourcetype/><D:getcontentlength>%d</D:getcontentlength><D:getetag>%s</D:getetag><D:getlastmodified>%s</D:getlastmodified>`,
+			len(f.body), f.etag, davModTime.Format(http.TimeFormat))
+	}
+	out.WriteString(`</D:prop><D:status>HTTP/1.1 200 OK</D:status></D:propstat></D:response>`)
+}
+
+func (s *davServer) set(p string, f davFile) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[p] = f
+}
+
+// fetched returns and resets the number of GET requests per path
+func (s *davServer) fetched() map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	gets := s.gets
+	s.gets = map[string]int{}
+	return gets
+}
+
+func newDAVServer(t *testing.T, files map[string]davFile) (*davServer, string) {
+	s := &davServer{files: files, gets: map[string]int{}}
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	return s, "webdav" + strings.TrimPrefix(srv.URL, "http")
+}
+
+// mirrorDAV mirrors the collection at u into dir
+func mirrorDAV(u, dir string) error {
+	return downloadWithRetry(context.Background(), &Config{URL: u, FilePath: dir, Quiet: true})
+}
+
+func TestWebDAVMirrorSkipsUnchangedFiles(t *testing.T) {
+	s, base := newDAVServer(t, map[string]davFile{
+		"/docs/a.txt":       {body: "alpha", etag: `"a1"`},
+		"/docs/sub/b.txt":   {body: "bravo", etag: `"b1"`},
+		"/docs/sub/c/d.txt": {body: "delta", etag: `"d1"`},
+		"/other/x.txt":      {body: "outside", etag: `"x1"`},
+	})
+	dir := filepath.Join(t.TempDir(), "docs")
+
+	if err := mirrorDAV(base+"/docs/", dir); err != nil {
+		t.Fatal(err)
+	}
+	for rel, want := range map[string]string{"a.txt": "alpha", "sub/b.txt": "bravo", "sub/c/d.txt": "delta"} {
+		if got, _ := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(rel))); string(got) != want {
+			t.Errorf("%s = %q, want %q", rel, got, want)
+		}
+	}
+	if gets := s.fetched(); len(gets) != 3 || gets["/other/x.txt"] != 0 {
+		t.Errorf("first run fetched %v, want the three files in the collection", gets)
+	}
+
+	if err := mirrorDAV(base+"/docs/", dir); err != nil {
+		t.Fatal(err)
+	}
+	if gets := s.fetched(); len(gets) != 0 {
+		t.Errorf("second run fetched %v, want nothing", gets)
+	}
+
+	s.set("/docs/sub/b.txt", davFile{body: "bravo v2", etag: `"b2"`})
+	if err := mirrorDAV(base+"/docs/", dir); err != nil {
+		t.Fatal(err)
+	}
+	if gets := s.fetched(); len(gets) != 1 || gets["/docs/sub/b.txt"] != 1 {
+		t.Errorf("run after a change fetched %v, want only sub/b.txt", gets)
+	}
+	if got, _ := ioutil.ReadFile(filepath.Join(dir, "sub", "b.txt")); string(got) != "bravo v2" {
+		t.Errorf("sub/b.txt = %q after the change", got)
+	}
+}
+
+func TestWebDAVVerifiesDigest(t *testing.T) {
+	s, base := newDAVServer(t, map[string]davFile{
+		"/docs/good.txt": {body: "good", etag: `"g1"`},
+		"/docs/bad.txt":  {body: "bad", etag: `"b1"`, badDigest: true},
+	})
+
+	// A single file is checked by downloadWithRetry
+	err := downloadWithRetry(context.Background(), &Config{URL: base + "/docs/bad.txt", FilePath: filepath.Join(t.TempDir(), "bad.txt"), Quiet: true})
+	var checksumErr *ChecksumError
+	if !errors.As(err, &checksumErr) {
+		t.Fatalf("single file download = %v, want a ChecksumError", err)
+	}
+
+	// Each file of a collection is checked as it completes
+	dir := t.TempDir()
+	err = mirrorDAV(base+"/docs/", dir)
+	if !errors.As(err, &checksumErr) || !strings.Contains(err.Error(), "bad.txt") {
+		t.Fatalf("mirror = %v, want a ChecksumError for bad.txt", err)
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(dir, davManifestName))
+	var manifest map[string]davRecord
+	json.Unmarshal(data, &manifest)
+	if manifest["bad.txt"].Complete {
+		t.Error("the manifest records bad.txt as complete")
+	}
+
+	// The bad copy is fetched again on the next run
+	s.fetched()
+	s.set("/docs/bad.txt", davFile{body: "bad", etag: `"b1"`})
+	if err := mirrorDAV(base+"/docs/", dir); err != nil {
+		t.Fatal(err)
+	}
+	if gets := s.fetched(); gets["/docs/bad.txt"] != 1 {
+		t.Errorf("run after the failure fetched %v, want bad.txt again", gets)
+	}
+}
+
+func TestWebDAVSkipsManifestName(t *testing.T) {
+	s, base := newDAVServer(t, map[string]davFile{
+		"/docs/a.txt":                  {body: "alpha", etag: `"a1"`},
+		"/docs/" + davManifestName:     {body: "not a manifest", etag: `"m1"`},
+		"/docs/sub/" + davManifestName: {body: "nested", etag: `"n1"`},
+	})
+	dir := t.TempDir()
+	for run := 0; run < 2; run++ {
+		if err := mirrorDAV(base+"/docs/", dir); err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, davManifestName))
+		var manifest map[string]davRecord
+		if err != nil || json.Unmarshal(data, &manifest) != nil {
+			t.Fatalf("run %d: manifest = %q, %v", run+1, data, err)
+		}
+		if !manifest["a.txt"].Complete {
+			t.Errorf("run %d: manifest = %v, want a.txt complete", run+1, manifest)
+		}
+	}
+	// Only the top-level name is reserved
+	if got, _ := ioutil.ReadFile(filepath.Join(dir, "sub", davManifestName)); string(got) != "nested" {
+		t.Errorf("sub/%s = %q", davManifestName, got)
+	}
+	if gets := s.fetched(); gets["/docs/"+davManifestName] != 0 || gets["/docs/a.txt"] != 1 {
+		t.Errorf("fetched %v", gets)
+	}
+}
+
+func TestDAVRelPath(t *testing.T) {
+	root, _ := url.Parse("http://host/docs/")
+	m := &davMirror{root: root}
+	tests := []struct {
+		path string
+		want string // "" when outside the root
+	}{
+		{"/docs/a.txt", "a.txt"},
+		{"/docs/sub/b.txt", "sub/b.txt"},
+		{"/docs/", ""},
+		{"/docs", ""},
+		{"/docsother/a.txt", ""},
+		{"/docs/../etc/passwd", "etc/passwd"},
+	}
+	for _, tt := range tests {
+		u, _ := url.Parse("http://host" + tt.path)
+		got, ok := m.relPath(u)
+		if ok != (tt.want != "") || got != tt.want {
+			t.Errorf("relPath(%s) = %q, %v; want %q", tt.path, got, ok, tt.want)
+		}
+		if ok && strings.HasPrefix(path.Clean(got), "..") {
+			t.Errorf("relPath(%s) = %q escapes the root", tt.path, got)
+		}
+	}
+}